@@ -1,17 +1,21 @@
 package config
 
 type Config struct {
-	Ip           string `json:"ip,omitempty" toml:"ip" yaml:"ip,omitempty" hcl:"ip"`
-	Port         int    `json:"port,omitempty" toml:"port" yaml:"port,omitempty" hcl:"port"`
-	Username     string `json:"username,omitempty" toml:"username" yaml:"username,omitempty" hcl:"username"`
-	Password     string `json:"password,omitempty" toml:"password" yaml:"password,omitempty" hcl:"password"`
-	LogLevel     string `json:"log_level,omitempty" toml:"log_level" yaml:"log_level,omitempty" hcl:"log_level"`
-	Syslog       bool   `json:"syslog,omitempty" toml:"syslog" yaml:"syslog,omitempty" hcl:"syslog"`
-	MaxJobBytes  int64  `json:"max_job_bytes,omitempty" toml:"max_job_bytes" yaml:"max_job_bytes,omitempty" hcl:"max_job_bytes"`
-	*Tls         `json:"tls,omitempty" toml:"tls" yaml:"tls,omitempty" hcl:"tls" hcl:"tls"`
-	*DataStore   `json:"data_store,omitempty" toml:"data_store" yaml:"data_store,omitempty" hcl:"data_store"`
-	*JobStore    `json:"job_store,omitempty" toml:"job_store" yaml:"job_store,omitempty" hcl:"job_store"`
-	*DeviceStore `json:"device_store,omitempty" toml:"device_store" yaml:"device_store,omitempty" hcl:"device_store"`
+	Ip                 string `json:"ip,omitempty" toml:"ip" yaml:"ip,omitempty" hcl:"ip"`
+	Port               int    `json:"port,omitempty" toml:"port" yaml:"port,omitempty" hcl:"port"`
+	Username           string `json:"username,omitempty" toml:"username" yaml:"username,omitempty" hcl:"username"`
+	Password           string `json:"password,omitempty" toml:"password" yaml:"password,omitempty" hcl:"password"`
+	LogLevel           string `json:"log_level,omitempty" toml:"log_level" yaml:"log_level,omitempty" hcl:"log_level"`
+	Syslog             bool   `json:"syslog,omitempty" toml:"syslog" yaml:"syslog,omitempty" hcl:"syslog"`
+	MaxJobBytes        int64  `json:"max_job_bytes,omitempty" toml:"max_job_bytes" yaml:"max_job_bytes,omitempty" hcl:"max_job_bytes"`
+	HistorySize        int    `json:"history_size,omitempty" toml:"history_size" yaml:"history_size,omitempty" hcl:"history_size"`
+	IncomingDir        string `json:"incoming_dir,omitempty" toml:"incoming_dir" yaml:"incoming_dir,omitempty" hcl:"incoming_dir"`
+	TofuKnownHostsFile string `json:"tofu_known_hosts_file,omitempty" toml:"tofu_known_hosts_file" yaml:"tofu_known_hosts_file,omitempty" hcl:"tofu_known_hosts_file"`
+	*Tls               `json:"tls,omitempty" toml:"tls" yaml:"tls,omitempty" hcl:"tls" hcl:"tls"`
+	DataStores         DataStoreList `json:"data_store,omitempty" toml:"data_store" yaml:"data_store,omitempty" hcl:"data_store"`
+	*JobStore          `json:"job_store,omitempty" toml:"job_store" yaml:"job_store,omitempty" hcl:"job_store"`
+	*DeviceStore       `json:"device_store,omitempty" toml:"device_store" yaml:"device_store,omitempty" hcl:"device_store"`
+	*Scheduler         `json:"scheduler,omitempty" toml:"scheduler" yaml:"scheduler,omitempty" hcl:"scheduler"`
 }
 
 type Tls struct {
@@ -19,18 +23,52 @@ type Tls struct {
 	KeyFile  string `json:"key_file,omitempty" toml:"key_file" yaml:"key_file,omitempty" hcl:"key_file"`
 }
 
+// DataStoreList can be given as a single data store or a list of them
+type DataStoreList []*DataStore
+
 type DataStore struct {
-	Type          string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
-	*DataStoreGit `json:"git,omitempty" toml:"git" yaml:"git,omitempty" hcl:"git"`
+	Name                 string `json:"name,omitempty" toml:"name" yaml:"name,omitempty" hcl:"name"`
+	Type                 string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
+	*DataStoreGit        `json:"git,omitempty" toml:"git" yaml:"git,omitempty" hcl:"git"`
+	*DataStoreFilesystem `json:"filesystem,omitempty" toml:"filesystem" yaml:"filesystem,omitempty" hcl:"filesystem"`
+	*DataStoreS3         `json:"s3,omitempty" toml:"s3" yaml:"s3,omitempty" hcl:"s3"`
+}
+
+type DataStoreFilesystem struct {
+	Directory  string   `json:"directory,omitempty" toml:"directory" yaml:"directory,omitempty" hcl:"directory"`
+	Structure  []string `json:"structure,omitempty" toml:"structure" yaml:"structure,omitempty" hcl:"structure"`
+	Retention  int      `json:"retention,omitempty" toml:"retention" yaml:"retention,omitempty" hcl:"retention"`
+	LatestLink bool     `json:"latest_link,omitempty" toml:"latest_link" yaml:"latest_link,omitempty" hcl:"latest_link"`
+}
+
+type DataStoreS3 struct {
+	Endpoint       string   `json:"endpoint,omitempty" toml:"endpoint" yaml:"endpoint,omitempty" hcl:"endpoint"`
+	Region         string   `json:"region,omitempty" toml:"region" yaml:"region,omitempty" hcl:"region"`
+	Bucket         string   `json:"bucket,omitempty" toml:"bucket" yaml:"bucket,omitempty" hcl:"bucket"`
+	Prefix         string   `json:"prefix,omitempty" toml:"prefix" yaml:"prefix,omitempty" hcl:"prefix"`
+	PathStyle      bool     `json:"path_style,omitempty" toml:"path_style" yaml:"path_style,omitempty" hcl:"path_style"`
+	Structure      []string `json:"structure,omitempty" toml:"structure" yaml:"structure,omitempty" hcl:"structure"`
+	AccessKey      string   `json:"access_key,omitempty" toml:"access_key" yaml:"access_key,omitempty" hcl:"access_key"`
+	SecretKey      string   `json:"secret_key,omitempty" toml:"secret_key" yaml:"secret_key,omitempty" hcl:"secret_key"`
+	SessionToken   string   `json:"session_token,omitempty" toml:"session_token" yaml:"session_token,omitempty" hcl:"session_token"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty" toml:"timeout_seconds" yaml:"timeout_seconds,omitempty" hcl:"timeout_seconds"`
 }
 
 type DataStoreGit struct {
 	Url                    string `json:"url,omitempty" toml:"url" yaml:"url" hcl:"url"`
+	Directory              string `json:"directory,omitempty" toml:"directory" yaml:"directory,omitempty" hcl:"directory"`
 	*DataStoreGitUser      `json:"user,omitempty" toml:"user" yaml:"user,omitempty" hcl:"user"`
+	*DataStoreGitSsh       `json:"ssh,omitempty" toml:"ssh" yaml:"ssh,omitempty" hcl:"ssh"`
 	PoolSize               int      `json:"pool_size,omitempty" toml:"pool_size" yaml:"pool_size,omitempty" hcl:"pool_size"`
 	Structure              []string `json:"structure,omitempty" toml:"structure" yaml:"structure,omitempty" hcl:"structure"`
 	IncludeReadmeOverviews bool     `json:"include_readme_overviews,omitempty" toml:"include_readme_overviews" yaml:"include_readme_overviews,omitempty" hcl:"include_readme_overviews"`
 	DataDir                string   `json:"data_dir,omitempty" toml:"data_dir" yaml:"data_dir,omitempty" hcl:"data_dir"`
+	Backend                string   `json:"backend,omitempty" toml:"backend" yaml:"backend,omitempty" hcl:"backend"`
+	TimeoutSeconds         int      `json:"timeout_seconds,omitempty" toml:"timeout_seconds" yaml:"timeout_seconds,omitempty" hcl:"timeout_seconds"`
+	Bare                   bool     `json:"bare,omitempty" toml:"bare" yaml:"bare,omitempty" hcl:"bare"`
+	PushRetrySeconds       int      `json:"push_retry_seconds,omitempty" toml:"push_retry_seconds" yaml:"push_retry_seconds,omitempty" hcl:"push_retry_seconds"`
+	PushRetryMaxSeconds    int      `json:"push_retry_max_seconds,omitempty" toml:"push_retry_max_seconds" yaml:"push_retry_max_seconds,omitempty" hcl:"push_retry_max_seconds"`
+	CommitPolicy           string   `json:"commit_policy,omitempty" toml:"commit_policy" yaml:"commit_policy,omitempty" hcl:"commit_policy"`
 }
 
 type DataStoreGitUser struct {
@@ -40,6 +78,12 @@ type DataStoreGitUser struct {
 	Pass         string `json:"pass,omitempty" toml:"pass" yaml:"pass,omitempty" hcl:"pass"`
 }
 
+type DataStoreGitSsh struct {
+	KeyFile        string `json:"key_file,omitempty" toml:"key_file" yaml:"key_file,omitempty" hcl:"key_file"`
+	KeyPassphrase  string `json:"key_passphrase,omitempty" toml:"key_passphrase" yaml:"key_passphrase,omitempty" hcl:"key_passphrase"`
+	KnownHostsFile string `json:"known_hosts_file,omitempty" toml:"known_hosts_file" yaml:"known_hosts_file,omitempty" hcl:"known_hosts_file"`
+}
+
 type JobStore struct {
 	Type           string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
 	*JobStoreLocal `json:"local,omitempty" toml:"local" yaml:"local,omitempty" hcl:"local"`
@@ -59,6 +103,22 @@ type Job struct {
 	JobFile        map[string]*JobFile `json:"file,omitempty" toml:"file" yaml:"file,omitempty" hcl:"file"`
 	Scrubbers      []*JobScrubber      `json:"scrubbers,omitempty" toml:"scrubbers" yaml:"scrubbers,omitempty" hcl:"scrubbers"`
 	TemplateValues map[string]string   `json:"template_values,omitempty" toml:"template_values" yaml:"template_values,omitempty" hcl:"template_values"`
+	CommitPolicy   string              `json:"commit_policy,omitempty" toml:"commit_policy" yaml:"commit_policy,omitempty" hcl:"commit_policy"`
+	FileExtension  string              `json:"file_extension,omitempty" toml:"file_extension" yaml:"file_extension,omitempty" hcl:"file_extension"`
+	Timeout        int                 `json:"timeout,omitempty" toml:"timeout" yaml:"timeout,omitempty" hcl:"timeout"`
+	Prompt         string              `json:"prompt,omitempty" toml:"prompt" yaml:"prompt,omitempty" hcl:"prompt"`
+	Pagers         []*Pager            `json:"pager,omitempty" toml:"pager" yaml:"pager,omitempty" hcl:"pager"`
+	*JobNormalize  `json:"normalize,omitempty" toml:"normalize" yaml:"normalize,omitempty" hcl:"normalize"`
+	*JobRetry      `json:"retry,omitempty" toml:"retry" yaml:"retry,omitempty" hcl:"retry"`
+	*JobHttp       `json:"http,omitempty" toml:"http" yaml:"http,omitempty" hcl:"http"`
+}
+
+type JobHttp struct {
+	Method       string            `json:"method,omitempty" toml:"method" yaml:"method,omitempty" hcl:"method"`
+	Path         string            `json:"path,omitempty" toml:"path" yaml:"path,omitempty" hcl:"path"`
+	Headers      map[string]string `json:"headers,omitempty" toml:"headers" yaml:"headers,omitempty" hcl:"headers"`
+	Body         string            `json:"body,omitempty" toml:"body" yaml:"body,omitempty" hcl:"body"`
+	ExpectStatus []int             `json:"expect_status,omitempty" toml:"expect_status" yaml:"expect_status,omitempty" hcl:"expect_status"`
 }
 
 type JobSchedule struct {
@@ -80,6 +140,25 @@ type JobFile struct {
 	Compression string `json:"compression,omitempty" toml:"compression" yaml:"compression,omitempty" hcl:"compression"`
 }
 
+type JobRetry struct {
+	MaxAttempts       *int     `json:"max_attempts,omitempty" toml:"max_attempts" yaml:"max_attempts,omitempty" hcl:"max_attempts"`
+	BackoffSeconds    *int     `json:"backoff_seconds,omitempty" toml:"backoff_seconds" yaml:"backoff_seconds,omitempty" hcl:"backoff_seconds"`
+	BackoffMaxSeconds *int     `json:"backoff_max_seconds,omitempty" toml:"backoff_max_seconds" yaml:"backoff_max_seconds,omitempty" hcl:"backoff_max_seconds"`
+	On                []string `json:"on,omitempty" toml:"on" yaml:"on,omitempty" hcl:"on"`
+}
+
+type JobNormalize struct {
+	StripEcho         *bool  `json:"strip_echo,omitempty" toml:"strip_echo" yaml:"strip_echo,omitempty" hcl:"strip_echo"`
+	StripPromptLines  string `json:"strip_prompt_lines,omitempty" toml:"strip_prompt_lines" yaml:"strip_prompt_lines,omitempty" hcl:"strip_prompt_lines"`
+	NormalizeNewlines *bool  `json:"normalize_newlines,omitempty" toml:"normalize_newlines" yaml:"normalize_newlines,omitempty" hcl:"normalize_newlines"`
+	StripAnsi         *bool  `json:"strip_ansi,omitempty" toml:"strip_ansi" yaml:"strip_ansi,omitempty" hcl:"strip_ansi"`
+}
+
+type Pager struct {
+	Pattern string  `json:"pattern,omitempty" toml:"pattern" yaml:"pattern,omitempty" hcl:"pattern"`
+	Send    *string `json:"send,omitempty" toml:"send" yaml:"send,omitempty" hcl:"send"`
+}
+
 type JobScrubber struct {
 	Type    string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
 	Search  string `json:"search,omitempty" toml:"search" yaml:"search,omitempty" hcl:"search"`
@@ -103,11 +182,22 @@ type Device struct {
 	Tags               []string `json:"tags,omitempty" toml:"tags" yaml:"tags,omitempty" hcl:"tags"`
 	*DeviceCredentials `json:"credentials,omitempty" toml:"credentials" yaml:"credentials,omitempty" hcl:"credentials"`
 	Jobs               map[string]*Job `json:"jobs,omitempty" toml:"jobs" yaml:"jobs,omitempty" hcl:"jobs"`
+	Prompt             string          `json:"prompt,omitempty" toml:"prompt" yaml:"prompt,omitempty" hcl:"prompt"`
+	Pagers             []*Pager        `json:"pager,omitempty" toml:"pager" yaml:"pager,omitempty" hcl:"pager"`
+	*DeviceHostKey     `json:"host_key,omitempty" toml:"host_key" yaml:"host_key,omitempty" hcl:"host_key"`
+}
+
+type DeviceHostKey struct {
+	Policy         string   `json:"policy,omitempty" toml:"policy" yaml:"policy,omitempty" hcl:"policy"`
+	KnownHostsFile string   `json:"known_hosts_file,omitempty" toml:"known_hosts_file" yaml:"known_hosts_file,omitempty" hcl:"known_hosts_file"`
+	Fingerprints   []string `json:"fingerprints,omitempty" toml:"fingerprints" yaml:"fingerprints,omitempty" hcl:"fingerprints"`
 }
 
 type DeviceProtocol struct {
-	Type               string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
-	*DeviceProtocolSsh `json:"ssh,omitempty" toml:"ssh" yaml:"ssh,omitempty" hcl:"ssh"`
+	Type                  string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
+	*DeviceProtocolSsh    `json:"ssh,omitempty" toml:"ssh" yaml:"ssh,omitempty" hcl:"ssh"`
+	*DeviceProtocolTelnet `json:"telnet,omitempty" toml:"telnet" yaml:"telnet,omitempty" hcl:"telnet"`
+	*DeviceProtocolHttp   `json:"http,omitempty" toml:"http" yaml:"http,omitempty" hcl:"http"`
 }
 
 type DeviceProtocolSsh struct {
@@ -115,7 +205,48 @@ type DeviceProtocolSsh struct {
 	IncludeCbcCiphers bool `json:"include_cbc_ciphers,omitempty" toml:"include_cbc_ciphers" yaml:"include_cbc_ciphers,omitempty" hcl:"include_cbc_ciphers"`
 }
 
+type DeviceProtocolTelnet struct {
+	Port           int    `json:"port,omitempty" toml:"port" yaml:"port,omitempty" hcl:"port"`
+	LoginPrompt    string `json:"login_prompt,omitempty" toml:"login_prompt" yaml:"login_prompt,omitempty" hcl:"login_prompt"`
+	PasswordPrompt string `json:"password_prompt,omitempty" toml:"password_prompt" yaml:"password_prompt,omitempty" hcl:"password_prompt"`
+}
+
+type DeviceProtocolHttp struct {
+	Port               int    `json:"port,omitempty" toml:"port" yaml:"port,omitempty" hcl:"port"`
+	Tls                *bool  `json:"tls,omitempty" toml:"tls" yaml:"tls,omitempty" hcl:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty" toml:"insecure_skip_verify" yaml:"insecure_skip_verify,omitempty" hcl:"insecure_skip_verify"`
+	CaFile             string `json:"ca_file,omitempty" toml:"ca_file" yaml:"ca_file,omitempty" hcl:"ca_file"`
+}
+
 type DeviceCredentials struct {
-	User string `json:"user,omitempty" toml:"user" yaml:"user,omitempty" hcl:"user"`
-	Pass string `json:"pass,omitempty" toml:"pass" yaml:"pass,omitempty" hcl:"pass"`
+	User                string                       `json:"user,omitempty" toml:"user" yaml:"user,omitempty" hcl:"user"`
+	Pass                string                       `json:"pass,omitempty" toml:"pass" yaml:"pass,omitempty" hcl:"pass"`
+	Key                 string                       `json:"key,omitempty" toml:"key" yaml:"key,omitempty" hcl:"key"`
+	KeyFile             string                       `json:"key_file,omitempty" toml:"key_file" yaml:"key_file,omitempty" hcl:"key_file"`
+	KeyPassphrase       string                       `json:"key_passphrase,omitempty" toml:"key_passphrase" yaml:"key_passphrase,omitempty" hcl:"key_passphrase"`
+	Agent               *bool                        `json:"agent,omitempty" toml:"agent" yaml:"agent,omitempty" hcl:"agent"`
+	Token               string                       `json:"token,omitempty" toml:"token" yaml:"token,omitempty" hcl:"token"`
+	KeyboardInteractive []*KeyboardInteractiveAnswer `json:"keyboard_interactive,omitempty" toml:"keyboard_interactive" yaml:"keyboard_interactive,omitempty" hcl:"keyboard_interactive"`
+	AuthOrder           []string                     `json:"auth_order,omitempty" toml:"auth_order" yaml:"auth_order,omitempty" hcl:"auth_order"`
+}
+
+type KeyboardInteractiveAnswer struct {
+	Prompt string `json:"prompt,omitempty" toml:"prompt" yaml:"prompt,omitempty" hcl:"prompt"`
+	Answer string `json:"answer,omitempty" toml:"answer" yaml:"answer,omitempty" hcl:"answer"`
+}
+
+type Scheduler struct {
+	MissedRuns      string `json:"missed_runs,omitempty" toml:"missed_runs" yaml:"missed_runs,omitempty" hcl:"missed_runs"`
+	LeaseSeconds    int    `json:"lease_seconds,omitempty" toml:"lease_seconds" yaml:"lease_seconds,omitempty" hcl:"lease_seconds"`
+	LeaseRetries    *int   `json:"lease_retries,omitempty" toml:"lease_retries" yaml:"lease_retries,omitempty" hcl:"lease_retries"`
+	*SchedulerState `json:"state,omitempty" toml:"state" yaml:"state,omitempty" hcl:"state"`
+}
+
+type SchedulerState struct {
+	Type                string `json:"type,omitempty" toml:"type" yaml:"type,omitempty" hcl:"type"`
+	*SchedulerStateFile `json:"file,omitempty" toml:"file" yaml:"file,omitempty" hcl:"file"`
+}
+
+type SchedulerStateFile struct {
+	Path string `json:"path,omitempty" toml:"path" yaml:"path,omitempty" hcl:"path"`
 }
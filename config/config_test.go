@@ -328,6 +328,60 @@ func TestHCLUnmarshal(t *testing.T) {
 	assertValidConfig(t, hcl, config.HCLFormat)
 }
 
+func TestDataStoreList(t *testing.T) {
+	tests := []struct {
+		format   config.Format
+		contents string
+	}{
+		{config.JSONFormat, `{"data_store": [
+			{"name": "primary", "type": "git", "git": {"url": "someurl1"}},
+			{"name": "archive", "type": "filesystem", "filesystem": {"directory": "somedir2"}}
+		]}`},
+		{config.YAMLFormat, `
+data_store:
+  - name: primary
+    type: git
+    git:
+      url: someurl1
+  - name: archive
+    type: filesystem
+    filesystem:
+      directory: somedir2
+`},
+		{config.TOMLFormat, `
+[[data_store]]
+name = "primary"
+type = "git"
+  [data_store.git]
+    url = "someurl1"
+
+[[data_store]]
+name = "archive"
+type = "filesystem"
+  [data_store.filesystem]
+    directory = "somedir2"
+`},
+	}
+	expected := config.DataStoreList{
+		&config.DataStore{Name: "primary", Type: "git", DataStoreGit: &config.DataStoreGit{Url: "someurl1"}},
+		&config.DataStore{
+			Name:                "archive",
+			Type:                "filesystem",
+			DataStoreFilesystem: &config.DataStoreFilesystem{Directory: "somedir2"},
+		},
+	}
+	for _, test := range tests {
+		conf, err := config.NewFromBytes([]byte(test.contents), test.format)
+		if err != nil {
+			t.Fatalf("Unable to read %v: %v", test.format, err)
+		}
+		if !reflect.DeepEqual(conf.DataStores, expected) {
+			actual, _ := conf.ToJSON(true)
+			t.Fatalf("Not equal for %v, actual:\n%v", test.format, string(actual))
+		}
+	}
+}
+
 func assertValidConfig(t *testing.T, contents string, format config.Format) {
 	conf, err := config.NewFromBytes([]byte(contents), format)
 	if err != nil {
@@ -427,15 +481,17 @@ var simpleConfig *config.Config = &config.Config{
 			},
 		},
 	},
-	DataStore: &config.DataStore{
-		Type: "git",
-		DataStoreGit: &config.DataStoreGit{
-			Url:      "someurl1",
-			PoolSize: 1,
-			DataDir:  "somedir1",
-			DataStoreGitUser: &config.DataStoreGitUser{
-				FriendlyName: "John Doe",
-				Email:        "jdoe@example.com",
+	DataStores: []*config.DataStore{
+		&config.DataStore{
+			Type: "git",
+			DataStoreGit: &config.DataStoreGit{
+				Url:      "someurl1",
+				PoolSize: 1,
+				DataDir:  "somedir1",
+				DataStoreGitUser: &config.DataStoreGitUser{
+					FriendlyName: "John Doe",
+					Email:        "jdoe@example.com",
+				},
 			},
 		},
 	},
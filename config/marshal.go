@@ -1,6 +1,7 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/BurntSushi/toml"
@@ -96,3 +97,61 @@ func (c *Config) ToJSON(pretty bool) ([]byte, error) {
 	}
 	return json.Marshal(c)
 }
+
+func (d *DataStoreList) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		single := new(DataStore)
+		if err := json.Unmarshal(data, single); err != nil {
+			return err
+		}
+		*d = DataStoreList{single}
+		return nil
+	}
+	var list []*DataStore
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*d = list
+	return nil
+}
+
+func (d *DataStoreList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []*DataStore
+	if err := unmarshal(&list); err == nil {
+		*d = list
+		return nil
+	}
+	single := new(DataStore)
+	if err := unmarshal(single); err != nil {
+		return err
+	}
+	*d = DataStoreList{single}
+	return nil
+}
+
+// The TOML decoder only gives us the parsed values, so they are encoded again
+// and decoded as a table or an array of tables
+func (d *DataStoreList) UnmarshalTOML(data interface{}) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{"data_store": data}); err != nil {
+		return err
+	}
+	if _, ok := data.(map[string]interface{}); ok {
+		single := struct {
+			DataStore *DataStore `toml:"data_store"`
+		}{}
+		if _, err := toml.Decode(buf.String(), &single); err != nil {
+			return err
+		}
+		*d = DataStoreList{single.DataStore}
+		return nil
+	}
+	list := struct {
+		DataStores []*DataStore `toml:"data_store"`
+	}{}
+	if _, err := toml.Decode(buf.String(), &list); err != nil {
+		return err
+	}
+	*d = list.DataStores
+	return nil
+}
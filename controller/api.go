@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"gitlab.com/cretz/fusty/model"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -15,10 +17,15 @@ import (
 // 500 meg
 const MaxJobBytes int64 = 524288000
 
+// Every form value but the file is small
+const maxFormValueBytes = 1048576
+
 func (c *Controller) addApiHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/worker/ping", c.authedWebCall(c.apiWorkerPing))
 	mux.HandleFunc("/worker/next", c.authedWebCall(c.apiWorkerNext))
 	mux.HandleFunc("/worker/complete", c.authedWebCall(c.apiWorkerComplete))
+	mux.HandleFunc("/history", c.authedWebCall(c.apiHistory))
+	mux.HandleFunc("/data_store/status", c.authedWebCall(c.apiDataStoreStatus))
 }
 
 func (c *Controller) apiWorkerPing(w http.ResponseWriter, req *http.Request) {
@@ -64,6 +71,11 @@ func (c *Controller) apiWorkerNext(w http.ResponseWriter, req *http.Request) {
 		if execution := c.NextExecution(tags, fromNow); execution == nil {
 			break
 		} else {
+			// Without its keys the worker fails the execution for the host key
+			if execution.HostKeys, err = c.hostKeys.hostKeys(execution.Device); err != nil {
+				c.errLog.Printf("Unable to get host keys for device %v: %v", execution.Device.Name, err)
+				execution.HostKeysError = err.Error()
+			}
 			executions = append(executions, execution)
 		}
 	}
@@ -89,60 +101,199 @@ func (c *Controller) apiWorkerComplete(w http.ResponseWriter, req *http.Request)
 	if c.conf.MaxJobBytes != 0 {
 		maxBytes = c.conf.MaxJobBytes
 	}
-	if err := req.ParseMultipartForm(maxBytes); err != nil {
+	values, contents, err := c.readWorkerComplete(req, maxBytes)
+	if err == errJobContentsTooLarge {
+		http.Error(w, fmt.Sprintf("File larger than %v bytes", maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		http.Error(w, "Invalid form", http.StatusBadRequest)
 		return
 	}
-	// Try to read contents
-	contents := []byte{}
-	if files := req.MultipartForm.File["file"]; len(files) == 1 {
-		f, err := files[0].Open()
-		if err != nil {
-			http.Error(w, "Unable to read file: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer f.Close()
-		contents, err = ioutil.ReadAll(f)
-		if err != nil {
-			http.Error(w, "Unable to read file: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
 	// Build job and validate
 	job := &DataStoreJob{
-		JobName:    singleMutlipartFormValOrEmpty("job", req),
-		DeviceName: singleMutlipartFormValOrEmpty("device", req),
-		JobTime:    timestampOrZero("job_timestamp", req),
-		StartTime:  timestampOrZero("start_timestamp", req),
-		EndTime:    timestampOrZero("end_timestamp", req),
-		Failure:    singleMutlipartFormValOrEmpty("failure", req),
-		Contents:   contents,
+		JobName:    values["job"],
+		DeviceName: values["device"],
+		JobTime:    timestampOrZero(values["job_timestamp"]),
+		StartTime:  timestampOrZero(values["start_timestamp"]),
+		EndTime:    timestampOrZero(values["end_timestamp"]),
+		Failure:    values["failure"],
+	}
+	if contents != nil {
+		job.Contents = contents
+	}
+	if attempts := values["attempts"]; attempts != "" {
+		if err := json.Unmarshal([]byte(attempts), &job.Attempts); err != nil {
+			http.Error(w, "Invalid attempts: "+err.Error(), http.StatusBadRequest)
+			if contents != nil {
+				contents.remove()
+			}
+			return
+		}
 	}
 	if job.JobName == "" || job.DeviceName == "" ||
 		job.JobTime.IsZero() || job.StartTime.IsZero() || job.EndTime.IsZero() {
 		http.Error(w,
 			"Fields job, device, job_timestamp, start_timestamp, end_timestamp are required", http.StatusBadRequest)
+		if contents != nil {
+			contents.remove()
+		}
 		return
-	} else if job.Failure == "" && len(job.Contents) == 0 {
+	} else if job.Failure == "" && !job.hasContents() {
 		http.Error(w, "Failure and contents may not both be empty", http.StatusBadRequest)
 		return
 	}
-	// We log failures, we do not store them
+	if device, ok := c.AllDevices()[job.DeviceName]; ok {
+		if deviceJob, ok := device.Jobs[job.JobName]; ok {
+			job.CommitPolicy = deviceJob.CommitPolicy
+		}
+		// Only sent by the worker when the device had no recorded key
+		if hostKey := values["host_key"]; hostKey != "" {
+			if err := c.hostKeys.recordFirstSeen(device, hostKey); err != nil {
+				c.errLog.Printf("Unable to record host key for device %v: %v", device.Name, err)
+			} else if Verbose {
+				log.Printf("Recorded first seen host key for device %v: %v", device.Name, hostKey)
+			}
+		}
+	}
+	c.ExecutionCompleted(job.DeviceName, job.JobName, job.JobTime, values["lease_id"])
+	c.History.Record(job)
+	// Failures are stored too, but we also log them
 	if job.Failure != "" {
 		c.errLog.Printf("Job %v on device %v at expected time %v failed. Failure: %v",
 			job.JobName, job.DeviceName, job.JobTime, job.Failure)
-	} else {
-		if Verbose {
-			log.Printf("Storing new job %v on %v at expected time of %v with contents:\n%v",
-				job.JobName, job.DeviceName, job.JobTime, string(job.Contents))
-		}
-		c.DataStore.Store(job)
+	} else if Verbose {
+		log.Printf("Storing new job %v on %v at expected time of %v with %v bytes of contents",
+			job.JobName, job.DeviceName, job.JobTime, job.Contents.Size())
 	}
+	// The data stores remove the contents when they are done with them
+	c.DataStore.Store(job)
 	w.WriteHeader(http.StatusOK)
 }
 
-func timestampOrZero(name string, req *http.Request) time.Time {
-	if str := singleMutlipartFormValOrEmpty(name, req); str == "" {
+// Reads the form values and streams the file to the incoming directory as it
+// arrives so it is never held in memory. The contents are nil if there is no
+// file or it is empty.
+func (c *Controller) readWorkerComplete(req *http.Request, maxBytes int64) (map[string]string,
+	*fileJobContents, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]string{}
+	var contents *fileJobContents
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if contents != nil {
+				contents.remove()
+			}
+			return nil, nil, err
+		}
+		if part.FormName() != "file" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+			if err == nil && len(value) > maxFormValueBytes {
+				err = fmt.Errorf("Form value %v too large", part.FormName())
+			}
+			if err != nil {
+				if contents != nil {
+					contents.remove()
+				}
+				return nil, nil, err
+			}
+			// Only the first value of each name is used
+			if _, ok := values[part.FormName()]; !ok {
+				values[part.FormName()] = string(value)
+			}
+		} else if contents == nil {
+			if contents, err = newFileJobContents(c.incomingDir(), part, maxBytes); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if contents != nil && contents.size == 0 {
+		contents.remove()
+		contents = nil
+	}
+	return values, contents, nil
+}
+
+func (c *Controller) apiHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	uri, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	deviceName := uri.Query().Get("device")
+	jobName := uri.Query().Get("job")
+	// If stale is given, we only include device jobs without a success in that many seconds
+	var staleSince time.Time
+	if staleParam := uri.Query()["stale"]; len(staleParam) == 1 {
+		if v, err := strconv.Atoi(staleParam[0]); err != nil || v < 0 {
+			http.Error(w, "Invalid stale", http.StatusBadRequest)
+			return
+		} else {
+			staleSince = time.Now().Add(-time.Duration(v) * time.Second)
+		}
+	}
+	// We go over every known device job so that ones that never ran are included
+	devices := c.AllDevices()
+	deviceNames := make([]string, 0, len(devices))
+	for name := range devices {
+		deviceNames = append(deviceNames, name)
+	}
+	sort.Strings(deviceNames)
+	histories := []*DeviceJobHistory{}
+	for _, devName := range deviceNames {
+		if deviceName != "" && devName != deviceName {
+			continue
+		}
+		jobNames := make([]string, 0, len(devices[devName].Jobs))
+		for name := range devices[devName].Jobs {
+			jobNames = append(jobNames, name)
+		}
+		sort.Strings(jobNames)
+		for _, name := range jobNames {
+			if jobName != "" && name != jobName {
+				continue
+			}
+			history := c.DeviceJobHistory(devName, name)
+			if history == nil {
+				history = &DeviceJobHistory{DeviceName: devName, JobName: name, Outcomes: []*JobOutcome{}}
+			}
+			if staleSince.IsZero() || history.LastSuccess < staleSince.Unix() {
+				histories = append(histories, history)
+			}
+		}
+	}
+	if body, err := json.Marshal(histories); err != nil {
+		http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+func (c *Controller) apiDataStoreStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if body, err := json.Marshal(c.DataStore.Status()); err != nil {
+		http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+func timestampOrZero(str string) time.Time {
+	if str == "" {
 		return time.Time{}
 	} else if i, err := strconv.ParseInt(str, 10, 0); err != nil {
 		return time.Time{}
@@ -150,11 +301,3 @@ func timestampOrZero(name string, req *http.Request) time.Time {
 		return time.Unix(i, 0)
 	}
 }
-
-func singleMutlipartFormValOrEmpty(name string, req *http.Request) string {
-	vals := req.MultipartForm.Value[name]
-	if len(vals) == 0 {
-		return ""
-	}
-	return vals[0]
-}
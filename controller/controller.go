@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/hashicorp/go-syslog"
 	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
@@ -22,7 +24,9 @@ type Controller struct {
 	DeviceStore
 	DataStore
 	Scheduler
-	started bool
+	History
+	hostKeys *hostKeyStore
+	started  bool
 }
 
 // configFileName can be empty which means default config
@@ -92,13 +96,35 @@ func NewController(conf *config.Config) (*Controller, error) {
 	} else {
 		controller.DeviceStore = deviceStore
 	}
-	if conf.DataStore == nil {
-		return nil, errors.New("Data store configuration not found")
-	} else if dataStore, err := NewDataStoreFromConfig(conf.DataStore); err != nil {
-		return nil, fmt.Errorf("Unable to create data store: %v", err)
+	// History is needed first to record data store outcomes
+	if conf.HistorySize < 0 {
+		return nil, errors.New("History size cannot be negative")
+	}
+	historySize := conf.HistorySize
+	if historySize == 0 {
+		historySize = DefaultHistorySize
+	}
+	if history, err := controller.newHistory(historySize); err != nil {
+		return nil, fmt.Errorf("Unable to create history: %v", err)
+	} else {
+		controller.History = history
+	}
+	if dataStore, err := NewDataStoresFromConfig(conf.DataStores, controller.DeviceStore, controller.History); err != nil {
+		return nil, err
 	} else {
 		controller.DataStore = dataStore
 	}
+	// Anything left over is from a previous run that never made it to the data stores
+	if err := os.MkdirAll(controller.incomingDir(), GitDirPerm); err != nil {
+		return nil, fmt.Errorf("Unable to create incoming directory: %v", err)
+	} else if err := removeFileJobContents(controller.incomingDir()); err != nil {
+		return nil, fmt.Errorf("Unable to clear incoming directory: %v", err)
+	}
+	if tofuPath, err := controller.tofuKnownHostsFile(); err != nil {
+		return nil, err
+	} else {
+		controller.hostKeys = newHostKeyStore(tofuPath)
+	}
 	if scheduler, err := controller.NewLocalScheduler(); err != nil {
 		return nil, fmt.Errorf("Unable to create scheduler: %v", err)
 	} else {
@@ -107,6 +133,67 @@ func NewController(conf *config.Config) (*Controller, error) {
 	return controller, nil
 }
 
+// The history is kept in a file next to the scheduler state unless the
+// scheduler state is only in memory
+func (c *Controller) newHistory(size int) (History, error) {
+	var stateConf *config.SchedulerState
+	if c.conf.Scheduler != nil {
+		stateConf = c.conf.Scheduler.SchedulerState
+	}
+	if stateConf != nil && stateConf.Type == "memory" {
+		return newLocalHistory(size), nil
+	}
+	stateDir := filepath.Dir(schedulerStateFilePath(stateConf, c.dataDir()))
+	return newFileHistory(size, filepath.Join(stateDir, HistoryFileName))
+}
+
+// The directory for the controller to keep local state in
+func (c *Controller) dataDir() string {
+	if dir := c.gitDataDir(); dir != "" {
+		return dir
+	}
+	if dir, err := os.Getwd(); err == nil {
+		return dir
+	}
+	return "."
+}
+
+// The first git data directory or empty if there is none
+func (c *Controller) gitDataDir() string {
+	for _, dataStore := range c.conf.DataStores {
+		if dataStore.DataStoreGit != nil && dataStore.DataStoreGit.DataDir != "" {
+			return dataStore.DataStoreGit.DataDir
+		}
+	}
+	return ""
+}
+
+// Where the keys first seen for tofu devices are kept. This is never left to
+// the working directory when there are tofu devices since losing it means
+// trusting whatever key is seen next.
+func (c *Controller) tofuKnownHostsFile() (string, error) {
+	if c.conf.TofuKnownHostsFile != "" {
+		return c.conf.TofuKnownHostsFile, nil
+	} else if dir := c.gitDataDir(); dir != "" {
+		return filepath.Join(dir, TofuKnownHostsFileName), nil
+	}
+	for _, device := range c.DeviceStore.AllDevices() {
+		if device.HostKey != nil && device.HostKey.Policy == model.HostKeyPolicyTofu {
+			return "", fmt.Errorf("Device %v trusts host keys on first use which requires tofu_known_hosts_file "+
+				"to be set when there is no git data store data_dir", device.Name)
+		}
+	}
+	return filepath.Join(c.dataDir(), TofuKnownHostsFileName), nil
+}
+
+// The directory job contents are written to as they arrive
+func (c *Controller) incomingDir() string {
+	if c.conf.IncomingDir != "" {
+		return c.conf.IncomingDir
+	}
+	return filepath.Join(c.dataDir(), IncomingDirName)
+}
+
 func (c *Controller) Start() error {
 	if c.started {
 		return errors.New("Controller already started")
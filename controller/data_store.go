@@ -1,14 +1,15 @@
 package controller
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"io"
 	"log"
 	"net/mail"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -19,15 +20,27 @@ import (
 
 type DataStore interface {
 	Store(job *DataStoreJob)
+	Status() *DataStoreStatus
 }
 
-func NewDataStoreFromConfig(conf *config.DataStore) (DataStore, error) {
+// The device store is used for device and job details in paths
+func NewDataStoreFromConfig(conf *config.DataStore, deviceStore DeviceStore) (DataStore, error) {
 	switch conf.Type {
 	case "git":
 		if conf.DataStoreGit == nil {
 			return nil, errors.New("Data store for \"git\" required")
 		}
-		return newGitDataStore(conf.DataStoreGit)
+		return newGitDataStore(conf.DataStoreGit, deviceStore)
+	case "filesystem":
+		if conf.DataStoreFilesystem == nil {
+			return nil, errors.New("Data store for \"filesystem\" required")
+		}
+		return newFilesystemDataStore(conf.DataStoreFilesystem, deviceStore)
+	case "s3":
+		if conf.DataStoreS3 == nil {
+			return nil, errors.New("Data store for \"s3\" required")
+		}
+		return newS3DataStore(conf.DataStoreS3, deviceStore)
 	default:
 		return nil, fmt.Errorf("Unrecognized data store type: %v", conf.Type)
 	}
@@ -40,20 +53,80 @@ type DataStoreJob struct {
 	StartTime  time.Time
 	EndTime    time.Time
 	Failure    string
-	// TODO: worries about this eating too much mem?
-	// Problem is we can't store reader because HTTP request is long gone
-	Contents []byte
+	// Nil if there are no contents
+	Contents JobContents
+	// Empty to use the data store's commit policy
+	CommitPolicy string
+	// Every attempt the worker made, oldest first. Empty if the worker did not
+	// send them.
+	Attempts []*model.ExecutionAttempt
+	// Set for the internal jobs that rewrite README overviews
+	overview bool
+	// Called by the data store when the job is written or fails to be. Nil if
+	// nothing is waiting on it.
+	stored func(err error)
 }
 
 const (
 	jobKeySplit          = "\x07"
 	GitStructureByDevice = "by_device"
 	GitStructureByJob    = "by_job"
+	GitFailureSuffix     = ".failure"
 	GitDirPerm           = 0755
 	GitFilePerm          = 0644
+	GitBackendCli        = "cli"
+	GitBackendEmbedded   = "embedded"
+	// Applies to each git operation
+	DefaultGitTimeoutSeconds = 300
 )
 
+// Data stores call this once the job is written with nil or with the reason it
+// could not be
+func (d *DataStoreJob) finished(err error) {
+	if d.stored != nil {
+		d.stored(err)
+	}
+}
+
+func (d *DataStoreJob) hasContents() bool {
+	return d.Contents != nil && d.Contents.Size() > 0
+}
+
+// The text stored in place of the contents when a job fails
+func (d *DataStoreJob) failureContents() BytesJobContents {
+	return BytesJobContents(fmt.Sprintf(
+		"Job: %v\n"+
+			"Device: %v\n"+
+			"Expected Run Date: %v\n"+
+			"Start Date: %v\n"+
+			"End On: %v\n"+
+			"Failure: %v\n",
+		d.JobName, d.DeviceName, d.JobTime.Format(time.ANSIC),
+		d.StartTime.Format(time.ANSIC), d.EndTime.Format(time.ANSIC), d.Failure,
+	))
+}
+
+func (d *DataStoreJob) commitMessage() string {
+	failure := ""
+	if d.Failure != "" {
+		failure = fmt.Sprintf("\n* Failure: %v", d.Failure)
+	}
+	return fmt.Sprintf(
+		"* Job: %v\n"+
+			"* Device: %v\n"+
+			"* Expected Run Date: %v\n"+
+			"* Start Date: %v\n"+
+			"* End On: %v\n"+
+			"* Elapsed Time: %v"+failure,
+		d.JobName, d.DeviceName, d.JobTime.Format(time.ANSIC),
+		d.StartTime.Format(time.ANSIC), d.EndTime.Format(time.ANSIC), d.EndTime.Sub(d.StartTime),
+	)
+}
+
 func (d *DataStoreJob) key() string {
+	if d.overview {
+		return gitOverviewKey
+	}
 	return d.DeviceName + jobKeySplit + d.JobName
 }
 
@@ -69,51 +142,114 @@ type gitDataStore struct {
 	// By job key then by job ID
 	runningWriteIds        map[string]map[string]bool
 	waitingOnRunningWrites map[string][]*DataStoreJob
+	// Nil if README overviews are not included
+	overview *gitOverview
+	// Nil if there are no device details for paths
+	devices DeviceStore
+	layout  *dataStoreLayout
+	// Results that failed to push waiting to be retried
+	spool        *gitSpool
+	commitPolicy *gitCommitPolicy
+	backend      gitBackend
+	// Credentials and SSH settings for every git command of the CLI backend
+	authEnv map[string]string
+}
+
+// gitBackend does the actual git work in the pooled clone directories
+type gitBackend interface {
+	validateRemote(ctx context.Context) error
+	clone(ctx context.Context, dir string) error
+	// Discards uncommitted changes and local commits and brings in remote ones
+	update(ctx context.Context, dir string) error
+	hasChanges(ctx context.Context, dir string) (bool, error)
+	// Adds everything including removals and commits even if nothing changed
+	commitAll(ctx context.Context, dir string, message string) error
+	push(ctx context.Context, dir string) error
 }
 
-func newGitDataStore(conf *config.DataStoreGit) (*gitDataStore, error) {
+func newGitDataStore(conf *config.DataStoreGit, devices DeviceStore) (*gitDataStore, error) {
 	dataStore := &gitDataStore{
 		conf:                   conf,
+		devices:                devices,
 		writesLock:             &sync.Mutex{},
 		pendingWrites:          make(map[string][]*DataStoreJob),
-		pendingWorkChan:        make(chan bool),
+		pendingWorkChan:        make(chan bool, 1),
 		runningWriteIds:        make(map[string]map[string]bool),
 		waitingOnRunningWrites: make(map[string][]*DataStoreJob),
 	}
 	if err := dataStore.ValidateAndApplyDefaults(); err != nil {
 		return nil, err
 	}
+	spool, err := newGitSpool(filepath.Join(conf.DataDir, GitSpoolDirName),
+		time.Duration(conf.PushRetrySeconds)*time.Second, time.Duration(conf.PushRetryMaxSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	dataStore.spool = spool
+	dataStore.commitPolicy = newGitCommitPolicy(conf.CommitPolicy, filepath.Join(conf.DataDir, GitRunLogFileName))
+	// Whatever didn't make it before we stopped is written first
+	if jobs, _ := spool.retry(); len(jobs) > 0 {
+		log.Printf("Queueing %v spooled git writes from a previous run", len(jobs))
+		for _, job := range jobs {
+			dataStore.enqueue(job)
+		}
+	}
+	if conf.Bare {
+		return dataStore, dataStore.startBare()
+	}
 	if Verbose {
 		log.Printf("Creating %v git data store copies for the pool", conf.PoolSize)
 	}
-	for i := 0; i < conf.PoolSize; i++ {
-		worker := &gitWorker{
+	workers := make([]*gitWorker, conf.PoolSize)
+	for i := range workers {
+		workers[i] = &gitWorker{
 			dir:       path.Join(conf.DataDir, "pool"+strconv.Itoa(i+1)),
 			dataStore: dataStore,
 		}
-		if err := worker.initialize(); err != nil {
+		if err := workers[i].initialize(); err != nil {
 			return nil, err
 		}
-		go worker.run()
+	}
+	if err := dataStore.loadOverview(&gitDirFileReader{filepath.Join(workers[0].dir, conf.Directory)}); err != nil {
+		return nil, err
+	}
+	for _, worker := range workers {
+		go dataStore.runWriter(worker)
 	}
 	return dataStore, nil
 }
 
+// Does nothing if README overviews are not included
+func (g *gitDataStore) loadOverview(reader gitFileReader) error {
+	if g.conf.IncludeReadmeOverviews {
+		// Pick up where the last overviews left off so we don't lose jobs not run since
+		g.overview = newGitOverview()
+		if err := g.overview.load(reader, g.conf.Structure); err != nil {
+			return fmt.Errorf("Unable to load README overviews: %v", err)
+		}
+	}
+	return nil
+}
+
 func (g *gitDataStore) ValidateAndApplyDefaults() error {
 	if g.conf.Url == "" {
 		return errors.New("Data store for git requires url")
 	}
+	if directory, err := cleanGitDirectory(g.conf.Directory); err != nil {
+		return err
+	} else {
+		g.conf.Directory = directory
+	}
 	if g.conf.PoolSize == 0 {
 		g.conf.PoolSize = 20
 	}
 	if len(g.conf.Structure) == 0 {
 		g.conf.Structure = []string{GitStructureByDevice}
+	}
+	if layout, err := newDataStoreLayout("git", g.conf.Structure, g.devices); err != nil {
+		return err
 	} else {
-		for _, structure := range g.conf.Structure {
-			if structure != GitStructureByDevice && structure != GitStructureByJob {
-				return fmt.Errorf("Unrecognized git structure: %v", structure)
-			}
-		}
+		g.layout = layout
 	}
 	if g.conf.DataDir == "" {
 		if dir, err := os.Getwd(); err != nil {
@@ -136,14 +272,75 @@ func (g *gitDataStore) ValidateAndApplyDefaults() error {
 			return errors.New("If git password supplied, username must also be supplied")
 		}
 	}
+	if g.conf.PushRetrySeconds < 0 || g.conf.PushRetryMaxSeconds < 0 {
+		return errors.New("Git push retry seconds cannot be negative")
+	}
+	if g.conf.PushRetrySeconds == 0 {
+		g.conf.PushRetrySeconds = DefaultGitPushRetrySeconds
+	}
+	if g.conf.PushRetryMaxSeconds == 0 {
+		g.conf.PushRetryMaxSeconds = DefaultGitPushRetryMaxSeconds
+	}
+	if g.conf.PushRetryMaxSeconds < g.conf.PushRetrySeconds {
+		return errors.New("Git push retry max seconds cannot be less than push retry seconds")
+	}
+	if err := model.ValidateCommitPolicy(g.conf.CommitPolicy); err != nil {
+		return err
+	} else if g.conf.CommitPolicy == "" {
+		g.conf.CommitPolicy = model.CommitPolicyAlways
+	}
+	if g.conf.TimeoutSeconds < 0 {
+		return errors.New("Git timeout seconds cannot be negative")
+	} else if g.conf.TimeoutSeconds == 0 {
+		g.conf.TimeoutSeconds = DefaultGitTimeoutSeconds
+	}
+	if err := g.validateSsh(); err != nil {
+		return err
+	}
+	// Bare is only done in memory which is only possible with the embedded backend
+	if g.conf.Bare && g.conf.Backend == "" {
+		g.conf.Backend = GitBackendEmbedded
+	} else if g.conf.Bare && g.conf.Backend != GitBackendEmbedded {
+		return errors.New("Bare git data store requires the embedded backend")
+	}
+	switch g.conf.Backend {
+	case "", GitBackendCli:
+		g.conf.Backend = GitBackendCli
+		if err := g.prepareAuthEnv(); err != nil {
+			return err
+		}
+		g.backend = &gitCliBackend{dataStore: g}
+	case GitBackendEmbedded:
+		backend, err := newGitEmbeddedBackend(g)
+		if err != nil {
+			return err
+		}
+		g.backend = backend
+	default:
+		return fmt.Errorf("Unrecognized git backend: %v", g.conf.Backend)
+	}
 	// We do a simple ping check here to see if the repository even exists
-	_, err := doGitCmd("", g.username(), g.password(), nil, "ls-remote", g.conf.Url)
-	if err != nil {
+	ctx, cancel := g.context()
+	defer cancel()
+	if err := g.backend.validateRemote(ctx); err != nil {
 		return fmt.Errorf("Git repository validation using ls-remote failed to validate URL %v: %v", g.conf.Url, err)
 	}
 	return nil
 }
 
+// Every git operation must complete within the configured timeout
+func (g *gitDataStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(g.conf.TimeoutSeconds)*time.Second)
+}
+
+// The author and committer from the configured user. Either may be empty.
+func (g *gitDataStore) author() (name string, email string) {
+	if g.conf.DataStoreGitUser != nil {
+		return g.conf.DataStoreGitUser.FriendlyName, g.conf.DataStoreGitUser.Email
+	}
+	return "", ""
+}
+
 func (g *gitDataStore) username() string {
 	if g.conf.DataStoreGitUser != nil {
 		return g.conf.DataStoreGitUser.Name
@@ -158,14 +355,78 @@ func (g *gitDataStore) password() string {
 	return ""
 }
 
+// The directory is relative to the repository root and may begin with a slash.
+// The result is empty for the repository root.
+func cleanGitDirectory(directory string) (string, error) {
+	if strings.Contains(directory, "\\") {
+		return "", fmt.Errorf("Git directory %v cannot contain backslashes", directory)
+	}
+	cleaned := strings.Trim(path.Clean("/"+directory), "/")
+	for _, piece := range strings.Split(directory, "/") {
+		if piece == ".." {
+			return "", fmt.Errorf("Git directory %v cannot reference a parent directory", directory)
+		} else if piece == ".git" {
+			return "", fmt.Errorf("Git directory %v cannot be inside .git", directory)
+		}
+	}
+	return cleaned, nil
+}
+
+// Prefixes the configured directory to the path to make it relative to the
+// repository root
+func (g *gitDataStore) repoPath(relativePath string) string {
+	if g.conf.Directory == "" {
+		return relativePath
+	}
+	return g.conf.Directory + "/" + relativePath
+}
+
+// The file contents to write for the job keyed by path relative to the
+// repository root. Nil contents mean the file is to be removed.
+func (g *gitDataStore) jobChanges(job *DataStoreJob) (map[string]JobContents, error) {
+	paths, err := g.jobPaths(job)
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]JobContents{}
+	for _, path := range paths {
+		if job.Failure != "" {
+			// We don't write contents on failure because they might be wildly different from a
+			// success which would break the diffs. Instead the failure goes next to the last
+			// good result.
+			changes[path+GitFailureSuffix] = job.failureContents()
+			continue
+		}
+		if job.hasContents() {
+			changes[path] = job.Contents
+		}
+		// Success means any previous failure is no longer relevant
+		changes[path+GitFailureSuffix] = nil
+	}
+	return changes, nil
+}
+
+// The paths relative to the repository root that the job is written to
+func (g *gitDataStore) jobPaths(job *DataStoreJob) ([]string, error) {
+	paths := g.layout.paths(job.DeviceName, job.JobName)
+	for index, path := range paths {
+		paths[index] = g.repoPath(path)
+	}
+	return paths, nil
+}
+
 func (g *gitDataStore) Store(job *DataStoreJob) {
-	// TODO: queue up readme overview...
 	// Queue up the write
 	if Verbose {
-		log.Printf("Preparing to store job %v on %v at expected time of %v with contents:\n%v",
-			job.JobName, job.DeviceName, job.JobTime, string(job.Contents))
+		log.Printf("Preparing to store job %v on %v at expected time of %v", job.JobName, job.DeviceName, job.JobTime)
 	}
 	g.writesLock.Lock()
+	g.enqueue(job)
+	g.writesLock.Unlock()
+}
+
+// Expects the writes lock to be held
+func (g *gitDataStore) enqueue(job *DataStoreJob) {
 	key := job.key()
 	// First, if it's running right now we put it in the waiting section
 	if _, ok := g.runningWriteIds[key]; ok {
@@ -182,8 +443,17 @@ func (g *gitDataStore) Store(job *DataStoreJob) {
 			g.pendingWrites[key] = []*DataStoreJob{job}
 		}
 	}
-	g.writesLock.Unlock()
-	g.pendingWorkChan <- true
+	g.signalPendingWork()
+}
+
+// Wakes up a worker to call nextJobs. The channel is buffered and this never
+// blocks (workers call it too) since a single unconsumed signal is enough for
+// the next worker to take every pending job.
+func (g *gitDataStore) signalPendingWork() {
+	select {
+	case g.pendingWorkChan <- true:
+	default:
+	}
 }
 
 func (g *gitDataStore) nextJobs() []*DataStoreJob {
@@ -238,48 +508,110 @@ func (g *gitDataStore) markJobsCompleted(jobs []*DataStoreJob) {
 				g.pendingWrites[key] = []*DataStoreJob{pending}
 			}
 		}
+		delete(g.waitingOnRunningWrites, key)
 	}
 	defer g.writesLock.Unlock()
 	if anythingEnqueued {
-		g.pendingWorkChan <- true
+		g.signalPendingWork()
 	}
 }
 
-type gitWorker struct {
-	dir       string
-	dataStore *gitDataStore
+// gitWriter commits and pushes a batch of jobs. Overview jobs should be
+// committed after the rest.
+type gitWriter interface {
+	// Returns false if the jobs did not make it to the remote. Jobs that could
+	// not be committed are left out of the push and returned with why.
+	pushJobs(jobs []*DataStoreJob) (commitErrs map[*DataStoreJob]error, pushed bool)
 }
 
-func (g *gitWorker) run() {
+func (g *gitDataStore) runWriter(writer gitWriter) {
 	for {
-		<-g.dataStore.pendingWorkChan
-		jobs := g.dataStore.nextJobs()
+		<-g.pendingWorkChan
+		jobs := g.nextJobs()
 		if len(jobs) > 0 {
-			g.pushJobs(jobs)
+			if commitErrs, pushed := writer.pushJobs(jobs); pushed {
+				g.jobsPushed(jobs, commitErrs)
+			} else {
+				g.jobsFailed(jobs)
+			}
+		}
+		g.markJobsCompleted(jobs)
+	}
+}
+
+// The jobs that failed to commit are finished with their error. Pushing again
+// won't help them so they are not spooled.
+func (g *gitDataStore) jobsPushed(jobs []*DataStoreJob, commitErrs map[*DataStoreJob]error) {
+	g.spool.pushed(jobs)
+	for _, job := range jobs {
+		job.finished(commitErrs[job])
+	}
+	// Only what made it to the remote goes in the overview
+	if g.overview != nil {
+		updated := false
+		for _, job := range jobs {
+			if !job.overview && commitErrs[job] == nil {
+				updated = true
+				g.overview.update(job.DeviceName, job.JobName, job.JobTime, job.Failure != "")
+			}
+		}
+		if updated {
+			g.queueOverview()
+		}
+	}
+}
+
+func logPushFailure(jobs []*DataStoreJob, err error) {
+	for _, job := range jobs {
+		if job.overview {
+			log.Printf("Failed to push README overviews: %v", err)
+		} else {
+			log.Printf("Failed to push job %v for device %v: %v", job.JobName, job.DeviceName, err)
 		}
-		g.dataStore.markJobsCompleted(jobs)
 	}
 }
 
-func (g *gitWorker) pushJobs(jobs []*DataStoreJob) {
-	// TODO: what to do on git errors...sleep, die, re-queue, etc?
+type gitWorker struct {
+	dir       string
+	dataStore *gitDataStore
+}
+
+func (g *gitWorker) pushJobs(jobs []*DataStoreJob) (map[*DataStoreJob]error, bool) {
 	if err := g.clean(); err != nil {
 		log.Printf("Unable to clean repository at %v: %v", g.dir, err)
-		return
+		return nil, false
 	}
+	commitErrs := map[*DataStoreJob]error{}
+	outcomes := &gitPolicyOutcomes{}
+	overviewJobs := []*DataStoreJob{}
 	for _, job := range jobs {
+		// Overviews are written last so they include the rest of the batch
+		if job.overview {
+			overviewJobs = append(overviewJobs, job)
+			continue
+		}
 		if Verbose {
 			log.Printf("Committing and pushing job %v for device %v", job.JobName, job.DeviceName)
 		}
-		if err := g.commitJob(job); err != nil {
+		if err := g.commitJob(job, outcomes); err != nil {
 			log.Printf("Failed to commit job %v for device %v: %v", job.JobName, job.DeviceName, err)
+			commitErrs[job] = err
 		}
 	}
-	if err := g.push(); err != nil {
-		for _, job := range jobs {
-			log.Printf("Failed to push job %v for device %v: %v", job.JobName, job.DeviceName, err)
+	if len(overviewJobs) > 0 {
+		if err := g.commitOverview(); err != nil {
+			log.Printf("Failed to commit README overviews: %v", err)
+			for _, job := range overviewJobs {
+				commitErrs[job] = err
+			}
 		}
 	}
+	if err := g.push(); err != nil {
+		logPushFailure(jobs, err)
+		return nil, false
+	}
+	g.dataStore.commitPolicy.record(outcomes)
+	return commitErrs, true
 }
 
 func (g *gitWorker) initialize() error {
@@ -295,8 +627,10 @@ func (g *gitWorker) initialize() error {
 		if Verbose {
 			log.Printf("Cloning into %v", g.dir)
 		}
-		if out, err := g.doGitCmd("clone", g.dataStore.conf.Url, g.dir); err != nil {
-			return fmt.Errorf("Unable to clone from %v: %v. Output:\n%v", g.dataStore.conf.Url, err, out)
+		ctx, cancel := g.dataStore.context()
+		defer cancel()
+		if err := g.dataStore.backend.clone(ctx, g.dir); err != nil {
+			return fmt.Errorf("Unable to clone from %v: %v", g.dataStore.conf.Url, err)
 		}
 	} else if Verbose {
 		log.Printf("Not cloning fresh into %v because .git folder already exists", g.dir)
@@ -308,106 +642,91 @@ func (g *gitWorker) clean() error {
 	if Verbose {
 		log.Printf("Performing hard reset and pull in %v", g.dir)
 	}
-	// Simple reset and pull
-	if out, err := g.doGitCmd("reset", "--hard"); err != nil {
-		return fmt.Errorf("Unable to git reset --hard in %v: %v. Output:\n%v", g.dir, err, out)
-	}
-	if out, err := g.doGitCmd("pull"); err != nil {
-		return fmt.Errorf("Unable to git pull in %v: %v. Output:\n%v", g.dir, err, out)
+	ctx, cancel := g.dataStore.context()
+	defer cancel()
+	if err := g.dataStore.backend.update(ctx, g.dir); err != nil {
+		return fmt.Errorf("Unable to reset and pull in %v: %v", g.dir, err)
 	}
 	return nil
 }
 
-func (g *gitWorker) commitJob(job *DataStoreJob) error {
-	if len(job.Contents) > 0 {
-		// TODO: should I write contents if there was a failure? I fear that if I do, it might be wildly
-		//	different from a success which will make the diffs break. But if I don't, where does the
-		//	failure go (i.e. is it too big for the commit message)?
-		// Make the write to each place based on what structures exist
-		for _, structure := range g.dataStore.conf.Structure {
-			switch structure {
-			case GitStructureByDevice:
-				path := "by_device/" + job.DeviceName + "/" + job.JobName
-				if err := g.writeGitFile(path, job.Contents); err != nil {
-					return fmt.Errorf("Unable to write job to %v: %v", path, err)
-				}
-			case GitStructureByJob:
-				path := "by_job/" + job.JobName + "/" + job.DeviceName
-				if err := g.writeGitFile(path, job.Contents); err != nil {
-					return fmt.Errorf("Unable to write job to %v: %v", path, err)
-				}
-			default:
-				return fmt.Errorf("Unrecognized structure: %v", structure)
+// What the commit policy decided is added to the outcomes
+func (g *gitWorker) commitJob(job *DataStoreJob, outcomes *gitPolicyOutcomes) error {
+	changes, err := g.dataStore.jobChanges(job)
+	if err != nil {
+		return err
+	}
+	for path, contents := range changes {
+		if contents == nil {
+			if err := g.removeGitFile(path); err != nil {
+				return fmt.Errorf("Unable to remove %v: %v", path, err)
 			}
+		} else if err := g.writeGitFile(path, contents); err != nil {
+			return fmt.Errorf("Unable to write job to %v: %v", path, err)
 		}
 	}
-	// If git status w/ porcelain returns anything, we need to add
-	if out, err := g.doGitCmd("status", "--porcelain"); err != nil {
-		return fmt.Errorf("Unable to check git status on %v: %v. Output:\n%v", g.dir, err, out)
-	} else if strings.TrimSpace(out) != "" {
-		// Add everything
-		if out, err := g.doGitCmd("add", "."); err != nil {
-			return fmt.Errorf("Unable to do git add on %v: %v. Output:\n%v", g.dir, err, out)
+	if !g.dataStore.commitPolicy.commitUnchanged(job) {
+		if changed, err := g.hasChanges(); err != nil {
+			return err
+		} else if !changed {
+			outcomes.skipped = append(outcomes.skipped, job)
+			return nil
 		}
 	}
-	// Commit w/ decent message regardless of whether files changed
-	failure := ""
-	if job.Failure != "" {
-		failure = fmt.Sprintf("\n* Failure: %v", job.Failure)
-	}
-	message := fmt.Sprintf(
-		"* Job: %v\n"+
-			"* Device: %v\n"+
-			"* Expected Run Date: %v\n"+
-			"* Start Date: %v\n"+
-			"* End On: %v\n"+
-			"* Elapsed Time: %v"+failure,
-		job.JobName, job.DeviceName, job.JobTime.Format(time.ANSIC),
-		job.StartTime.Format(time.ANSIC), job.EndTime.Format(time.ANSIC), job.EndTime.Sub(job.StartTime),
-	)
-	// We --allow-empty so we can commit a message even without contents/change
-	args := []string{"commit", "--allow-empty", "-m", message}
-	// We have to make the author as friendly name or username
-	env := map[string]string{}
-	if g.dataStore.conf.DataStoreGitUser != nil &&
-		(g.dataStore.conf.DataStoreGitUser.FriendlyName != "" || g.dataStore.conf.DataStoreGitUser.Email != "") {
-		args = append(args, "--author",
-			g.dataStore.conf.DataStoreGitUser.FriendlyName+" <"+g.dataStore.conf.DataStoreGitUser.Email+">")
-		if g.dataStore.conf.DataStoreGitUser.FriendlyName != "" {
-			env["GIT_COMMITTER_NAME"] = g.dataStore.conf.DataStoreGitUser.FriendlyName
-		}
-		if g.dataStore.conf.DataStoreGitUser.Email != "" {
-			env["GIT_COMMITTER_EMAIL"] = g.dataStore.conf.DataStoreGitUser.Email
-		}
+	// Commit w/ decent message even if files did not change
+	if err := g.commit(job.commitMessage()); err != nil {
+		return err
 	}
+	outcomes.committed = append(outcomes.committed, job)
+	return nil
+}
+
+// Adds everything, including removals, and commits even if nothing changed
+func (g *gitWorker) commit(message string) error {
 	if Verbose {
 		log.Printf("Committing from %v with message:\n%v", g.dir, message)
 	}
-	if out, err := g.doGitCmdWithEnv(env, args...); err != nil {
-		return fmt.Errorf("Unable to do git commit on %v: %v. Output:\n%v", g.dir, err, out)
+	ctx, cancel := g.dataStore.context()
+	defer cancel()
+	if err := g.dataStore.backend.commitAll(ctx, g.dir, message); err != nil {
+		return fmt.Errorf("Unable to commit on %v: %v", g.dir, err)
 	}
 	return nil
 }
 
+func (g *gitWorker) hasChanges() (bool, error) {
+	ctx, cancel := g.dataStore.context()
+	defer cancel()
+	changed, err := g.dataStore.backend.hasChanges(ctx, g.dir)
+	if err != nil {
+		return false, fmt.Errorf("Unable to check git status on %v: %v", g.dir, err)
+	}
+	return changed, nil
+}
+
 func (g *gitWorker) push() error {
 	if Verbose {
 		log.Printf("Pushing from %v", g.dir)
 	}
-	if out, err := g.doGitCmd("push"); err != nil {
-		return fmt.Errorf("Unable to do git push on %v: %v. Output:\n%v", g.dir, err, out)
+	ctx, cancel := g.dataStore.context()
+	defer cancel()
+	if err := g.dataStore.backend.push(ctx, g.dir); err != nil {
+		return fmt.Errorf("Unable to push on %v: %v", g.dir, err)
 	}
 	return nil
 }
 
-func (g *gitWorker) doGitCmd(args ...string) (string, error) {
-	return doGitCmd(g.dir, g.dataStore.username(), g.dataStore.password(), nil, args...)
-}
-
-func (g *gitWorker) doGitCmdWithEnv(env map[string]string, args ...string) (string, error) {
-	return doGitCmd(g.dir, g.dataStore.username(), g.dataStore.password(), env, args...)
+func (g *gitWorker) removeGitFile(path string) error {
+	fullPath := filepath.Join(g.dir, path)
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil && Verbose {
+		log.Printf("Removed file %v", fullPath)
+	}
+	return nil
 }
 
-func (g *gitWorker) writeGitFile(path string, contents []byte) error {
+func (g *gitWorker) writeGitFile(path string, contents JobContents) error {
 	fullPath := filepath.Join(g.dir, path)
 	if Verbose {
 		log.Printf("Writing to file %v", fullPath)
@@ -416,55 +735,16 @@ func (g *gitWorker) writeGitFile(path string, contents []byte) error {
 	if err := os.MkdirAll(dir, GitDirPerm); err != nil {
 		return err
 	}
-	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, GitFilePerm)
+	reader, err := contents.Open()
 	if err != nil {
 		return err
 	}
-	_, err = file.Write(contents)
-	return err
-}
-
-func doGitCmd(dir string, username string, password string, env map[string]string, args ...string) (string, error) {
-	cmd := exec.Command("git", args...)
-	if dir != "" {
-		cmd.Dir = dir
-	}
-	if len(env) > 0 {
-		cmd.Env = os.Environ()
-		for k, v := range env {
-			cmd.Env = append(cmd.Env, k+"="+v)
-		}
-	}
-	if Verbose {
-		log.Printf("Running git command with args %v", args)
-	}
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	pipe, err := cmd.StdinPipe()
-	if err != nil {
-		return "", fmt.Errorf("Cannot open stdin: %v", err)
-	}
-	if err := cmd.Start(); err != nil {
-		return "", fmt.Errorf("Unable to run git: %v", err)
-	}
-	// TODO: this doesn't feel right, should I sleep before checking out, etc
-	if username != "" && strings.HasSuffix(out.String(), "Username:") {
-		_, err = pipe.Write([]byte(username + "\n"))
-	}
-	if password != "" && err == nil && strings.HasSuffix(out.String(), "Password:") {
-		_, err = pipe.Write([]byte(password + "\n"))
-	}
-	if err == nil {
-		// TODO: this needs to time out after so long
-		err = cmd.Wait()
-	}
+	defer reader.Close()
+	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, GitFilePerm)
 	if err != nil {
-		if dir == "" {
-			return "", fmt.Errorf("Error running git: %v. Output:\n%v", err, out.String())
-		} else {
-			return "", fmt.Errorf("Error running git in %v: %v. Output:\n%v", dir, err, out.String())
-		}
+		return err
 	}
-	return out.String(), nil
+	defer file.Close()
+	_, err = io.Copy(file, reader)
+	return err
 }
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/cretz/fusty/model"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Where skipped runs are recorded under the data directory
+	GitRunLogFileName = "skipped-runs.log"
+	// Once the run log would pass this size it is moved to the same name with
+	// a .1 suffix, replacing the one before, and a new log is started
+	GitRunLogMaxSize = 10 * 1024 * 1024
+	// How long an unchanged result can go without a commit when the policy
+	// has a heartbeat
+	GitHeartbeatInterval = 24 * time.Hour
+)
+
+// gitCommitPolicy decides whether results that changed nothing get committed
+// and records the runs that don't
+type gitCommitPolicy struct {
+	// Used when the job has no policy of its own
+	defaultPolicy string
+	runLogPath    string
+	runLogMaxSize int64
+	lock          *sync.Mutex
+	// Expected run time of the last commit by job key. This starts empty so
+	// the first heartbeat after a restart is always committed.
+	lastCommits map[string]time.Time
+}
+
+// A line in the run log
+type skippedRun struct {
+	DeviceName string `json:"device"`
+	JobName    string `json:"job"`
+	JobTime    int64  `json:"job_timestamp"`
+	StartTime  int64  `json:"start_timestamp"`
+	EndTime    int64  `json:"end_timestamp"`
+	// Hex SHA-1 of the contents which are the same as what is committed
+	ContentsSha1 string `json:"contents_sha1"`
+}
+
+func newGitCommitPolicy(defaultPolicy string, runLogPath string) *gitCommitPolicy {
+	return &gitCommitPolicy{
+		defaultPolicy: defaultPolicy,
+		runLogPath:    runLogPath,
+		runLogMaxSize: GitRunLogMaxSize,
+		lock:          &sync.Mutex{},
+		lastCommits:   make(map[string]time.Time),
+	}
+}
+
+// Whether the job should be committed even though it changed nothing.
+// Failures are always committed.
+func (g *gitCommitPolicy) commitUnchanged(job *DataStoreJob) bool {
+	policy := job.CommitPolicy
+	if policy == "" {
+		policy = g.defaultPolicy
+	}
+	switch {
+	case job.Failure != "" || policy == model.CommitPolicyAlways:
+		return true
+	case policy == model.CommitPolicyOnChangeWithHeartbeat:
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		last, ok := g.lastCommits[job.key()]
+		return !ok || !job.JobTime.Before(last.Add(GitHeartbeatInterval))
+	default:
+		return false
+	}
+}
+
+// What the policy decided for a batch. It is only recorded once the batch is
+// pushed so a push that fails or is retried doesn't log a run twice or count a
+// heartbeat that never made it to the remote.
+type gitPolicyOutcomes struct {
+	skipped   []*DataStoreJob
+	committed []*DataStoreJob
+}
+
+func (g *gitCommitPolicy) record(outcomes *gitPolicyOutcomes) {
+	for _, job := range outcomes.skipped {
+		g.skipped(job)
+	}
+	for _, job := range outcomes.committed {
+		g.committed(job)
+	}
+}
+
+func (g *gitCommitPolicy) committed(job *DataStoreJob) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if last, ok := g.lastCommits[job.key()]; !ok || job.JobTime.After(last) {
+		g.lastCommits[job.key()] = job.JobTime
+	}
+}
+
+// Appends the run to the run log so there is proof it happened
+func (g *gitCommitPolicy) skipped(job *DataStoreJob) {
+	if Verbose {
+		log.Printf("Not committing job %v for device %v since nothing changed", job.JobName, job.DeviceName)
+	}
+	contents := job.Contents
+	if contents == nil {
+		contents = BytesJobContents{}
+	}
+	hash, err := jobContentsSha1(contents)
+	var line []byte
+	if err == nil {
+		line, err = json.Marshal(&skippedRun{
+			DeviceName:   job.DeviceName,
+			JobName:      job.JobName,
+			JobTime:      job.JobTime.Unix(),
+			StartTime:    job.StartTime.Unix(),
+			EndTime:      job.EndTime.Unix(),
+			ContentsSha1: hex.EncodeToString(hash),
+		})
+	}
+	if err == nil {
+		err = g.appendRunLog(append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("Unable to record skipped run of job %v for device %v: %v", job.JobName, job.DeviceName, err)
+	}
+}
+
+func (g *gitCommitPolicy) appendRunLog(line []byte) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if info, err := os.Stat(g.runLogPath); err == nil && info.Size() > 0 &&
+		info.Size()+int64(len(line)) > g.runLogMaxSize {
+		if err := os.Rename(g.runLogPath, g.runLogPath+".1"); err != nil {
+			return fmt.Errorf("Unable to rotate run log: %v", err)
+		}
+	}
+	file, err := os.OpenFile(g.runLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, GitFilePerm)
+	if err != nil {
+		return fmt.Errorf("Unable to open run log: %v", err)
+	}
+	defer file.Close()
+	_, err = file.Write(line)
+	return err
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGitCommitPolicyCommitUnchanged(t *testing.T) {
+	policy := newGitCommitPolicy(model.CommitPolicyOnChange, "")
+	policy.committed(&DataStoreJob{DeviceName: "dev", JobName: "heartbeat", JobTime: time.Unix(0, 0)})
+	tests := []struct {
+		job      *DataStoreJob
+		expected bool
+	}{
+		{&DataStoreJob{DeviceName: "dev", JobName: "job"}, false},
+		{&DataStoreJob{DeviceName: "dev", JobName: "job", Failure: "timeout"}, true},
+		{&DataStoreJob{DeviceName: "dev", JobName: "job", CommitPolicy: model.CommitPolicyAlways}, true},
+		// Never committed
+		{&DataStoreJob{DeviceName: "dev", JobName: "job", CommitPolicy: model.CommitPolicyOnChangeWithHeartbeat}, true},
+		{&DataStoreJob{DeviceName: "dev", JobName: "heartbeat", JobTime: time.Unix(0, 0).Add(GitHeartbeatInterval - time.Second),
+			CommitPolicy: model.CommitPolicyOnChangeWithHeartbeat}, false},
+		{&DataStoreJob{DeviceName: "dev", JobName: "heartbeat", JobTime: time.Unix(0, 0).Add(GitHeartbeatInterval),
+			CommitPolicy: model.CommitPolicyOnChangeWithHeartbeat}, true},
+	}
+	for _, test := range tests {
+		if actual := policy.commitUnchanged(test.job); actual != test.expected {
+			t.Fatalf("Expected %v for %v, got %v", test.expected, test.job, actual)
+		}
+	}
+}
+
+func TestGitOnChangeDataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-on-change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remoteDir := filepath.Join(dir, "remote")
+	seedEmbeddedRemote(t, remoteDir, filepath.Join(dir, "seed"))
+	for _, bare := range []bool{false, true} {
+		dataDir, err := ioutil.TempDir(dir, "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataStore, err := newGitDataStore(&config.DataStoreGit{
+			Url:              remoteDir,
+			PoolSize:         1,
+			DataDir:          dataDir,
+			Backend:          GitBackendEmbedded,
+			Bare:             bare,
+			CommitPolicy:     model.CommitPolicyOnChange,
+			DataStoreGitUser: &config.DataStoreGitUser{FriendlyName: "John Doe", Email: "jdoe@example.com"},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each pass adds one commit to the remote
+		commits := 2
+		contents := BytesJobContents("config")
+		if bare {
+			commits = 3
+			contents = BytesJobContents("bare config")
+		}
+		dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0), Contents: contents})
+		waitForEmbeddedCommit(t, remoteDir, commits)
+		dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(200, 0), Contents: contents})
+		runLogPath := filepath.Join(dataDir, GitRunLogFileName)
+		var runLog []byte
+		for i := 0; i < 50 && len(runLog) == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+			runLog, _ = ioutil.ReadFile(runLogPath)
+		}
+		skipped := &skippedRun{}
+		if err := json.Unmarshal(runLog, skipped); err != nil {
+			t.Fatalf("Unable to read run log %q: %v", runLog, err)
+		} else if skipped.DeviceName != "dev" || skipped.JobName != "job" || skipped.JobTime != 200 ||
+			skipped.ContentsSha1 != fmt.Sprintf("%x", sha1.Sum(contents)) {
+			t.Fatalf("Unexpected skipped run: %v", skipped)
+		}
+		waitForEmbeddedCommit(t, remoteDir, commits)
+	}
+}
+
+func TestGitCommitPolicyRecordedAfterPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-heartbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, bare := range []bool{false, true} {
+		remoteDir := filepath.Join(dir, fmt.Sprintf("remote%v", i))
+		seedEmbeddedRemote(t, remoteDir, filepath.Join(dir, fmt.Sprintf("seed%v", i)))
+		dataDir := filepath.Join(dir, fmt.Sprintf("data%v", i))
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		dataStore, err := newGitDataStore(&config.DataStoreGit{
+			Url:              remoteDir,
+			PoolSize:         1,
+			DataDir:          dataDir,
+			Backend:          GitBackendEmbedded,
+			Bare:             bare,
+			CommitPolicy:     model.CommitPolicyOnChangeWithHeartbeat,
+			PushRetrySeconds: 1,
+			DataStoreGitUser: &config.DataStoreGitUser{FriendlyName: "John Doe", Email: "jdoe@example.com"},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0),
+			Contents: BytesJobContents("config")})
+		waitForEmbeddedCommit(t, remoteDir, 2)
+		// The remote rejects every push until the hook is removed
+		hookPath := filepath.Join(remoteDir, "hooks", "pre-receive")
+		if err := os.MkdirAll(filepath.Dir(hookPath), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(hookPath, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		heartbeat := &DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0).Add(GitHeartbeatInterval),
+			Contents: BytesJobContents("config")}
+		dataStore.Store(heartbeat)
+		for i := 0; i < 50 && dataStore.Status().SpoolDepth == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if depth := dataStore.Status().SpoolDepth; depth != 1 {
+			t.Fatalf("Expected heartbeat spooled with bare %v, got depth %v", bare, depth)
+		}
+		// The commit that never made it is not counted as the heartbeat
+		if !dataStore.commitPolicy.commitUnchanged(heartbeat) {
+			t.Fatalf("Expected heartbeat still due with bare %v", bare)
+		}
+		if err := os.Remove(hookPath); err != nil {
+			t.Fatal(err)
+		}
+		waitForEmbeddedCommit(t, remoteDir, 3)
+		if dataStore.commitPolicy.commitUnchanged(heartbeat) {
+			t.Fatalf("Expected heartbeat recorded once pushed with bare %v", bare)
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, GitRunLogFileName)); !os.IsNotExist(err) {
+			t.Fatalf("Expected no skipped runs with bare %v, got: %v", bare, err)
+		}
+	}
+}
+
+func TestGitCommitPolicyRunLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-run-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runLogPath := filepath.Join(dir, GitRunLogFileName)
+	policy := newGitCommitPolicy(model.CommitPolicyOnChange, runLogPath)
+	policy.runLogMaxSize = 25
+	// Each line is 10 bytes so the third starts a new log
+	for _, line := range []string{"skipped 1\n", "skipped 2\n", "skipped 3\n", "skipped 4\n", "skipped 5\n"} {
+		if err := policy.appendRunLog([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, expected := range map[string]string{runLogPath: "skipped 5\n", runLogPath + ".1": "skipped 3\nskipped 4\n"} {
+		if actual, err := ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		} else if string(actual) != expected {
+			t.Fatalf("Expected %q in %v, got %q", expected, path, actual)
+		}
+	}
+}
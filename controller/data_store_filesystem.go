@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Versions are named after the expected run time in UTC
+	FilesystemVersionFormat  = "20060102T150405Z"
+	FilesystemLatestLinkName = "latest"
+	FilesystemDirPerm        = 0755
+	FilesystemFilePerm       = 0644
+)
+
+// filesystemDataStore writes each result as a new version file in a directory
+// for every structure path
+type filesystemDataStore struct {
+	conf   *config.DataStoreFilesystem
+	layout *dataStoreLayout
+	// Writes are quick so they are done one at a time as they come in
+	lock *sync.Mutex
+}
+
+func newFilesystemDataStore(conf *config.DataStoreFilesystem, devices DeviceStore) (*filesystemDataStore, error) {
+	if conf.Directory == "" {
+		return nil, errors.New("Data store for filesystem requires directory")
+	}
+	if conf.Retention < 0 {
+		return nil, errors.New("Filesystem retention cannot be negative")
+	}
+	if len(conf.Structure) == 0 {
+		conf.Structure = []string{GitStructureByDevice}
+	}
+	layout, err := newDataStoreLayout("filesystem", conf.Structure, devices)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(conf.Directory, FilesystemDirPerm); err != nil {
+		return nil, fmt.Errorf("Unable to create filesystem data directory: %v", err)
+	}
+	return &filesystemDataStore{conf: conf, layout: layout, lock: &sync.Mutex{}}, nil
+}
+
+func (f *filesystemDataStore) Store(job *DataStoreJob) {
+	if Verbose {
+		log.Printf("Storing job %v on %v at expected time of %v in %v",
+			job.JobName, job.DeviceName, job.JobTime, f.conf.Directory)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var firstErr error
+	for _, path := range f.layout.paths(job.DeviceName, job.JobName) {
+		dir := filepath.Join(f.conf.Directory, filepath.FromSlash(path))
+		if err := f.storeVersion(dir, job); err != nil {
+			log.Printf("Failed to store job %v for device %v in %v: %v", job.JobName, job.DeviceName, dir, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	job.finished(firstErr)
+}
+
+// Nothing is ever queued
+func (f *filesystemDataStore) Status() *DataStoreStatus {
+	return &DataStoreStatus{}
+}
+
+func (f *filesystemDataStore) storeVersion(dir string, job *DataStoreJob) error {
+	if err := os.MkdirAll(dir, FilesystemDirPerm); err != nil {
+		return err
+	}
+	version := job.JobTime.UTC().Format(FilesystemVersionFormat)
+	if job.Failure != "" {
+		if err := writeFileAtomic(dir, version+GitFailureSuffix, job.failureContents()); err != nil {
+			return err
+		}
+	} else if job.hasContents() {
+		if err := writeFileAtomic(dir, version, job.Contents); err != nil {
+			return err
+		}
+		if f.conf.LatestLink {
+			if err := f.updateLatestLink(dir, version); err != nil {
+				return fmt.Errorf("Unable to update latest link: %v", err)
+			}
+		}
+	}
+	return f.prune(dir)
+}
+
+// Writes to a temp file in the same directory and renames it so readers never
+// see a partial file
+func writeFileAtomic(dir string, name string, contents JobContents) error {
+	reader, err := contents.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	temp, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(temp, reader)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), FilesystemFilePerm)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// Points the link at the version unless it already points at a newer one
+func (f *filesystemDataStore) updateLatestLink(dir string, version string) error {
+	link := filepath.Join(dir, FilesystemLatestLinkName)
+	if current, err := os.Readlink(link); err == nil && current >= version {
+		return nil
+	}
+	// Same as files, the link is replaced with a rename
+	temp := filepath.Join(dir, "."+FilesystemLatestLinkName+".tmp")
+	os.Remove(temp)
+	if err := os.Symlink(version, temp); err != nil {
+		return err
+	}
+	return os.Rename(temp, link)
+}
+
+// Removes all but the newest versions and failures past the retention count
+func (f *filesystemDataStore) prune(dir string) error {
+	if f.conf.Retention == 0 {
+		return nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	versions, failures := []string{}, []string{}
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() {
+			continue
+		} else if _, err := time.Parse(FilesystemVersionFormat, name); err == nil {
+			versions = append(versions, name)
+		} else if _, err := time.Parse(FilesystemVersionFormat, strings.TrimSuffix(name, GitFailureSuffix)); err == nil {
+			failures = append(failures, name)
+		}
+	}
+	for _, names := range [][]string{versions, failures} {
+		// Oldest first
+		sort.Strings(names)
+		for len(names) > f.conf.Retention {
+			if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+				return err
+			}
+			names = names[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"gitlab.com/cretz/fusty/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilesystemDataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-filesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataStore, err := newFilesystemDataStore(&config.DataStoreFilesystem{
+		Directory:  filepath.Join(dir, "backups"),
+		Structure:  []string{GitStructureByDevice, "{{job}}/{{device}}.{{ext}}"},
+		Retention:  2,
+		LatestLink: true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(seconds int64, contents string, failure string) {
+		dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(seconds, 0),
+			Contents: BytesJobContents(contents), Failure: failure})
+	}
+	store(100, "first", "")
+	store(300, "third", "")
+	store(400, "", "timeout")
+	// Older results don't move the latest link
+	store(200, "second", "")
+	for _, path := range []string{"backups/by_device/dev/job", "backups/job/dev.txt"} {
+		versionDir := filepath.Join(dir, filepath.FromSlash(path))
+		files, err := ioutil.ReadDir(versionDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		expected := []string{"19700101T000320Z", "19700101T000500Z", "19700101T000640Z.failure", "latest"}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("In %v expected %v, got %v", path, expected, names)
+		}
+		if contents, err := ioutil.ReadFile(filepath.Join(versionDir, "latest")); err != nil {
+			t.Fatal(err)
+		} else if string(contents) != "third" {
+			t.Fatalf("Expected latest to be third, got %v", string(contents))
+		}
+	}
+}
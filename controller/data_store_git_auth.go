@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const GitAskPassFileName = "git-askpass.sh"
+
+// Git and SSH run this to ask for credentials instead of prompting on a
+// terminal. The credentials themselves are only ever given to the git process
+// as environment variables, never written to disk.
+const gitAskPassScript = `#!/bin/sh
+case "$1" in
+  Username*) printf '%s\n' "$FUSTY_GIT_USERNAME" ;;
+  Password*) printf '%s\n' "$FUSTY_GIT_PASSWORD" ;;
+  *assphrase*) printf '%s\n' "$FUSTY_GIT_SSH_PASSPHRASE" ;;
+  *) exit 1 ;;
+esac
+`
+
+// Whether the URL is ssh:// or scp-style like user@host:path/repo.git
+func isGitSshUrl(url string) bool {
+	if strings.HasPrefix(url, "ssh://") || strings.HasPrefix(url, "git+ssh://") || strings.HasPrefix(url, "ssh+git://") {
+		return true
+	}
+	if strings.Contains(url, "://") {
+		return false
+	}
+	// Same as git, a colon before any slash means scp-style. We require more
+	// than one character before it so Windows drive letters are paths.
+	colon := strings.Index(url, ":")
+	return colon > 1 && !strings.Contains(url[:colon], "/")
+}
+
+func (g *gitDataStore) validateSsh() error {
+	ssh := g.conf.DataStoreGitSsh
+	if !isGitSshUrl(g.conf.Url) {
+		if ssh != nil {
+			return errors.New("Git ssh settings can only be used with an SSH URL")
+		}
+		return nil
+	}
+	if g.password() != "" {
+		return errors.New("Git password cannot be used with an SSH URL, use an SSH key instead")
+	}
+	if ssh == nil {
+		return nil
+	}
+	if ssh.KeyPassphrase != "" && ssh.KeyFile == "" {
+		return errors.New("If git SSH key passphrase supplied, key file must also be supplied")
+	}
+	if ssh.KeyFile != "" {
+		if _, err := os.Stat(ssh.KeyFile); err != nil {
+			return fmt.Errorf("Unable to find git SSH key file: %v", err)
+		}
+	}
+	if ssh.KnownHostsFile != "" {
+		if _, err := os.Stat(ssh.KnownHostsFile); err != nil {
+			return fmt.Errorf("Unable to find git SSH known hosts file: %v", err)
+		}
+	}
+	return nil
+}
+
+// Writes the ask pass script to the data directory and builds the environment
+// every git command is run with
+func (g *gitDataStore) prepareAuthEnv() error {
+	askPass := filepath.Join(g.conf.DataDir, GitAskPassFileName)
+	if err := ioutil.WriteFile(askPass, []byte(gitAskPassScript), 0700); err != nil {
+		return fmt.Errorf("Unable to write git ask pass script to %v: %v", askPass, err)
+	}
+	// The file may have already existed with other permissions
+	if err := os.Chmod(askPass, 0700); err != nil {
+		return fmt.Errorf("Unable to make git ask pass script %v executable: %v", askPass, err)
+	}
+	env := map[string]string{
+		// Never hang waiting on a terminal
+		"GIT_TERMINAL_PROMPT": "0",
+		"GIT_ASKPASS":         askPass,
+	}
+	if g.username() != "" {
+		env["FUSTY_GIT_USERNAME"] = g.username()
+	}
+	if g.password() != "" {
+		env["FUSTY_GIT_PASSWORD"] = g.password()
+	}
+	if ssh := g.conf.DataStoreGitSsh; ssh != nil {
+		args := []string{"ssh"}
+		if ssh.KeyFile != "" {
+			args = append(args, "-i", ssh.KeyFile, "-o", "IdentitiesOnly=yes")
+		}
+		if ssh.KnownHostsFile != "" {
+			args = append(args, "-o", "UserKnownHostsFile="+ssh.KnownHostsFile, "-o", "StrictHostKeyChecking=yes")
+		}
+		if ssh.KeyPassphrase == "" {
+			// Batch mode prevents all prompting, including for the passphrase
+			args = append(args, "-o", "BatchMode=yes")
+		} else {
+			env["FUSTY_GIT_SSH_PASSPHRASE"] = ssh.KeyPassphrase
+			env["SSH_ASKPASS"] = askPass
+			env["SSH_ASKPASS_REQUIRE"] = "force"
+			// Older SSH versions only use the ask pass program with a display
+			if os.Getenv("DISPLAY") == "" {
+				env["DISPLAY"] = "none"
+			}
+		}
+		for i, arg := range args {
+			args[i] = shellQuote(arg)
+		}
+		env["GIT_SSH_COMMAND"] = strings.Join(args, " ")
+	}
+	g.authEnv = env
+	return nil
+}
+
+// Git runs GIT_SSH_COMMAND via the shell
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,533 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	GitBareDirName = "bare"
+	// The branch used when the remote is empty
+	GitBareDefaultBranch = "master"
+	// How many times we try to push a batch when someone else pushed first
+	gitBarePushAttempts = 5
+	gitBarePushBackoff  = 200 * time.Millisecond
+)
+
+// gitBareWriter keeps a single bare repository and builds each batch of
+// commits in memory on top of the latest remote commit. There are no working
+// copies to clean or pull.
+type gitBareWriter struct {
+	dataStore *gitDataStore
+	auth      transport.AuthMethod
+	repo      *git.Repository
+	// The remote branch we commit on top of
+	branch plumbing.ReferenceName
+}
+
+func (g *gitDataStore) startBare() error {
+	embedded, ok := g.backend.(*gitEmbeddedBackend)
+	if !ok {
+		return errors.New("Bare git data store requires the embedded backend")
+	}
+	writer := &gitBareWriter{dataStore: g, auth: embedded.auth}
+	if err := writer.initialize(); err != nil {
+		return err
+	}
+	ctx, cancel := g.context()
+	defer cancel()
+	head, err := writer.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch from %v: %v", g.conf.Url, err)
+	}
+	reader := &gitTreeFileReader{directory: g.conf.Directory}
+	if !head.IsZero() {
+		commit, err := writer.repo.CommitObject(head)
+		if err != nil {
+			return fmt.Errorf("Unable to read latest commit: %v", err)
+		}
+		if reader.tree, err = commit.Tree(); err != nil {
+			return fmt.Errorf("Unable to read latest tree: %v", err)
+		}
+	}
+	if err := g.loadOverview(reader); err != nil {
+		return err
+	}
+	go g.runWriter(writer)
+	return nil
+}
+
+func (g *gitBareWriter) initialize() error {
+	dir := filepath.Join(g.dataStore.conf.DataDir, GitBareDirName)
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		if Verbose {
+			log.Printf("Creating bare repository at %v", dir)
+		}
+		repo, err = git.PlainInit(dir, true)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to open bare repository at %v: %v", dir, err)
+	}
+	g.repo = repo
+	// Always recreate the remote in case the URL has changed
+	if err := repo.DeleteRemote(gitRemoteName); err != nil && err != git.ErrRemoteNotFound {
+		return fmt.Errorf("Unable to remove old remote: %v", err)
+	}
+	remote, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: gitRemoteName, URLs: []string{g.dataStore.conf.Url}})
+	if err != nil {
+		return fmt.Errorf("Unable to create remote: %v", err)
+	}
+	// Use whatever branch the remote HEAD is on
+	ctx, cancel := g.dataStore.context()
+	defer cancel()
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: g.auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		g.branch = plumbing.NewBranchReferenceName(GitBareDefaultBranch)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to list remote references: %v", err)
+	}
+	var head *plumbing.Reference
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+		}
+	}
+	if head != nil && head.Type() == plumbing.SymbolicReference {
+		g.branch = head.Target()
+		return nil
+	}
+	// Without the symbolic ref advertised, take the first branch on the same commit
+	for _, ref := range refs {
+		if head != nil && ref.Name().IsBranch() && ref.Hash() == head.Hash() {
+			g.branch = ref.Name()
+			return nil
+		}
+	}
+	g.branch = plumbing.NewBranchReferenceName(GitBareDefaultBranch)
+	return nil
+}
+
+// Returns the zero hash if the remote branch does not exist yet
+func (g *gitBareWriter) fetch(ctx context.Context) (plumbing.Hash, error) {
+	remoteName := plumbing.NewRemoteReferenceName(gitRemoteName, g.branch.Short())
+	err := g.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: gitRemoteName,
+		Auth:       g.auth,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + g.branch.String() + ":" + remoteName.String())},
+	})
+	if err == transport.ErrEmptyRemoteRepository || errors.Is(err, git.NoMatchingRefSpecError{}) {
+		return plumbing.ZeroHash, nil
+	} else if err != nil && err != git.NoErrAlreadyUpToDate {
+		if ctx.Err() != nil {
+			return plumbing.ZeroHash, fmt.Errorf("%v (%v)", ctx.Err(), err)
+		}
+		return plumbing.ZeroHash, err
+	}
+	ref, err := g.repo.Reference(remoteName, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return plumbing.ZeroHash, nil
+	} else if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return ref.Hash(), nil
+}
+
+func (g *gitBareWriter) pushJobs(jobs []*DataStoreJob) (map[*DataStoreJob]error, bool) {
+	var err error
+	for attempt := 1; attempt <= gitBarePushAttempts; attempt++ {
+		if attempt > 1 {
+			if Verbose {
+				log.Printf("Remote changed while pushing, retrying in the bare repository. Previous error: %v", err)
+			}
+			time.Sleep(time.Duration(attempt-1) * gitBarePushBackoff)
+		}
+		var commitErrs map[*DataStoreJob]error
+		var retry bool
+		outcomes := &gitPolicyOutcomes{}
+		if commitErrs, retry, err = g.tryPushJobs(jobs, outcomes); err == nil {
+			g.dataStore.commitPolicy.record(outcomes)
+			return commitErrs, true
+		} else if !retry {
+			break
+		}
+	}
+	logPushFailure(jobs, err)
+	return nil, false
+}
+
+// Returns true for retry if the push failed because it was not a fast-forward
+func (g *gitBareWriter) tryPushJobs(jobs []*DataStoreJob,
+	outcomes *gitPolicyOutcomes) (map[*DataStoreJob]error, bool, error) {
+	ctx, cancel := g.dataStore.context()
+	defer cancel()
+	parent, err := g.fetch(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to fetch: %v", err)
+	}
+	head, commitErrs, err := g.commitJobs(parent, jobs, outcomes)
+	if err != nil {
+		return nil, false, err
+	}
+	if head == parent {
+		return commitErrs, false, nil
+	}
+	if err := g.repo.Storer.SetReference(plumbing.NewHashReference(g.branch, head)); err != nil {
+		return nil, false, fmt.Errorf("Unable to update local branch: %v", err)
+	}
+	if Verbose {
+		log.Printf("Pushing %v from bare repository", head)
+	}
+	err = g.repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: gitRemoteName,
+		Auth:       g.auth,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(g.branch.String() + ":" + g.branch.String())},
+	})
+	if err == nil || err == git.NoErrAlreadyUpToDate {
+		return commitErrs, false, nil
+	} else if ctx.Err() != nil {
+		return nil, false, fmt.Errorf("%v (%v)", ctx.Err(), err)
+	}
+	return nil, err == git.ErrNonFastForwardUpdate || err == git.ErrForceNeeded ||
+		strings.Contains(err.Error(), "non-fast-forward") || strings.Contains(err.Error(), "fetch first"), err
+}
+
+// Returns the last commit which is the parent if nothing was committed. Jobs
+// that can't be written are left out and returned with why, the error is only
+// for when nothing can be committed. What the commit policy decided is added to
+// the outcomes.
+func (g *gitBareWriter) commitJobs(parent plumbing.Hash, jobs []*DataStoreJob,
+	outcomes *gitPolicyOutcomes) (plumbing.Hash, map[*DataStoreJob]error, error) {
+	head := parent
+	tree := plumbing.ZeroHash
+	if !parent.IsZero() {
+		commit, err := g.repo.CommitObject(parent)
+		if err != nil {
+			return plumbing.ZeroHash, nil, fmt.Errorf("Unable to read latest commit: %v", err)
+		}
+		tree = commit.TreeHash
+	}
+	commitErrs := map[*DataStoreJob]error{}
+	overviewJobs := []*DataStoreJob{}
+	for _, job := range jobs {
+		// Overviews are written last so they include the rest of the batch
+		if job.overview {
+			overviewJobs = append(overviewJobs, job)
+			continue
+		}
+		changes, err := g.dataStore.jobChanges(job)
+		if err != nil {
+			log.Printf("Failed to commit job %v for device %v: %v", job.JobName, job.DeviceName, err)
+			commitErrs[job] = err
+			continue
+		}
+		newTree, changed, err := g.updateTree(tree, changes)
+		if err != nil {
+			err = fmt.Errorf("Unable to update tree: %v", err)
+			log.Printf("Failed to commit job %v for device %v: %v", job.JobName, job.DeviceName, err)
+			commitErrs[job] = err
+			continue
+		}
+		tree = newTree
+		if !changed && !g.dataStore.commitPolicy.commitUnchanged(job) {
+			outcomes.skipped = append(outcomes.skipped, job)
+			continue
+		}
+		if head, err = g.commit(head, tree, job.commitMessage()); err != nil {
+			return plumbing.ZeroHash, nil, err
+		}
+		outcomes.committed = append(outcomes.committed, job)
+	}
+	if len(overviewJobs) > 0 {
+		changes := map[string]JobContents{}
+		for relativePath, contents := range g.dataStore.overview.readmes(g.dataStore.conf.Structure) {
+			changes[g.dataStore.repoPath(relativePath)] = BytesJobContents(contents)
+		}
+		newTree, changed, err := g.updateTree(tree, changes)
+		if err != nil {
+			err = fmt.Errorf("Unable to write README overviews: %v", err)
+			log.Printf("Failed to commit README overviews: %v", err)
+			for _, job := range overviewJobs {
+				commitErrs[job] = err
+			}
+		} else if changed {
+			if head, err = g.commit(head, newTree, gitOverviewCommitTitle); err != nil {
+				return plumbing.ZeroHash, nil, err
+			}
+		} else if Verbose {
+			log.Printf("README overviews already up to date")
+		}
+	}
+	return head, commitErrs, nil
+}
+
+func (g *gitBareWriter) commit(parent plumbing.Hash, tree plumbing.Hash, message string) (plumbing.Hash, error) {
+	if tree.IsZero() {
+		// Everything was removed
+		var err error
+		if tree, err = g.store(&object.Tree{}); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("Unable to store empty tree: %v", err)
+		}
+	}
+	signature := g.signature()
+	commit := &object.Commit{
+		Author:    signature,
+		Committer: signature,
+		Message:   message,
+		TreeHash:  tree,
+	}
+	if !parent.IsZero() {
+		commit.ParentHashes = []plumbing.Hash{parent}
+	}
+	hash, err := g.store(commit)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Unable to store commit: %v", err)
+	}
+	return hash, nil
+}
+
+// Same as the git executable, falls back to the git config if no user is set
+func (g *gitBareWriter) signature() object.Signature {
+	name, email := g.dataStore.author()
+	if name == "" && email == "" {
+		if conf, err := gitconfig.LoadConfig(gitconfig.GlobalScope); err == nil {
+			name, email = conf.User.Name, conf.User.Email
+		}
+	}
+	if name == "" {
+		name = "Fusty"
+	}
+	return object.Signature{Name: name, Email: email, When: time.Now()}
+}
+
+// Applies the changes, keyed by path relative to the tree, and returns the
+// new tree hash and whether it changed. Nil contents remove the file. The zero
+// hash is an empty tree.
+func (g *gitBareWriter) updateTree(treeHash plumbing.Hash, changes map[string]JobContents) (plumbing.Hash, bool, error) {
+	entries := []object.TreeEntry{}
+	if !treeHash.IsZero() {
+		tree, err := object.GetTree(g.repo.Storer, treeHash)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		entries = append(entries, tree.Entries...)
+	}
+	files := map[string]JobContents{}
+	subtrees := map[string]map[string]JobContents{}
+	for path, contents := range changes {
+		if slash := strings.Index(path, "/"); slash == -1 {
+			files[path] = contents
+		} else if sub, ok := subtrees[path[:slash]]; ok {
+			sub[path[slash+1:]] = contents
+		} else {
+			subtrees[path[:slash]] = map[string]JobContents{path[slash+1:]: contents}
+		}
+	}
+	changed := false
+	for name, contents := range files {
+		index := treeEntryIndex(entries, name)
+		if index >= 0 && entries[index].Mode == filemode.Dir {
+			return plumbing.ZeroHash, false, fmt.Errorf("Cannot write file %v over directory", name)
+		}
+		if contents == nil {
+			if index >= 0 {
+				entries = append(entries[:index], entries[index+1:]...)
+				changed = true
+			}
+			continue
+		}
+		blob, err := g.storeBlob(contents)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		if index == -1 {
+			entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: blob})
+			changed = true
+		} else if entries[index].Hash != blob {
+			entries[index].Hash = blob
+			changed = true
+		}
+	}
+	for name, subChanges := range subtrees {
+		index := treeEntryIndex(entries, name)
+		subHash := plumbing.ZeroHash
+		if index >= 0 {
+			if entries[index].Mode != filemode.Dir {
+				return plumbing.ZeroHash, false, fmt.Errorf("Cannot write directory %v over file", name)
+			}
+			subHash = entries[index].Hash
+		}
+		newHash, subChanged, err := g.updateTree(subHash, subChanges)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		} else if !subChanged {
+			continue
+		}
+		changed = true
+		if newHash.IsZero() {
+			// Git has no empty directories
+			if index >= 0 {
+				entries = append(entries[:index], entries[index+1:]...)
+			}
+		} else if index >= 0 {
+			entries[index].Hash = newHash
+		} else {
+			entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: newHash})
+		}
+	}
+	if !changed {
+		return treeHash, false, nil
+	} else if len(entries) == 0 {
+		return plumbing.ZeroHash, true, nil
+	}
+	sort.Sort(gitTreeEntries(entries))
+	hash, err := g.store(&object.Tree{Entries: entries})
+	return hash, true, err
+}
+
+func treeEntryIndex(entries []object.TreeEntry, name string) int {
+	for i, entry := range entries {
+		if entry.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// The contents are read once for the hash and again when stored, so large
+// results are never held in memory
+func (g *gitBareWriter) storeBlob(contents JobContents) (plumbing.Hash, error) {
+	obj := &gitBlobObject{contents: contents}
+	reader, err := contents.Open()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer reader.Close()
+	hasher := plumbing.NewHasher(plumbing.BlobObject, contents.Size())
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	obj.hash = hasher.Sum()
+	// Nothing to write if we already have it
+	if g.repo.Storer.HasEncodedObject(obj.hash) == nil {
+		return obj.hash, nil
+	}
+	return g.repo.Storer.SetEncodedObject(obj)
+}
+
+// gitBlobObject is a blob read from job contents
+type gitBlobObject struct {
+	contents JobContents
+	hash     plumbing.Hash
+}
+
+func (g *gitBlobObject) Hash() plumbing.Hash {
+	return g.hash
+}
+
+func (g *gitBlobObject) Type() plumbing.ObjectType {
+	return plumbing.BlobObject
+}
+
+func (g *gitBlobObject) SetType(plumbing.ObjectType) {
+}
+
+func (g *gitBlobObject) Size() int64 {
+	return g.contents.Size()
+}
+
+func (g *gitBlobObject) SetSize(int64) {
+}
+
+func (g *gitBlobObject) Reader() (io.ReadCloser, error) {
+	return g.contents.Open()
+}
+
+func (g *gitBlobObject) Writer() (io.WriteCloser, error) {
+	return nil, errors.New("Git blob from job contents cannot be written")
+}
+
+func (g *gitBareWriter) store(encodable interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := g.repo.Storer.NewEncodedObject()
+	if err := encodable.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return g.repo.Storer.SetEncodedObject(obj)
+}
+
+// Git sorts tree entries by name as though directories end with a slash
+type gitTreeEntries []object.TreeEntry
+
+func (g gitTreeEntries) Len() int           { return len(g) }
+func (g gitTreeEntries) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g gitTreeEntries) Less(i, j int) bool { return g.sortName(i) < g.sortName(j) }
+
+func (g gitTreeEntries) sortName(i int) string {
+	if g[i].Mode == filemode.Dir {
+		return g[i].Name + "/"
+	}
+	return g[i].Name
+}
+
+// gitTreeFileReader reads files from a commit tree which is nil when the
+// remote is empty
+type gitTreeFileReader struct {
+	tree      *object.Tree
+	directory string
+}
+
+func (g *gitTreeFileReader) subdirectories(relativePath string) ([]string, error) {
+	if g.tree == nil {
+		return nil, nil
+	}
+	tree, err := g.tree.Tree(g.path(relativePath))
+	if err == object.ErrDirectoryNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for _, entry := range tree.Entries {
+		if entry.Mode == filemode.Dir {
+			dirs = append(dirs, entry.Name)
+		}
+	}
+	return dirs, nil
+}
+
+func (g *gitTreeFileReader) readFile(relativePath string) ([]byte, error) {
+	if g.tree == nil {
+		return nil, nil
+	}
+	file, err := g.tree.File(g.path(relativePath))
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents()
+	return []byte(contents), err
+}
+
+func (g *gitTreeFileReader) path(relativePath string) string {
+	if g.directory == "" {
+		return relativePath
+	}
+	return g.directory + "/" + relativePath
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gitCliBackend runs the system git executable
+type gitCliBackend struct {
+	dataStore *gitDataStore
+}
+
+func (g *gitCliBackend) validateRemote(ctx context.Context) error {
+	_, err := g.run(ctx, "", nil, "ls-remote", g.dataStore.conf.Url)
+	return err
+}
+
+func (g *gitCliBackend) clone(ctx context.Context, dir string) error {
+	_, err := g.run(ctx, dir, nil, "clone", g.dataStore.conf.Url, dir)
+	return err
+}
+
+func (g *gitCliBackend) update(ctx context.Context, dir string) error {
+	// Local commits that failed to push are dropped since they are in the spool
+	if _, err := g.run(ctx, dir, nil, "fetch"); err != nil {
+		return err
+	}
+	_, err := g.run(ctx, dir, nil, "reset", "--hard", "@{upstream}")
+	return err
+}
+
+func (g *gitCliBackend) hasChanges(ctx context.Context, dir string) (bool, error) {
+	out, err := g.run(ctx, dir, nil, "status", "--porcelain")
+	return strings.TrimSpace(out) != "", err
+}
+
+func (g *gitCliBackend) commitAll(ctx context.Context, dir string, message string) error {
+	// If git status w/ porcelain returns anything, we need to add
+	if changed, err := g.hasChanges(ctx, dir); err != nil {
+		return err
+	} else if changed {
+		// Add everything including removals
+		if _, err := g.run(ctx, dir, nil, "add", "-A", "."); err != nil {
+			return err
+		}
+	}
+	// We --allow-empty so we can commit a message even without contents/change
+	args := []string{"commit", "--allow-empty", "-m", message}
+	// We have to make the author as friendly name or username
+	env := map[string]string{}
+	if name, email := g.dataStore.author(); name != "" || email != "" {
+		args = append(args, "--author", name+" <"+email+">")
+		if name != "" {
+			env["GIT_COMMITTER_NAME"] = name
+		}
+		if email != "" {
+			env["GIT_COMMITTER_EMAIL"] = email
+		}
+	}
+	_, err := g.run(ctx, dir, env, args...)
+	return err
+}
+
+func (g *gitCliBackend) push(ctx context.Context, dir string) error {
+	_, err := g.run(ctx, dir, nil, "push")
+	return err
+}
+
+func (g *gitCliBackend) run(ctx context.Context, dir string, env map[string]string, args ...string) (string, error) {
+	return doGitCmd(ctx, dir, g.dataStore.authEnv, env, args...)
+}
+
+// Credentials are never prompted for, they are given to git via the auth
+// environment. The command is killed if the context is done first.
+func doGitCmd(ctx context.Context, dir string, authEnv map[string]string, env map[string]string,
+	args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if dir != "" {
+		cmd.Dir = dir
+	}
+	if len(authEnv) > 0 || len(env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range authEnv {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	if Verbose {
+		log.Printf("Running git command with args %v", args)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%v (%v)", ctx.Err(), err)
+		}
+		if dir == "" {
+			return "", fmt.Errorf("Error running git: %v. Output:\n%v", err, out.String())
+		} else {
+			return "", fmt.Errorf("Error running git in %v: %v. Output:\n%v", dir, err, out.String())
+		}
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const gitRemoteName = "origin"
+
+// gitEmbeddedBackend uses a pure Go git implementation so no git executable
+// is needed
+type gitEmbeddedBackend struct {
+	dataStore *gitDataStore
+	// Nil for no authentication
+	auth transport.AuthMethod
+}
+
+func newGitEmbeddedBackend(dataStore *gitDataStore) (*gitEmbeddedBackend, error) {
+	ret := &gitEmbeddedBackend{dataStore: dataStore}
+	url := dataStore.conf.Url
+	if isGitSshUrl(url) {
+		endpoint, err := transport.NewEndpoint(url)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid git SSH URL: %v", err)
+		}
+		user := endpoint.User
+		if user == "" {
+			user = gitssh.DefaultUsername
+		}
+		conf := dataStore.conf.DataStoreGitSsh
+		var knownHostsFiles []string
+		if conf != nil && conf.KnownHostsFile != "" {
+			knownHostsFiles = []string{conf.KnownHostsFile}
+		}
+		// With no files given, this uses the same known hosts files SSH does
+		callback, err := gitssh.NewKnownHostsCallback(knownHostsFiles...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load git SSH known hosts: %v", err)
+		}
+		if conf != nil && conf.KeyFile != "" {
+			keys, err := gitssh.NewPublicKeysFromFile(user, conf.KeyFile, conf.KeyPassphrase)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to load git SSH key file: %v", err)
+			}
+			keys.HostKeyCallback = callback
+			ret.auth = keys
+		} else {
+			agent, err := gitssh.NewSSHAgentAuth(user)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to use SSH agent for git without a key file: %v", err)
+			}
+			agent.HostKeyCallback = callback
+			ret.auth = agent
+		}
+	} else if dataStore.username() != "" && (strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
+		ret.auth = &githttp.BasicAuth{Username: dataStore.username(), Password: dataStore.password()}
+	}
+	return ret, nil
+}
+
+func (g *gitEmbeddedBackend) validateRemote(ctx context.Context) error {
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: gitRemoteName,
+		URLs: []string{g.dataStore.conf.Url},
+	})
+	_, err := remote.ListContext(ctx, &git.ListOptions{Auth: g.auth})
+	// Same as ls-remote, an empty repository is still a repository
+	if err == transport.ErrEmptyRemoteRepository {
+		return nil
+	}
+	return g.contextError(ctx, err)
+}
+
+func (g *gitEmbeddedBackend) clone(ctx context.Context, dir string) error {
+	_, err := git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+		URL:        g.dataStore.conf.Url,
+		RemoteName: gitRemoteName,
+		Auth:       g.auth,
+	})
+	if err != nil {
+		// Don't leave a partial clone behind to be mistaken for a good one
+		if removeErr := os.RemoveAll(filepath.Join(dir, ".git")); removeErr != nil {
+			log.Printf("Unable to remove partial clone at %v: %v", dir, removeErr)
+		}
+	}
+	return g.contextError(ctx, err)
+}
+
+func (g *gitEmbeddedBackend) update(ctx context.Context, dir string) error {
+	repo, worktree, err := g.open(dir)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("Unable to read HEAD: %v", err)
+	}
+	if err := worktree.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: head.Hash()}); err != nil {
+		return fmt.Errorf("Unable to reset: %v", err)
+	}
+	err = repo.FetchContext(ctx, &git.FetchOptions{RemoteName: gitRemoteName, Auth: g.auth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return g.contextError(ctx, err)
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName(gitRemoteName, head.Name().Short()), true)
+	if err != nil {
+		return fmt.Errorf("Unable to find remote branch for %v: %v", head.Name().Short(), err)
+	}
+	if remoteRef.Hash() == head.Hash() {
+		return nil
+	}
+	// Local commits that failed to push are dropped since they are in the spool
+	if err := worktree.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: remoteRef.Hash()}); err != nil {
+		return fmt.Errorf("Unable to reset to remote: %v", err)
+	}
+	return nil
+}
+
+func (g *gitEmbeddedBackend) hasChanges(ctx context.Context, dir string) (bool, error) {
+	_, worktree, err := g.open(dir)
+	if err != nil {
+		return false, err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return false, fmt.Errorf("Unable to get status: %v", err)
+	}
+	return !status.IsClean(), nil
+}
+
+func (g *gitEmbeddedBackend) commitAll(ctx context.Context, dir string, message string) error {
+	_, worktree, err := g.open(dir)
+	if err != nil {
+		return err
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return fmt.Errorf("Unable to add: %v", err)
+	}
+	options := &git.CommitOptions{AllowEmptyCommits: true}
+	// Otherwise it comes from the git config
+	if name, email := g.dataStore.author(); name != "" || email != "" {
+		options.Author = &object.Signature{Name: name, Email: email, When: time.Now()}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := worktree.Commit(message, options); err != nil {
+		return fmt.Errorf("Unable to commit: %v", err)
+	}
+	return nil
+}
+
+func (g *gitEmbeddedBackend) push(ctx context.Context, dir string) error {
+	repo, _, err := g.open(dir)
+	if err != nil {
+		return err
+	}
+	err = repo.PushContext(ctx, &git.PushOptions{RemoteName: gitRemoteName, Auth: g.auth})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return g.contextError(ctx, err)
+}
+
+func (g *gitEmbeddedBackend) open(dir string) (*git.Repository, *git.Worktree, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to open repository: %v", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to open worktree: %v", err)
+	}
+	return repo, worktree, nil
+}
+
+// Makes it clear when the failure is because we ran out of time
+func (g *gitEmbeddedBackend) contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%v (%v)", ctx.Err(), err)
+	}
+	return err
+}
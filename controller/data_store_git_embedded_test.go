@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"errors"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gitlab.com/cretz/fusty/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitEmbeddedDataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remoteDir := filepath.Join(dir, "remote")
+	seedEmbeddedRemote(t, remoteDir, filepath.Join(dir, "seed"))
+	dataDir := filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, GitDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	dataStore, err := newGitDataStore(&config.DataStoreGit{
+		Url:              remoteDir,
+		Directory:        "backups",
+		PoolSize:         1,
+		DataDir:          dataDir,
+		Backend:          GitBackendEmbedded,
+		DataStoreGitUser: &config.DataStoreGitUser{FriendlyName: "John Doe", Email: "jdoe@example.com"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0), Failure: "timeout"})
+	failure := waitForEmbeddedCommit(t, remoteDir, 2)
+	if !strings.Contains(failure.Message, "* Failure: timeout") || failure.Author.Name != "John Doe" {
+		t.Fatalf("Unexpected failure commit: %v", failure)
+	}
+	if _, err := failure.File("backups/by_device/dev/job.failure"); err != nil {
+		t.Fatalf("Expected failure file: %v", err)
+	}
+	dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(200, 0), Contents: BytesJobContents("config")})
+	success := waitForEmbeddedCommit(t, remoteDir, 3)
+	if file, err := success.File("backups/by_device/dev/job"); err != nil {
+		t.Fatalf("Expected job file: %v", err)
+	} else if contents, _ := file.Contents(); contents != "config" {
+		t.Fatalf("Unexpected contents: %v", contents)
+	}
+	if _, err := success.File("backups/by_device/dev/job.failure"); err != object.ErrFileNotFound {
+		t.Fatalf("Expected failure file to be removed, got: %v", err)
+	}
+}
+
+func seedEmbeddedRemote(t *testing.T, remoteDir string, seedDir string) {
+	if _, err := git.PlainInit(remoteDir, true); err != nil {
+		t.Fatal(err)
+	}
+	seed, err := git.PlainInit(seedDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := seed.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("Initial commit", &git.CommitOptions{
+		AllowEmptyCommits: true,
+		Author:            &object.Signature{Name: "Seed", Email: "seed@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seed.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{remoteDir}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Push(&git.PushOptions{RemoteName: "origin"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Waits for the remote HEAD to have the given number of commits and returns it
+func waitForEmbeddedCommit(t *testing.T, remoteDir string, count int) *object.Commit {
+	remote, err := git.PlainOpen(remoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if head, err := remote.Head(); err == nil {
+			if commits, err := remote.Log(&git.LogOptions{From: head.Hash()}); err == nil {
+				actual := 0
+				commits.ForEach(func(*object.Commit) error {
+					actual++
+					return nil
+				})
+				if actual == count {
+					commit, err := remote.CommitObject(head.Hash())
+					if err != nil {
+						t.Fatal(err)
+					}
+					return commit
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %v commits", count)
+	return nil
+}
+
+func TestGitBareDataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-bare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remoteDir := filepath.Join(dir, "remote")
+	seedDir := filepath.Join(dir, "seed")
+	seedEmbeddedRemote(t, remoteDir, seedDir)
+	dataDir := filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, GitDirPerm); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.DataStoreGit{
+		Url:                    remoteDir,
+		Directory:              "backups",
+		Structure:              []string{GitStructureByDevice, GitStructureByJob},
+		IncludeReadmeOverviews: true,
+		DataDir:                dataDir,
+		Bare:                   true,
+	}
+	dataStore, err := newGitDataStore(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Backend != GitBackendEmbedded {
+		t.Fatalf("Expected embedded backend, got %v", conf.Backend)
+	}
+	dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0), Failure: "timeout"})
+	// The job and then the overview
+	waitForEmbeddedCommit(t, remoteDir, 3)
+
+	// Someone else pushes
+	seed, err := git.PlainOpen(seedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := seed.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.Pull(&git.PullOptions{RemoteName: "origin"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(seedDir, "other"), []byte("other"), GitFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add("other"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("Other commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Seed", Email: "seed@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.Push(&git.PushOptions{RemoteName: "origin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(200, 0), Contents: BytesJobContents("config")})
+	head := waitForEmbeddedCommit(t, remoteDir, 6)
+	if head.Message != gitOverviewCommitTitle {
+		t.Fatalf("Expected overview commit, got: %v", head.Message)
+	}
+	for _, path := range []string{"other", "backups/by_device/dev/job", "backups/by_job/job/dev", "backups/by_job/README.md"} {
+		if _, err := head.File(path); err != nil {
+			t.Fatalf("Expected file %v: %v", path, err)
+		}
+	}
+	if _, err := head.File("backups/by_device/dev/job.failure"); err != object.ErrFileNotFound {
+		t.Fatalf("Expected failure file to be removed, got: %v", err)
+	}
+	readme, err := head.File("backups/by_device/dev/README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := readme.Contents(); !strings.Contains(contents, "| [job](job) | 1970-01-01 00:03:20 UTC | Success |") {
+		t.Fatalf("Unexpected readme:\n%v", contents)
+	}
+
+	// Starting again picks up the overview from the remote
+	restarted, err := newGitDataStore(&config.DataStoreGit{
+		Url:                    remoteDir,
+		Directory:              "backups",
+		Structure:              []string{GitStructureByJob},
+		IncludeReadmeOverviews: true,
+		DataDir:                dataDir,
+		Bare:                   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := restarted.overview.all(); len(entries) != 1 || entries[0].lastRun.Unix() != 200 || entries[0].failed {
+		t.Fatalf("Unexpected overview entries: %v", entries)
+	}
+}
+
+type unreadableJobContents struct{}
+
+func (unreadableJobContents) Open() (io.ReadCloser, error) {
+	return nil, errors.New("Contents are gone")
+}
+
+func (unreadableJobContents) Size() int64 {
+	return 6
+}
+
+func TestGitDataStoreCommitFailure(t *testing.T) {
+	for _, bare := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "fusty-commit-failure")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		remoteDir := filepath.Join(dir, "remote")
+		seedEmbeddedRemote(t, remoteDir, filepath.Join(dir, "seed"))
+		dataDir := filepath.Join(dir, "data")
+		if err := os.Mkdir(dataDir, GitDirPerm); err != nil {
+			t.Fatal(err)
+		}
+		dataStore, err := newGitDataStore(&config.DataStoreGit{
+			Url:              remoteDir,
+			PoolSize:         1,
+			DataDir:          dataDir,
+			Backend:          GitBackendEmbedded,
+			Bare:             bare,
+			DataStoreGitUser: &config.DataStoreGitUser{FriendlyName: "John Doe", Email: "jdoe@example.com"},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := make(chan error, 2)
+		finished := func(err error) { stored <- err }
+		dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "bad", JobTime: time.Unix(100, 0),
+			Contents: unreadableJobContents{}, stored: finished})
+		if err := <-stored; err == nil || !strings.Contains(err.Error(), "Contents are gone") {
+			t.Fatalf("Expected commit error with bare %v, got: %v", bare, err)
+		}
+		// Others still make it
+		dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "good", JobTime: time.Unix(100, 0),
+			Contents: BytesJobContents("config"), stored: finished})
+		if err := <-stored; err != nil {
+			t.Fatalf("Unexpected error with bare %v: %v", bare, err)
+		}
+		head := waitForEmbeddedCommit(t, remoteDir, 2)
+		if _, err := head.File("by_device/dev/good"); err != nil {
+			t.Fatalf("Expected good job file with bare %v: %v", bare, err)
+		}
+		if status := dataStore.spool.status(); status.SpoolDepth != 0 {
+			t.Fatalf("Expected nothing spooled with bare %v, got %v", bare, status.SpoolDepth)
+		}
+	}
+}
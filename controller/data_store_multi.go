@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// multiDataStore hands every job to each of its data stores. Every data store
+// has its own queue so one that is slow or failing never holds up the others.
+type multiDataStore struct {
+	stores []*queuedDataStore
+	// Nil if outcomes are not recorded
+	history History
+}
+
+type queuedDataStore struct {
+	name string
+	DataStore
+	lock *sync.Mutex
+	// Oldest first
+	pending         []*DataStoreJob
+	pendingWorkChan chan bool
+}
+
+// Creates every configured data store. Each job outcome in each data store is
+// recorded in the history if it is not nil.
+func NewDataStoresFromConfig(confs []*config.DataStore, deviceStore DeviceStore, history History) (DataStore, error) {
+	if len(confs) == 0 {
+		return nil, errors.New("Data store configuration not found")
+	}
+	if err := validateDataStoreConfigs(confs); err != nil {
+		return nil, err
+	}
+	multi := &multiDataStore{history: history}
+	for _, conf := range confs {
+		dataStore, err := NewDataStoreFromConfig(conf, deviceStore)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create data store %v: %v", conf.Name, err)
+		}
+		multi.add(conf.Name, dataStore)
+	}
+	return multi, nil
+}
+
+// Starts the queue for the data store
+func (m *multiDataStore) add(name string, dataStore DataStore) {
+	queued := &queuedDataStore{
+		name:            name,
+		DataStore:       dataStore,
+		lock:            &sync.Mutex{},
+		pendingWorkChan: make(chan bool, 1),
+	}
+	m.stores = append(m.stores, queued)
+	go queued.run()
+}
+
+// Names default to the type and must be unique. Git data stores cannot share
+// a data directory since their clones and spools would collide.
+func validateDataStoreConfigs(confs []*config.DataStore) error {
+	names := map[string]bool{}
+	gitDataDirs := map[string]string{}
+	for _, conf := range confs {
+		if conf.Name == "" {
+			conf.Name = conf.Type
+		}
+		if names[conf.Name] {
+			return fmt.Errorf("Data store name %v is used more than once", conf.Name)
+		}
+		names[conf.Name] = true
+		if conf.Type == "git" && conf.DataStoreGit != nil {
+			// An empty data directory is the working directory
+			dir, err := filepath.Abs(conf.DataStoreGit.DataDir)
+			if err != nil {
+				return fmt.Errorf("Invalid git data directory %v: %v", conf.DataStoreGit.DataDir, err)
+			}
+			if other, ok := gitDataDirs[dir]; ok {
+				return fmt.Errorf("Data stores %v and %v cannot share git data directory %v", other, conf.Name, dir)
+			}
+			gitDataDirs[dir] = conf.Name
+		}
+	}
+	return nil
+}
+
+// Contents in a file are removed once every data store has reported on the
+// job the first time
+func (m *multiDataStore) Store(job *DataStoreJob) {
+	remainingLock := &sync.Mutex{}
+	remaining := len(m.stores)
+	for _, store := range m.stores {
+		// Each data store gets its own copy to report on
+		copied := *job
+		if m.history != nil {
+			m.history.RecordDataStore(job, store.name, &DataStoreOutcome{Status: DataStoreOutcomePending})
+		}
+		name, reported := store.name, false
+		copied.stored = func(err error) {
+			if m.history != nil {
+				m.recordOutcome(job, name, err)
+			}
+			remainingLock.Lock()
+			defer remainingLock.Unlock()
+			if !reported {
+				reported = true
+				if remaining--; remaining == 0 {
+					if contents, ok := job.Contents.(*fileJobContents); ok {
+						contents.remove()
+					}
+				}
+			}
+		}
+		store.enqueue(&copied)
+	}
+}
+
+func (m *multiDataStore) recordOutcome(job *DataStoreJob, name string, err error) {
+	if err != nil {
+		m.history.RecordDataStore(job, name, &DataStoreOutcome{Status: DataStoreOutcomeFailed, Failure: err.Error()})
+	} else {
+		m.history.RecordDataStore(job, name, &DataStoreOutcome{Status: DataStoreOutcomeStored})
+	}
+}
+
+// The totals across every data store along with each one by name
+func (m *multiDataStore) Status() *DataStoreStatus {
+	status := &DataStoreStatus{DataStores: make(map[string]*DataStoreStatus, len(m.stores))}
+	for _, store := range m.stores {
+		storeStatus := store.Status()
+		store.lock.Lock()
+		storeStatus.QueueDepth = len(store.pending)
+		store.lock.Unlock()
+		status.DataStores[store.name] = storeStatus
+		status.QueueDepth += storeStatus.QueueDepth
+		status.SpoolDepth += storeStatus.SpoolDepth
+		if storeStatus.OldestSpooled != 0 && (status.OldestSpooled == 0 || storeStatus.OldestSpooled < status.OldestSpooled) {
+			status.OldestSpooled = storeStatus.OldestSpooled
+		}
+		if storeStatus.NextRetry != 0 && (status.NextRetry == 0 || storeStatus.NextRetry < status.NextRetry) {
+			status.NextRetry = storeStatus.NextRetry
+		}
+	}
+	return status
+}
+
+func (q *queuedDataStore) enqueue(job *DataStoreJob) {
+	q.lock.Lock()
+	q.pending = append(q.pending, job)
+	q.lock.Unlock()
+	// Non-blocking since a signal already waiting covers this job too
+	select {
+	case q.pendingWorkChan <- true:
+	default:
+	}
+}
+
+func (q *queuedDataStore) run() {
+	for {
+		<-q.pendingWorkChan
+		for {
+			q.lock.Lock()
+			if len(q.pending) == 0 {
+				q.lock.Unlock()
+				break
+			}
+			job := q.pending[0]
+			q.pending = q.pending[1:]
+			q.lock.Unlock()
+			if Verbose {
+				log.Printf("Handing job %v on %v to data store %v", job.JobName, job.DeviceName, q.name)
+			}
+			q.DataStore.Store(job)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"errors"
+	"gitlab.com/cretz/fusty/config"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiDataStore(t *testing.T) {
+	history := newLocalHistory(DefaultHistorySize)
+	multi := &multiDataStore{history: history}
+	started, blocked := make(chan bool, 2), make(chan bool)
+	multi.add("blocked", &funcDataStore{func(job *DataStoreJob) {
+		started <- true
+		<-blocked
+		job.finished(nil)
+	}})
+	multi.add("failing", &funcDataStore{func(job *DataStoreJob) { job.finished(errors.New("Disk full")) }})
+	stored := make(chan *DataStoreJob, 2)
+	multi.add("working", &funcDataStore{func(job *DataStoreJob) {
+		stored <- job
+		job.finished(nil)
+	}})
+	for _, seconds := range []int64{100, 200} {
+		job := &DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(seconds, 0)}
+		history.Record(job)
+		multi.Store(job)
+	}
+	// The blocked data store doesn't hold up the others
+	for _, seconds := range []int64{100, 200} {
+		select {
+		case job := <-stored:
+			if job.JobTime.Unix() != seconds {
+				t.Fatalf("Expected job at %v, got %v", seconds, job.JobTime.Unix())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for working data store")
+		}
+	}
+	<-started
+	if status := multi.Status(); status.DataStores["blocked"].QueueDepth != 1 {
+		t.Fatalf("Expected one job queued for blocked data store, got %v", status.DataStores["blocked"].QueueDepth)
+	}
+	close(blocked)
+	expected := map[string]*DataStoreOutcome{
+		"blocked": &DataStoreOutcome{Status: DataStoreOutcomeStored},
+		"failing": &DataStoreOutcome{Status: DataStoreOutcomeFailed, Failure: "Disk full"},
+		"working": &DataStoreOutcome{Status: DataStoreOutcomeStored},
+	}
+	var outcomes []*JobOutcome
+	for i := 0; i < 50; i++ {
+		outcomes = history.DeviceJobHistory("dev", "job").Outcomes
+		if reflect.DeepEqual(outcomes[0].DataStores, expected) && reflect.DeepEqual(outcomes[1].DataStores, expected) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Expected outcomes %v, got %v and %v", expected, outcomes[0].DataStores, outcomes[1].DataStores)
+}
+
+func TestValidateDataStoreConfigs(t *testing.T) {
+	tests := []struct {
+		confs    []*config.DataStore
+		expected string
+	}{
+		{[]*config.DataStore{{Type: "git", DataStoreGit: &config.DataStoreGit{DataDir: "a"}},
+			{Type: "filesystem"}}, ""},
+		{[]*config.DataStore{{Type: "git", DataStoreGit: &config.DataStoreGit{DataDir: "a"}},
+			{Name: "backup", Type: "git", DataStoreGit: &config.DataStoreGit{DataDir: "b"}}}, ""},
+		{[]*config.DataStore{{Type: "filesystem"}, {Type: "filesystem"}},
+			"Data store name filesystem is used more than once"},
+		{[]*config.DataStore{{Type: "git", DataStoreGit: &config.DataStoreGit{DataDir: "a"}},
+			{Name: "backup", Type: "git", DataStoreGit: &config.DataStoreGit{DataDir: "a/"}}},
+			"Data stores git and backup cannot share git data directory"},
+	}
+	for _, test := range tests {
+		err := validateDataStoreConfigs(test.confs)
+		if test.expected == "" && err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		} else if test.expected != "" && (err == nil || !strings.HasPrefix(err.Error(), test.expected)) {
+			t.Fatalf("Expected error %v, got %v", test.expected, err)
+		}
+	}
+}
+
+// funcDataStore stores with the function
+type funcDataStore struct {
+	store func(job *DataStoreJob)
+}
+
+func (f *funcDataStore) Store(job *DataStoreJob) {
+	f.store(job)
+}
+
+func (f *funcDataStore) Status() *DataStoreStatus {
+	return &DataStoreStatus{}
+}
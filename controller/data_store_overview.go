@@ -0,0 +1,320 @@
+package controller
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GitReadmeName = "README.md"
+	// Overview jobs are queued under this key so only one is ever written at a time
+	gitOverviewKey         = jobKeySplit + "readme"
+	gitOverviewTimeFormat  = "2006-01-02 15:04:05 MST"
+	gitOverviewStatusOk    = "Success"
+	gitOverviewStatusFail  = "Failure"
+	gitOverviewCommitTitle = "Update README overviews"
+)
+
+// gitOverview is the last known outcome of every job that has been pushed
+type gitOverview struct {
+	lock *sync.Mutex
+	// Keyed by job key
+	entries map[string]*gitOverviewEntry
+}
+
+type gitOverviewEntry struct {
+	deviceName string
+	jobName    string
+	lastRun    time.Time
+	failed     bool
+}
+
+func newGitOverview() *gitOverview {
+	return &gitOverview{lock: &sync.Mutex{}, entries: make(map[string]*gitOverviewEntry)}
+}
+
+func (g *gitOverview) update(deviceName string, jobName string, lastRun time.Time, failed bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	key := (&DataStoreJob{DeviceName: deviceName, JobName: jobName}).key()
+	if existing, ok := g.entries[key]; ok && existing.lastRun.After(lastRun) {
+		return
+	}
+	g.entries[key] = &gitOverviewEntry{deviceName: deviceName, jobName: jobName, lastRun: lastRun.UTC(), failed: failed}
+}
+
+// Returns a copy of all entries
+func (g *gitOverview) all() []*gitOverviewEntry {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	ret := make([]*gitOverviewEntry, 0, len(g.entries))
+	for _, entry := range g.entries {
+		copied := *entry
+		ret = append(ret, &copied)
+	}
+	return ret
+}
+
+// Keyed by path relative to the configured directory
+func (g *gitOverview) readmes(structures []string) map[string][]byte {
+	entries := g.all()
+	ret := map[string][]byte{}
+	for _, structure := range structures {
+		switch structure {
+		case GitStructureByDevice:
+			g.addReadmes(ret, structure, "Devices", "Device", "Job", entries,
+				func(e *gitOverviewEntry) (string, string) { return e.deviceName, e.jobName })
+		case GitStructureByJob:
+			g.addReadmes(ret, structure, "Jobs", "Job", "Device", entries,
+				func(e *gitOverviewEntry) (string, string) { return e.jobName, e.deviceName })
+		}
+	}
+	return ret
+}
+
+// The names function returns the directory name then the file name of an entry
+func (g *gitOverview) addReadmes(readmes map[string][]byte, structure string, title string, dirColumn string,
+	fileColumn string, entries []*gitOverviewEntry, names func(*gitOverviewEntry) (string, string)) {
+	byDir := map[string][]*gitOverviewEntry{}
+	for _, entry := range entries {
+		dirName, _ := names(entry)
+		byDir[dirName] = append(byDir[dirName], entry)
+	}
+	dirNames := make([]string, 0, len(byDir))
+	for dirName := range byDir {
+		dirNames = append(dirNames, dirName)
+	}
+	sort.Strings(dirNames)
+	top := &bytes.Buffer{}
+	fmt.Fprintf(top, "# %v\n\n| %v | %v | Last Run | Failing |\n| --- | --- | --- | --- |\n",
+		title, dirColumn, fileColumn+"s")
+	for _, dirName := range dirNames {
+		dirEntries := byDir[dirName]
+		sort.Sort(overviewEntriesByName{dirEntries, names})
+		lastRun := time.Time{}
+		failing := 0
+		dir := &bytes.Buffer{}
+		fmt.Fprintf(dir, "# %v\n\n| %v | Last Run | Status |\n| --- | --- | --- |\n",
+			escapeOverviewText(dirName), fileColumn)
+		for _, entry := range dirEntries {
+			_, fileName := names(entry)
+			// Same as the job paths
+			filePath := sanitizePathSegment(fileName)
+			status := gitOverviewStatusOk
+			if entry.failed {
+				failing++
+				status = "[" + gitOverviewStatusFail + "](" + overviewLink(filePath+GitFailureSuffix) + ")"
+			}
+			if entry.lastRun.After(lastRun) {
+				lastRun = entry.lastRun
+			}
+			fmt.Fprintf(dir, "| [%v](%v) | %v | %v |\n", escapeOverviewText(fileName), overviewLink(filePath),
+				entry.lastRun.Format(gitOverviewTimeFormat), status)
+		}
+		dirPath := sanitizePathSegment(dirName)
+		readmes[structure+"/"+dirPath+"/"+GitReadmeName] = dir.Bytes()
+		fmt.Fprintf(top, "| [%v](%v) | %v | %v | %v |\n", escapeOverviewText(dirName),
+			overviewLink(dirPath+"/"+GitReadmeName), len(dirEntries), lastRun.Format(gitOverviewTimeFormat), failing)
+	}
+	readmes[structure+"/"+GitReadmeName] = top.Bytes()
+}
+
+// gitFileReader reads files of a previous run. Paths are relative to the
+// configured directory. Missing paths are not errors, they are just empty.
+type gitFileReader interface {
+	subdirectories(relativePath string) ([]string, error)
+	readFile(relativePath string) ([]byte, error)
+}
+
+type gitDirFileReader struct {
+	dir string
+}
+
+func (g *gitDirFileReader) subdirectories(relativePath string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(g.dir, relativePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			dirs = append(dirs, info.Name())
+		}
+	}
+	return dirs, nil
+}
+
+func (g *gitDirFileReader) readFile(relativePath string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(g.dir, relativePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return contents, err
+}
+
+// Seed the overview from the README files of a previous run. Only the first
+// structure with overviews is needed since they all contain the same
+// information.
+func (g *gitOverview) load(reader gitFileReader, structures []string) error {
+	structure := ""
+	for _, candidate := range structures {
+		if candidate == GitStructureByDevice || candidate == GitStructureByJob {
+			structure = candidate
+			break
+		}
+	}
+	if structure == "" {
+		return nil
+	}
+	dirs, err := reader.subdirectories(structure)
+	if err != nil {
+		return fmt.Errorf("Unable to read overview directory: %v", err)
+	}
+	for _, dir := range dirs {
+		readme, err := reader.readFile(structure + "/" + dir + "/" + GitReadmeName)
+		if err != nil {
+			return fmt.Errorf("Unable to read overview: %v", err)
+		}
+		for _, row := range parseOverviewRows(readme) {
+			if structure == GitStructureByJob {
+				g.update(row.fileName, dir, row.lastRun, row.failed)
+			} else {
+				g.update(dir, row.fileName, row.lastRun, row.failed)
+			}
+		}
+	}
+	return nil
+}
+
+type overviewRow struct {
+	fileName string
+	lastRun  time.Time
+	failed   bool
+}
+
+// Rows that can't be parsed are skipped since they will just be rewritten
+func parseOverviewRows(readme []byte) []*overviewRow {
+	rows := []*overviewRow{}
+	for _, line := range strings.Split(string(readme), "\n") {
+		cells := splitOverviewRow(line)
+		if len(cells) != 3 || !strings.HasPrefix(cells[0], "[") {
+			continue
+		}
+		linkStart := strings.LastIndex(cells[0], "](")
+		if linkStart == -1 {
+			continue
+		}
+		lastRun, err := time.Parse(gitOverviewTimeFormat, cells[1])
+		if err != nil {
+			continue
+		}
+		rows = append(rows, &overviewRow{
+			fileName: unescapeOverviewText(cells[0][1:linkStart]),
+			lastRun:  lastRun,
+			failed:   cells[2] != gitOverviewStatusOk,
+		})
+	}
+	return rows
+}
+
+// Splits a markdown table row on unescaped pipes and trims the cells
+func splitOverviewRow(line string) []string {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "|") || !strings.HasSuffix(line, "|") {
+		return nil
+	}
+	cells := []string{}
+	current := []byte{}
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			current = append(current, line[i])
+			if i+1 < len(line) {
+				i++
+				current = append(current, line[i])
+			}
+		case '|':
+			cells = append(cells, strings.TrimSpace(string(current)))
+			current = []byte{}
+		default:
+			current = append(current, line[i])
+		}
+	}
+	return cells
+}
+
+var overviewEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, `[`, `\[`, `]`, `\]`)
+var overviewUnescaper = strings.NewReplacer(`\\`, `\`, `\|`, `|`, `\[`, `[`, `\]`, `]`)
+
+func escapeOverviewText(text string) string {
+	return overviewEscaper.Replace(text)
+}
+
+func unescapeOverviewText(text string) string {
+	return overviewUnescaper.Replace(text)
+}
+
+func overviewLink(relativePath string) string {
+	return (&url.URL{Path: relativePath}).String()
+}
+
+type overviewEntriesByName struct {
+	entries []*gitOverviewEntry
+	names   func(*gitOverviewEntry) (string, string)
+}
+
+func (o overviewEntriesByName) Len() int { return len(o.entries) }
+func (o overviewEntriesByName) Swap(i, j int) {
+	o.entries[i], o.entries[j] = o.entries[j], o.entries[i]
+}
+func (o overviewEntriesByName) Less(i, j int) bool {
+	_, left := o.names(o.entries[i])
+	_, right := o.names(o.entries[j])
+	return left < right
+}
+
+// Queue up a README rewrite unless one is already waiting to be written
+func (g *gitDataStore) queueOverview() {
+	g.writesLock.Lock()
+	defer g.writesLock.Unlock()
+	if len(g.pendingWrites[gitOverviewKey]) > 0 || len(g.waitingOnRunningWrites[gitOverviewKey]) > 0 {
+		return
+	}
+	job := &DataStoreJob{JobTime: time.Now(), overview: true}
+	if _, ok := g.runningWriteIds[gitOverviewKey]; ok {
+		g.waitingOnRunningWrites[gitOverviewKey] = []*DataStoreJob{job}
+	} else {
+		g.pendingWrites[gitOverviewKey] = []*DataStoreJob{job}
+		g.signalPendingWork()
+	}
+}
+
+func (g *gitWorker) commitOverview() error {
+	for relativePath, contents := range g.dataStore.overview.readmes(g.dataStore.conf.Structure) {
+		relativePath = g.dataStore.repoPath(relativePath)
+		if err := g.writeGitFile(relativePath, BytesJobContents(contents)); err != nil {
+			return fmt.Errorf("Unable to write overview to %v: %v", relativePath, err)
+		}
+	}
+	// Nothing to commit if the overviews are already up to date
+	if changed, err := g.hasChanges(); err != nil {
+		return err
+	} else if !changed {
+		if Verbose {
+			log.Printf("README overviews in %v already up to date", g.dir)
+		}
+		return nil
+	}
+	return g.commit(gitOverviewCommitTitle)
+}
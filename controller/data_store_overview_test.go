@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitOverviewReadmes(t *testing.T) {
+	overview := newGitOverview()
+	overview.update("dev1", "job|1", time.Unix(200, 0), false)
+	overview.update("dev1", "job2", time.Unix(300, 0), true)
+	overview.update("dev2", "job2", time.Unix(100, 0), false)
+	// Older results are ignored
+	overview.update("dev1", "job2", time.Unix(250, 0), false)
+	readmes := overview.readmes([]string{GitStructureByDevice, GitStructureByJob})
+	if len(readmes) != 6 {
+		t.Fatalf("Expected 6 readmes, got %v", len(readmes))
+	}
+	expected := "# dev1\n\n" +
+		"| Job | Last Run | Status |\n" +
+		"| --- | --- | --- |\n" +
+		"| [job2](job2) | 1970-01-01 00:05:00 UTC | [Failure](job2.failure) |\n" +
+		"| [job\\|1](job%7C1) | 1970-01-01 00:03:20 UTC | Success |\n"
+	if actual := string(readmes["by_device/dev1/README.md"]); actual != expected {
+		t.Fatalf("Expected device readme:\n%v\nGot:\n%v", expected, actual)
+	}
+	if top := string(readmes["by_job/README.md"]); !strings.Contains(top, "| [job2](job2/README.md) | 2 | 1970-01-01 00:05:00 UTC | 1 |") {
+		t.Fatalf("Unexpected job readme:\n%v", top)
+	}
+
+	// Make sure we can load what we wrote
+	dir, err := ioutil.TempDir("", "fusty-overview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for relativePath, contents := range readmes {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, relativePath)), GitDirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, relativePath), contents, GitFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, structures := range [][]string{{GitStructureByDevice}, {GitStructureByJob}} {
+		loaded := newGitOverview()
+		if err := loaded.load(&gitDirFileReader{dir}, structures); err != nil {
+			t.Fatal(err)
+		}
+		for relativePath, contents := range loaded.readmes([]string{GitStructureByDevice, GitStructureByJob}) {
+			if string(contents) != string(readmes[relativePath]) {
+				t.Fatalf("Loaded from %v, expected %v to be:\n%v\nGot:\n%v",
+					structures, relativePath, string(readmes[relativePath]), string(contents))
+			}
+		}
+	}
+}
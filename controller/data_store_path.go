@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"fmt"
+	"gitlab.com/cretz/fusty/model"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	PathDevice    = "device"
+	PathHost      = "host"
+	PathTag       = "tag"
+	PathJob       = "job"
+	PathExtension = "ext"
+	// Used for the tag when the device has none
+	PathNoTag = "untagged"
+)
+
+var pathPlaceholder = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+
+// dataStoreLayout turns the configured structures in to the paths each device
+// job is written to
+type dataStoreLayout struct {
+	// Nil if there are no device details for paths
+	devices   DeviceStore
+	templates []*pathTemplate
+}
+
+// pathTemplate is a structure as a path with placeholders like
+// "sites/{{tag}}/{{device}}/{{job}}.{{ext}}"
+type pathTemplate struct {
+	template string
+}
+
+// The values available to a path template
+type pathValues map[string]string
+
+// Fails if two device jobs would write to the same path. The data store type
+// is only for errors.
+func newDataStoreLayout(dataStoreType string, structures []string, devices DeviceStore) (*dataStoreLayout, error) {
+	layout := &dataStoreLayout{devices: devices}
+	for _, structure := range structures {
+		template, err := newPathTemplate(dataStoreType, structure)
+		if err != nil {
+			return nil, err
+		}
+		layout.templates = append(layout.templates, template)
+	}
+	if err := layout.validate(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+func newPathTemplate(dataStoreType string, structure string) (*pathTemplate, error) {
+	switch structure {
+	case GitStructureByDevice:
+		return &pathTemplate{GitStructureByDevice + "/{{" + PathDevice + "}}/{{" + PathJob + "}}"}, nil
+	case GitStructureByJob:
+		return &pathTemplate{GitStructureByJob + "/{{" + PathJob + "}}/{{" + PathDevice + "}}"}, nil
+	}
+	if !strings.Contains(structure, "{{") {
+		return nil, fmt.Errorf("Unrecognized %v structure: %v", dataStoreType, structure)
+	}
+	if strings.Contains(structure, "\\") {
+		return nil, fmt.Errorf("Structure %v cannot contain backslashes", structure)
+	}
+	for _, piece := range strings.Split(strings.Trim(structure, "/"), "/") {
+		if piece == "" || piece == "." || piece == ".." || piece == ".git" {
+			return nil, fmt.Errorf("Structure %v has invalid path piece: %q", structure, piece)
+		}
+	}
+	for _, match := range pathPlaceholder.FindAllStringSubmatch(structure, -1) {
+		switch match[1] {
+		case PathDevice, PathHost, PathTag, PathJob, PathExtension:
+		default:
+			return nil, fmt.Errorf("Unrecognized placeholder %v in structure %v", match[0], structure)
+		}
+	}
+	if rest := pathPlaceholder.ReplaceAllString(structure, ""); strings.Contains(rest, "{{") ||
+		strings.Contains(rest, "}}") {
+		return nil, fmt.Errorf("Unclosed placeholder in structure %v", structure)
+	}
+	return &pathTemplate{strings.Trim(structure, "/")}, nil
+}
+
+// Values are sanitized so they can never add or escape a directory
+func (p *pathTemplate) path(values pathValues) string {
+	return pathPlaceholder.ReplaceAllStringFunc(p.template, func(placeholder string) string {
+		return sanitizePathSegment(values[placeholder[2:len(placeholder)-2]])
+	})
+}
+
+func newPathValues(deviceName string, jobName string, device *model.Device) pathValues {
+	values := pathValues{
+		PathDevice:    deviceName,
+		PathHost:      deviceName,
+		PathTag:       PathNoTag,
+		PathJob:       jobName,
+		PathExtension: model.DefaultJobFileExtension,
+	}
+	// The device may have been removed since the job ran
+	if device != nil {
+		values[PathHost] = device.Host
+		if len(device.Tags) > 0 {
+			values[PathTag] = device.Tags[0]
+		}
+		if job := device.Jobs[jobName]; job != nil {
+			values[PathExtension] = job.Extension()
+		}
+	}
+	return values
+}
+
+// Replaces anything that would make the name more or less than a single path
+// piece
+func sanitizePathSegment(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	switch name {
+	case "", ".", "..":
+		return strings.Repeat("_", len(name)+1)
+	case ".git":
+		return "_git"
+	}
+	return name
+}
+
+// The paths, one per structure, that the device job is written to
+func (d *dataStoreLayout) paths(deviceName string, jobName string) []string {
+	var device *model.Device
+	if d.devices != nil {
+		device = d.devices.AllDevices()[deviceName]
+	}
+	values := newPathValues(deviceName, jobName, device)
+	paths := make([]string, len(d.templates))
+	for index, template := range d.templates {
+		paths[index] = template.path(values)
+	}
+	return paths
+}
+
+// Makes sure no two device jobs write the same path and that no path is
+// written where another needs a directory. Failures are written next to each
+// path with the failure suffix.
+func (d *dataStoreLayout) validate() error {
+	if d.devices == nil {
+		return nil
+	}
+	devices := d.devices.AllDevices()
+	deviceNames := make([]string, 0, len(devices))
+	for name := range devices {
+		deviceNames = append(deviceNames, name)
+	}
+	sort.Strings(deviceNames)
+	// Owners by path
+	files := map[string]string{}
+	dirs := map[string]string{}
+	for _, deviceName := range deviceNames {
+		jobNames := make([]string, 0, len(devices[deviceName].Jobs))
+		for name := range devices[deviceName].Jobs {
+			jobNames = append(jobNames, name)
+		}
+		sort.Strings(jobNames)
+		for _, jobName := range jobNames {
+			owner := fmt.Sprintf("job %v on device %v", jobName, deviceName)
+			for _, path := range d.paths(deviceName, jobName) {
+				for _, file := range []string{path, path + GitFailureSuffix} {
+					if other, ok := files[file]; ok && other != owner {
+						return fmt.Errorf("Path %v is written by both %v and %v", file, other, owner)
+					} else if other, ok := dirs[file]; ok {
+						return fmt.Errorf("Path %v is a file for %v but a directory for %v", file, owner, other)
+					}
+					files[file] = owner
+				}
+				for dir := parentPath(path); dir != ""; dir = parentPath(dir) {
+					if other, ok := files[dir]; ok {
+						return fmt.Errorf("Path %v is a file for %v but a directory for %v", dir, other, owner)
+					}
+					dirs[dir] = owner
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func parentPath(path string) string {
+	if slash := strings.LastIndex(path, "/"); slash >= 0 {
+		return path[:slash]
+	}
+	return ""
+}
@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultS3Region         = "us-east-1"
+	DefaultS3TimeoutSeconds = 60
+	// Uploads run in the background with this many at once
+	S3UploadConcurrency = 10
+	// Attempts for each object before the result is dropped as failed
+	S3PutAttempts = 3
+	// Prefixed with x-amz-meta- on each object
+	S3MetaDevice    = "fusty-device"
+	S3MetaJob       = "fusty-job"
+	S3MetaJobTime   = "fusty-job-time"
+	S3MetaStartTime = "fusty-start-time"
+	S3MetaEndTime   = "fusty-end-time"
+)
+
+// s3DataStore writes each result as an object at every structure path in an S3
+// compatible bucket. History is kept by the bucket's object versioning.
+type s3DataStore struct {
+	conf        *config.DataStoreS3
+	layout      *dataStoreLayout
+	credentials *s3Credentials
+	endpoint    *url.URL
+	client      *http.Client
+	// Holds a value for every upload running
+	uploads chan bool
+}
+
+func newS3DataStore(conf *config.DataStoreS3, devices DeviceStore) (*s3DataStore, error) {
+	if conf.Bucket == "" {
+		return nil, errors.New("Data store for s3 requires bucket")
+	}
+	if len(conf.Structure) == 0 {
+		conf.Structure = []string{GitStructureByDevice}
+	}
+	layout, err := newDataStoreLayout("s3", conf.Structure, devices)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := newS3Credentials(conf)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + credentials.region + ".amazonaws.com"
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || endpointUrl.Host == "" || (endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid S3 endpoint: %v", endpoint)
+	}
+	if conf.TimeoutSeconds == 0 {
+		conf.TimeoutSeconds = DefaultS3TimeoutSeconds
+	}
+	s := &s3DataStore{
+		conf:        conf,
+		layout:      layout,
+		credentials: credentials,
+		endpoint:    endpointUrl,
+		client:      &http.Client{Timeout: time.Duration(conf.TimeoutSeconds) * time.Second},
+		uploads:     make(chan bool, S3UploadConcurrency),
+	}
+	// Without versioning, each write replaces the last so we only warn
+	if versioned, err := s.versioningEnabled(); err != nil {
+		log.Printf("Unable to check versioning of S3 bucket %v: %v", conf.Bucket, err)
+	} else if !versioned {
+		log.Printf("Versioning is not enabled on S3 bucket %v, only the latest result of each job will be kept",
+			conf.Bucket)
+	}
+	return s, nil
+}
+
+// Values in config are used over the ones in the environment
+func newS3Credentials(conf *config.DataStoreS3) (*s3Credentials, error) {
+	credentials := &s3Credentials{
+		accessKey:    conf.AccessKey,
+		secretKey:    conf.SecretKey,
+		sessionToken: conf.SessionToken,
+		region:       conf.Region,
+	}
+	if credentials.accessKey == "" && credentials.secretKey == "" {
+		credentials.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		credentials.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if credentials.sessionToken == "" {
+			credentials.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+	}
+	if credentials.accessKey == "" || credentials.secretKey == "" {
+		return nil, errors.New("S3 access key and secret key required in config or environment")
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if credentials.region == "" {
+			credentials.region = os.Getenv(env)
+		}
+	}
+	if credentials.region == "" {
+		credentials.region = DefaultS3Region
+	}
+	return credentials, nil
+}
+
+// Uploads happen in the background so the worker is not held up by S3. This
+// blocks while every upload slot is taken so jobs wait in the data store queue
+// where they are counted instead of piling up here.
+func (s *s3DataStore) Store(job *DataStoreJob) {
+	if Verbose {
+		log.Printf("Storing job %v on %v at expected time of %v in S3 bucket %v",
+			job.JobName, job.DeviceName, job.JobTime, s.conf.Bucket)
+	}
+	s.uploads <- true
+	go func() {
+		defer func() { <-s.uploads }()
+		var firstErr error
+		for _, path := range s.layout.paths(job.DeviceName, job.JobName) {
+			if err := s.storeObject(s.objectKey(path), job); err != nil {
+				log.Printf("Failed to store job %v for device %v in S3 at %v: %v",
+					job.JobName, job.DeviceName, path, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		job.finished(firstErr)
+	}()
+}
+
+// Nothing is spooled since a result that fails every attempt is dropped after
+// it is logged and reported as failed. Jobs waiting on an upload slot are in the
+// data store queue.
+func (s *s3DataStore) Status() *DataStoreStatus {
+	return &DataStoreStatus{}
+}
+
+func (s *s3DataStore) objectKey(path string) string {
+	if prefix := strings.Trim(s.conf.Prefix, "/"); prefix != "" {
+		return prefix + "/" + path
+	}
+	return path
+}
+
+func (s *s3DataStore) storeObject(key string, job *DataStoreJob) error {
+	contents, contentType := job.Contents, "application/octet-stream"
+	if job.Failure != "" {
+		key += GitFailureSuffix
+		contents, contentType = job.failureContents(), "text/plain; charset=utf-8"
+	} else if !job.hasContents() {
+		return nil
+	}
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	// Names can be anything so they are escaped to stay valid header values
+	header.Set("X-Amz-Meta-"+S3MetaDevice, s3EscapePath(job.DeviceName))
+	header.Set("X-Amz-Meta-"+S3MetaJob, s3EscapePath(job.JobName))
+	header.Set("X-Amz-Meta-"+S3MetaJobTime, job.JobTime.UTC().Format(time.RFC3339))
+	header.Set("X-Amz-Meta-"+S3MetaStartTime, job.StartTime.UTC().Format(time.RFC3339))
+	header.Set("X-Amz-Meta-"+S3MetaEndTime, job.EndTime.UTC().Format(time.RFC3339))
+	var err error
+	for attempt := 1; attempt <= S3PutAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		var respHeader http.Header
+		if respHeader, _, err = s.do("PUT", s.objectUrl(key, ""), header, contents); err != nil {
+			continue
+		}
+		if Verbose && respHeader.Get("X-Amz-Version-Id") != "" {
+			log.Printf("Stored S3 object %v as version %v", key, respHeader.Get("X-Amz-Version-Id"))
+		}
+		return nil
+	}
+	return err
+}
+
+func (s *s3DataStore) versioningEnabled() (bool, error) {
+	_, body, err := s.do("GET", s.objectUrl("", "versioning"), http.Header{}, BytesJobContents{})
+	if err != nil {
+		return false, err
+	}
+	versioning := &struct {
+		Status string `xml:"Status"`
+	}{}
+	if err := xml.Unmarshal(body, versioning); err != nil {
+		return false, fmt.Errorf("Invalid versioning response: %v", err)
+	}
+	return versioning.Status == "Enabled", nil
+}
+
+// The bucket is in the path or the host depending on the path style setting
+func (s *s3DataStore) objectUrl(key string, query string) *url.URL {
+	objectUrl := *s.endpoint
+	path := "/" + key
+	if s.conf.PathStyle {
+		path = "/" + s.conf.Bucket + path
+	} else {
+		objectUrl.Host = s.conf.Bucket + "." + objectUrl.Host
+	}
+	objectUrl.Path = strings.TrimSuffix(objectUrl.Path, "/") + path
+	objectUrl.RawPath = s3EscapePath(objectUrl.Path)
+	objectUrl.RawQuery = query
+	return &objectUrl
+}
+
+// Anything but a 2xx status is an error. The body is read once to sign it and
+// again to send it.
+func (s *s3DataStore) do(method string, requestUrl *url.URL, header http.Header,
+	body JobContents) (http.Header, []byte, error) {
+	payloadHash, err := jobContentsSha256(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := body.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	req, err := http.NewRequest(method, requestUrl.String(), reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = body.Size()
+	if req.ContentLength == 0 {
+		req.Body = nil
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.credentials.sign(req, hex.EncodeToString(payloadHash), time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, fmt.Errorf("S3 returned %v: %v", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return resp.Header, respBody, nil
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3SignAlgorithm  = "AWS4-HMAC-SHA256"
+	s3SignService    = "s3"
+	s3SignDateFormat = "20060102T150405Z"
+)
+
+// s3Credentials sign requests with AWS signature version 4. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+}
+
+// Adds the auth headers to the request. Every header already set on the
+// request is signed along with the host.
+func (s *s3Credentials) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.UTC().Format(s3SignDateFormat)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for index, value := range values {
+			trimmed[index] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date[:8] + "/" + s.region + "/" + s3SignService + "/aws4_request"
+	stringToSign := s3SignAlgorithm + "\n" + date + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSha256([]byte("AWS4"+s.secretKey), date[:8])
+	for _, piece := range []string{s.region, s3SignService, "aws4_request"} {
+		key = hmacSha256(key, piece)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%x",
+		s3SignAlgorithm, s.accessKey, scope, signedHeaders, hmacSha256(key, stringToSign)))
+}
+
+// Escapes everything except unreserved characters and slashes. The request
+// must be sent with this same escaping which is why it is also used as the raw
+// path.
+func s3EscapePath(path string) string {
+	escaped := &bytes.Buffer{}
+	for _, b := range []byte(path) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3EscapePath(name)+"="+strings.Replace(s3EscapePath(value), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
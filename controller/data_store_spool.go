@@ -0,0 +1,339 @@
+package controller
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GitSpoolDirName = "spool"
+	// Doubled after every failed retry up to the max
+	DefaultGitPushRetrySeconds    = 5
+	DefaultGitPushRetryMaxSeconds = 600
+	gitSpoolFileSuffix            = ".json"
+	gitSpoolContentsSuffix        = ".contents"
+)
+
+// Reported for results that failed to push, they are reported again once a
+// retry pushes them
+var errGitPushSpooled = errors.New("Git push failed, result spooled for retry")
+
+// DataStoreStatus is what the data store reports about writes that have not
+// made it to the remote yet
+type DataStoreStatus struct {
+	// Number of job results waiting to be retried
+	SpoolDepth int `json:"spool_depth"`
+	// Unix timestamp of when the oldest spooled result first failed, 0 if none
+	OldestSpooled int64 `json:"oldest_spooled,omitempty"`
+	// Unix timestamp of the next retry, 0 if none
+	NextRetry int64 `json:"next_retry,omitempty"`
+	// Number of job results not yet handed to the data store
+	QueueDepth int `json:"queue_depth"`
+	// Each data store by name when there is more than one source of status
+	DataStores map[string]*DataStoreStatus `json:"data_stores,omitempty"`
+}
+
+// gitSpool holds job results that failed to push. Each is kept in memory and
+// in its own file in the spool directory so they survive a restart.
+type gitSpool struct {
+	dir  string
+	lock *sync.Mutex
+	// By job ID
+	jobs           map[string]*spooledJob
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// Consecutive failures since the last successful push
+	failures int
+	// Zero if no retry is scheduled
+	nextRetry time.Time
+	// Whether a README overview failed to push and needs to be written again
+	overviewFailed bool
+}
+
+type spooledJob struct {
+	DeviceName string    `json:"device"`
+	JobName    string    `json:"job"`
+	JobTime    time.Time `json:"job_time"`
+	StartTime  time.Time `json:"start_time"`
+	EndTime    time.Time `json:"end_time"`
+	Failure    string    `json:"failure,omitempty"`
+	// The contents are in their own file next to this one
+	HasContents bool `json:"has_contents,omitempty"`
+	// Empty to use the data store's commit policy
+	CommitPolicy string `json:"commit_policy,omitempty"`
+	// When this first failed to push
+	Spooled  time.Time `json:"spooled"`
+	contents JobContents
+	// Only kept in memory, so results spooled before a restart aren't reported
+	stored func(err error)
+}
+
+func newGitSpool(dir string, initialBackoff time.Duration, maxBackoff time.Duration) (*gitSpool, error) {
+	spool := &gitSpool{
+		dir:            dir,
+		lock:           &sync.Mutex{},
+		jobs:           make(map[string]*spooledJob),
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+	}
+	if err := os.MkdirAll(dir, GitDirPerm); err != nil {
+		return nil, fmt.Errorf("Unable to create git spool directory %v: %v", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read git spool directory %v: %v", dir, err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), gitSpoolFileSuffix) {
+			continue
+		}
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read spooled job %v: %v", file.Name(), err)
+		}
+		spooled := &spooledJob{}
+		if err := json.Unmarshal(bytes, spooled); err != nil {
+			// Leave it there for someone to look at, but don't let it stop us
+			log.Printf("Ignoring invalid spooled job %v: %v", file.Name(), err)
+			continue
+		}
+		id := spooled.job().id()
+		if spooled.HasContents {
+			contentsPath := spool.contentsPath(id)
+			if info, err := os.Stat(contentsPath); err != nil {
+				log.Printf("Ignoring spooled job %v without contents: %v", file.Name(), err)
+				continue
+			} else {
+				spooled.contents = &fileJobContents{path: contentsPath, size: info.Size()}
+			}
+		}
+		spool.jobs[id] = spooled
+	}
+	return spool, nil
+}
+
+func (s *spooledJob) job() *DataStoreJob {
+	return &DataStoreJob{
+		DeviceName:   s.DeviceName,
+		JobName:      s.JobName,
+		JobTime:      s.JobTime,
+		StartTime:    s.StartTime,
+		EndTime:      s.EndTime,
+		Failure:      s.Failure,
+		Contents:     s.contents,
+		CommitPolicy: s.CommitPolicy,
+		stored:       s.stored,
+	}
+}
+
+// Job IDs can have any characters, so the file is named after a hash of it
+func (g *gitSpool) path(id string) string {
+	hash := sha1.Sum([]byte(id))
+	return filepath.Join(g.dir, hex.EncodeToString(hash[:])+gitSpoolFileSuffix)
+}
+
+func (g *gitSpool) contentsPath(id string) string {
+	return strings.TrimSuffix(g.path(id), gitSpoolFileSuffix) + gitSpoolContentsSuffix
+}
+
+// Adds the jobs that failed to push and returns how long until they should be
+// retried. Returns 0 if a retry is already scheduled.
+func (g *gitSpool) failed(jobs []*DataStoreJob) time.Duration {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	for _, job := range jobs {
+		if job.overview {
+			g.overviewFailed = true
+			continue
+		}
+		id := job.id()
+		// Retried jobs keep the time they first failed
+		if _, ok := g.jobs[id]; ok {
+			continue
+		}
+		spooled := &spooledJob{
+			DeviceName:   job.DeviceName,
+			JobName:      job.JobName,
+			JobTime:      job.JobTime,
+			StartTime:    job.StartTime,
+			EndTime:      job.EndTime,
+			Failure:      job.Failure,
+			CommitPolicy: job.CommitPolicy,
+			Spooled:      now,
+			contents:     job.Contents,
+			stored:       job.stored,
+		}
+		g.jobs[id] = spooled
+		// It's still in memory, so we can go on even if it's not on disk, but the
+		// contents may not last if they can't be copied
+		if err := g.write(id, spooled); err != nil {
+			log.Printf("Unable to spool job %v for device %v to disk: %v", job.JobName, job.DeviceName, err)
+		}
+	}
+	if !g.nextRetry.IsZero() {
+		return 0
+	}
+	backoff := g.initialBackoff
+	for i := 0; i < g.failures && backoff < g.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > g.maxBackoff {
+		backoff = g.maxBackoff
+	}
+	g.failures++
+	g.nextRetry = now.Add(backoff)
+	return backoff
+}
+
+// The contents are copied first since the job's contents are removed once
+// every data store is done with them
+func (g *gitSpool) write(id string, spooled *spooledJob) error {
+	if spooled.contents != nil {
+		contents, err := copyJobContents(spooled.contents, g.contentsPath(id))
+		if err != nil {
+			return err
+		}
+		spooled.contents, spooled.HasContents = contents, true
+	}
+	bytes, err := json.Marshal(spooled)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file and rename so we never leave a partial file
+	path := g.path(id)
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, bytes, GitFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Removes the pushed jobs and any older spooled results for the same device
+// job since pushing those now would overwrite newer results
+func (g *gitSpool) pushed(jobs []*DataStoreJob) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.failures = 0
+	for _, job := range jobs {
+		if job.overview {
+			g.overviewFailed = false
+			continue
+		}
+		for id, spooled := range g.jobs {
+			if spooled.DeviceName == job.DeviceName && spooled.JobName == job.JobName &&
+				!spooled.JobTime.After(job.JobTime) {
+				g.remove(id)
+			}
+		}
+	}
+}
+
+func (g *gitSpool) remove(id string) {
+	delete(g.jobs, id)
+	for _, path := range []string{g.path(id), g.contentsPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove spooled job file: %v", err)
+		}
+	}
+}
+
+// Returns every spooled job oldest first and whether the README overviews need
+// to be written again. This clears the scheduled retry.
+func (g *gitSpool) retry() ([]*DataStoreJob, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.nextRetry = time.Time{}
+	jobs := make([]*DataStoreJob, 0, len(g.jobs))
+	for _, spooled := range g.jobs {
+		jobs = append(jobs, spooled.job())
+	}
+	sort.Sort(dataStoreJobsByTime(jobs))
+	return jobs, g.overviewFailed
+}
+
+func (g *gitSpool) status() *DataStoreStatus {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	status := &DataStoreStatus{SpoolDepth: len(g.jobs)}
+	for _, spooled := range g.jobs {
+		if status.OldestSpooled == 0 || spooled.Spooled.Unix() < status.OldestSpooled {
+			status.OldestSpooled = spooled.Spooled.Unix()
+		}
+	}
+	if !g.nextRetry.IsZero() {
+		status.NextRetry = g.nextRetry.Unix()
+	}
+	return status
+}
+
+type dataStoreJobsByTime []*DataStoreJob
+
+func (d dataStoreJobsByTime) Len() int           { return len(d) }
+func (d dataStoreJobsByTime) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dataStoreJobsByTime) Less(i, j int) bool { return d[i].JobTime.Before(d[j].JobTime) }
+
+// Spools the jobs and schedules a retry if one isn't already
+func (g *gitDataStore) jobsFailed(jobs []*DataStoreJob) {
+	backoff := g.spool.failed(jobs)
+	// Only after they are spooled since the contents may be removed after this
+	for _, job := range jobs {
+		job.finished(errGitPushSpooled)
+	}
+	if backoff > 0 {
+		log.Printf("Git push failed, %v results spooled, retrying in %v", g.spool.status().SpoolDepth, backoff)
+		time.AfterFunc(backoff, g.retrySpooled)
+	}
+}
+
+// Queues every spooled job that isn't already queued
+func (g *gitDataStore) retrySpooled() {
+	jobs, overview := g.spool.retry()
+	if Verbose {
+		log.Printf("Retrying %v spooled git writes", len(jobs))
+	}
+	g.writesLock.Lock()
+	for _, job := range jobs {
+		if !g.queued(job) {
+			g.enqueue(job)
+		}
+	}
+	g.writesLock.Unlock()
+	if overview && g.overview != nil {
+		g.queueOverview()
+	}
+}
+
+// Expects the writes lock to be held
+func (g *gitDataStore) queued(job *DataStoreJob) bool {
+	key, id := job.key(), job.id()
+	if g.runningWriteIds[key][id] {
+		return true
+	}
+	for _, queued := range g.pendingWrites[key] {
+		if queued.id() == id {
+			return true
+		}
+	}
+	for _, queued := range g.waitingOnRunningWrites[key] {
+		if queued.id() == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *gitDataStore) Status() *DataStoreStatus {
+	return g.spool.status()
+}
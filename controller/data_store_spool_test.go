@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGitSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := newGitSpool(dir, time.Second, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := []*DataStoreJob{
+		{DeviceName: "dev", JobName: "job", JobTime: time.Unix(200, 0), Contents: BytesJobContents("new")},
+		{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0), Failure: "timeout"},
+		{DeviceName: "dev", JobName: "other", JobTime: time.Unix(100, 0), Contents: BytesJobContents("other")},
+		{JobTime: time.Unix(300, 0), overview: true},
+	}
+	if backoff := spool.failed(jobs); backoff != time.Second {
+		t.Fatalf("Expected first backoff of 1s, got %v", backoff)
+	}
+	// Already scheduled
+	if backoff := spool.failed(jobs[:1]); backoff != 0 {
+		t.Fatalf("Expected no backoff while retry scheduled, got %v", backoff)
+	}
+	if status := spool.status(); status.SpoolDepth != 3 || status.OldestSpooled == 0 || status.NextRetry == 0 {
+		t.Fatalf("Unexpected status: %v", status)
+	}
+	// Backoff doubles until the max
+	for _, expected := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		spool.retry()
+		if backoff := spool.failed(nil); backoff != expected {
+			t.Fatalf("Expected backoff of %v, got %v", expected, backoff)
+		}
+	}
+
+	// A new spool picks up what is on disk, oldest first
+	reloaded, err := newGitSpool(dir, time.Second, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, overview := reloaded.retry()
+	if len(retried) != 3 || retried[0].JobTime.Unix() != 100 || retried[2].JobTime.Unix() != 200 || overview {
+		t.Fatalf("Unexpected reloaded jobs: %v, overview %v", retried, overview)
+	}
+	if contents := readJobContents(t, retried[2].Contents); contents != "new" {
+		t.Fatalf("Unexpected contents: %v", contents)
+	}
+
+	// Pushing the newer result also drops the older one
+	reloaded.pushed(jobs[:1])
+	if retried, _ := reloaded.retry(); len(retried) != 1 || retried[0].JobName != "other" {
+		t.Fatalf("Unexpected jobs after push: %v", retried)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		// The job and its contents
+		t.Fatalf("Expected 2 spool files, got %v", len(files))
+	}
+}
+
+type failingGitWriter struct {
+	lock     *sync.Mutex
+	failures int
+	// Contents are read on push like a real writer since the spool removes
+	// its copy after
+	pushed []string
+}
+
+func (f *failingGitWriter) pushJobs(jobs []*DataStoreJob) (map[*DataStoreJob]error, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return nil, false
+	}
+	for _, job := range jobs {
+		reader, err := job.Contents.Open()
+		if err != nil {
+			return nil, false
+		}
+		byts, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, false
+		}
+		f.pushed = append(f.pushed, string(byts))
+	}
+	return nil, true
+}
+
+func TestGitDataStoreRetriesSpooled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := newGitSpool(dir, 10*time.Millisecond, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore := &gitDataStore{
+		writesLock:             &sync.Mutex{},
+		pendingWrites:          make(map[string][]*DataStoreJob),
+		pendingWorkChan:        make(chan bool, 1),
+		runningWriteIds:        make(map[string]map[string]bool),
+		waitingOnRunningWrites: make(map[string][]*DataStoreJob),
+		spool:                  spool,
+	}
+	writer := &failingGitWriter{lock: &sync.Mutex{}, failures: 3}
+	go dataStore.runWriter(writer)
+	dataStore.Store(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(100, 0), Contents: BytesJobContents("config")})
+	for i := 0; i < 50; i++ {
+		writer.lock.Lock()
+		pushed := writer.pushed
+		writer.lock.Unlock()
+		// The spool is cleared just after the push
+		if len(pushed) > 0 && dataStore.Status().SpoolDepth == 0 {
+			if len(pushed) != 1 || pushed[0] != "config" {
+				t.Fatalf("Unexpected pushed jobs: %v", pushed)
+			}
+			if status := dataStore.Status(); status.NextRetry != 0 {
+				t.Fatalf("Expected no retry, got: %v", status)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for spooled job to be pushed")
+}
+
+func readJobContents(t *testing.T, contents JobContents) string {
+	reader, err := contents.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	byts, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(byts)
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"gitlab.com/cretz/fusty/model"
+	"strings"
+	"testing"
+)
+
+func TestCleanGitDirectory(t *testing.T) {
+	tests := []struct {
+		directory string
+		expected  string
+		err       bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"/network-backups", "network-backups", false},
+		{"network-backups/", "network-backups", false},
+		{"/network/./backups//", "network/backups", false},
+		{"../backups", "", true},
+		{"/network/../../backups", "", true},
+		{"/network/..", "", true},
+		{".git/backups", "", true},
+		{"network\\..\\backups", "", true},
+	}
+	for _, test := range tests {
+		actual, err := cleanGitDirectory(test.directory)
+		if test.err != (err != nil) {
+			t.Fatalf("For %v, unexpected error result: %v", test.directory, err)
+		} else if actual != test.expected {
+			t.Fatalf("For %v, expected %v, got %v", test.directory, test.expected, actual)
+		}
+	}
+}
+
+func TestIsGitSshUrl(t *testing.T) {
+	tests := map[string]bool{
+		"ssh://git@myserver.local/my/repository.git": true,
+		"git+ssh://myserver.local/repository.git":    true,
+		"git@myserver.local:my/repository.git":       true,
+		"myserver.local:repository.git":              true,
+		"http://myserver.local/my/repository.git":    false,
+		"file:///tmp/repository.git":                 false,
+		"/tmp/repository.git":                        false,
+		"./dir:with/colon":                           false,
+		"C:\\repository.git":                         false,
+	}
+	for url, expected := range tests {
+		if actual := isGitSshUrl(url); actual != expected {
+			t.Fatalf("For %v, expected %v, got %v", url, expected, actual)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if actual := shellQuote("/path/with space/it's"); actual != `'/path/with space/it'\''s'` {
+		t.Fatalf("Unexpected quoting: %v", actual)
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	device := model.NewDefaultDevice("dev/1")
+	device.Host = "10.0.0.1"
+	device.Tags = []string{"dallas", "dmz"}
+	job := model.NewDefaultJob("show run")
+	job.FileExtension = "cfg"
+	device.Jobs = map[string]*model.Job{"show run": job}
+	tests := []struct {
+		structure string
+		device    *model.Device
+		expected  string
+		err       string
+	}{
+		{GitStructureByDevice, device, "by_device/dev_1/show run", ""},
+		{GitStructureByJob, device, "by_job/show run/dev_1", ""},
+		{"/sites/{{tag}}/{{device}}/{{job}}.{{ext}}", device, "sites/dallas/dev_1/show run.cfg", ""},
+		{"{{host}}-{{job}}", device, "10.0.0.1-show run", ""},
+		// Removed devices still have names
+		{"{{tag}}/{{host}}/{{job}}.{{ext}}", nil, "untagged/dev_1/show run.txt", ""},
+		{"unknown", nil, "", "Unrecognized git structure"},
+		{"{{site}}/{{job}}", nil, "", "Unrecognized placeholder {{site}}"},
+		{"{{device}}/{{job}", nil, "", "Unclosed placeholder"},
+		{"../{{device}}", nil, "", "invalid path piece"},
+		{".git/{{device}}", nil, "", "invalid path piece"},
+		{"{{device}}\\{{job}}", nil, "", "backslashes"},
+	}
+	for _, test := range tests {
+		template, err := newPathTemplate("git", test.structure)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("For %v, expected error %v, got %v", test.structure, test.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("For %v, unexpected error: %v", test.structure, err)
+		}
+		if actual := template.path(newPathValues("dev/1", "show run", test.device)); actual != test.expected {
+			t.Fatalf("For %v, expected %v, got %v", test.structure, test.expected, actual)
+		}
+	}
+}
+
+func TestSanitizePathSegment(t *testing.T) {
+	tests := map[string]string{
+		"router1.local": "router1.local",
+		"a/b\\c":        "a_b_c",
+		" tab\tname ":   "tab_name",
+		"":              "_",
+		".":             "__",
+		"..":            "___",
+		".git":          "_git",
+	}
+	for name, expected := range tests {
+		if actual := sanitizePathSegment(name); actual != expected {
+			t.Fatalf("For %q, expected %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+type staticDeviceStore map[string]*model.Device
+
+func (s staticDeviceStore) AllDevices() map[string]*model.Device {
+	return s
+}
+
+func TestDataStoreLayout(t *testing.T) {
+	devices := staticDeviceStore{}
+	for _, name := range []string{"dev1", "dev2"} {
+		device := model.NewDefaultDevice(name)
+		device.Tags = []string{"dallas"}
+		device.Jobs = map[string]*model.Job{"job1": model.NewDefaultJob("job1"), "job2": model.NewDefaultJob("job2")}
+		devices[name] = device
+	}
+	tests := []struct {
+		structure []string
+		err       string
+	}{
+		{[]string{GitStructureByDevice, GitStructureByJob}, ""},
+		{[]string{"{{tag}}/{{device}}/{{job}}.{{ext}}"}, ""},
+		{[]string{"{{tag}}/{{job}}"}, "Path dallas/job1 is written by both job job1 on device dev1 and job job1 on device dev2"},
+		{[]string{"{{device}}", "{{device}}/{{job}}"}, "Path dev1 is a file for job job1 on device dev1 but a directory"},
+	}
+	for _, test := range tests {
+		_, err := newDataStoreLayout("git", test.structure, devices)
+		if test.err == "" && err != nil {
+			t.Fatalf("For %v, unexpected error: %v", test.structure, err)
+		} else if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+			t.Fatalf("For %v, expected error %v, got %v", test.structure, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/cretz/fusty/model"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHistorySize = 20
+	// Kept next to the scheduler state file
+	HistoryFileName  = "history.json"
+	historyFlushTime = time.Second
+	// The failure of data store outcomes still pending when the history is loaded
+	historyRestartFailure = "Controller restarted before the data store finished"
+	// The states of a job outcome in a data store
+	DataStoreOutcomePending = "pending"
+	DataStoreOutcomeStored  = "stored"
+	DataStoreOutcomeFailed  = "failed"
+)
+
+// History keeps the most recent outcomes of every job on every device
+type History interface {
+	Record(job *DataStoreJob)
+	// Sets how the recorded job did in the named data store. Does nothing if
+	// the job is not in the history.
+	RecordDataStore(job *DataStoreJob, dataStoreName string, outcome *DataStoreOutcome)
+	// Nil if nothing has been recorded
+	DeviceJobHistory(deviceName string, jobName string) *DeviceJobHistory
+}
+
+type DeviceJobHistory struct {
+	DeviceName  string `json:"device"`
+	JobName     string `json:"job"`
+	LastSuccess int64  `json:"last_success,omitempty"`
+	LastFailure int64  `json:"last_failure,omitempty"`
+	// Newest first
+	Outcomes []*JobOutcome `json:"outcomes"`
+}
+
+type JobOutcome struct {
+	JobTimestamp   int64  `json:"job_timestamp"`
+	StartTimestamp int64  `json:"start_timestamp"`
+	EndTimestamp   int64  `json:"end_timestamp"`
+	Failure        string `json:"failure,omitempty"`
+	// Oldest first, including the last one
+	Attempts []*model.ExecutionAttempt `json:"attempts,omitempty"`
+	// Keyed by data store name
+	DataStores map[string]*DataStoreOutcome `json:"data_stores,omitempty"`
+}
+
+type DataStoreOutcome struct {
+	Status  string `json:"status"`
+	Failure string `json:"failure,omitempty"`
+}
+
+type localHistory struct {
+	size        int
+	historyLock *sync.Mutex
+	// Keyed by job key
+	history map[string]*DeviceJobHistory
+}
+
+func newLocalHistory(size int) *localHistory {
+	return &localHistory{
+		size:        size,
+		historyLock: &sync.Mutex{},
+		history:     make(map[string]*DeviceJobHistory),
+	}
+}
+
+func (l *localHistory) Record(job *DataStoreJob) {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	key := job.key()
+	existing, ok := l.history[key]
+	if !ok {
+		existing = &DeviceJobHistory{DeviceName: job.DeviceName, JobName: job.JobName}
+		l.history[key] = existing
+	}
+	outcome := &JobOutcome{
+		JobTimestamp:   job.JobTime.Unix(),
+		StartTimestamp: job.StartTime.Unix(),
+		EndTimestamp:   job.EndTime.Unix(),
+		Failure:        job.Failure,
+		Attempts:       job.Attempts,
+	}
+	if job.Failure == "" && outcome.JobTimestamp > existing.LastSuccess {
+		existing.LastSuccess = outcome.JobTimestamp
+	} else if job.Failure != "" && outcome.JobTimestamp > existing.LastFailure {
+		existing.LastFailure = outcome.JobTimestamp
+	}
+	existing.Outcomes = append([]*JobOutcome{outcome}, existing.Outcomes...)
+	if len(existing.Outcomes) > l.size {
+		existing.Outcomes = existing.Outcomes[:l.size]
+	}
+}
+
+func (l *localHistory) RecordDataStore(job *DataStoreJob, dataStoreName string, outcome *DataStoreOutcome) {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	existing, ok := l.history[job.key()]
+	if !ok {
+		return
+	}
+	for _, jobOutcome := range existing.Outcomes {
+		if jobOutcome.JobTimestamp == job.JobTime.Unix() {
+			if jobOutcome.DataStores == nil {
+				jobOutcome.DataStores = make(map[string]*DataStoreOutcome)
+			}
+			jobOutcome.DataStores[dataStoreName] = outcome
+			return
+		}
+	}
+}
+
+func (l *localHistory) DeviceJobHistory(deviceName string, jobName string) *DeviceJobHistory {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	history, ok := l.history[(&DataStoreJob{DeviceName: deviceName, JobName: jobName}).key()]
+	if !ok {
+		return nil
+	}
+	copied := *history
+	// Outcomes are updated as data stores finish, so they are copied too
+	copied.Outcomes = make([]*JobOutcome, len(history.Outcomes))
+	for index, outcome := range history.Outcomes {
+		copiedOutcome := *outcome
+		if outcome.DataStores != nil {
+			copiedOutcome.DataStores = make(map[string]*DataStoreOutcome, len(outcome.DataStores))
+			for name, dataStoreOutcome := range outcome.DataStores {
+				copiedOutcome.DataStores[name] = dataStoreOutcome
+			}
+		}
+		copied.Outcomes[index] = &copiedOutcome
+	}
+	return &copied
+}
+
+// fileHistory keeps the history in memory and flushes it to a JSON file in the
+// background when it changes so it survives a restart
+type fileHistory struct {
+	*localHistory
+	path      string
+	dirty     bool
+	flushLock *sync.Mutex
+}
+
+func newFileHistory(size int, path string) (*fileHistory, error) {
+	history := &fileHistory{
+		localHistory: newLocalHistory(size),
+		path:         path,
+		flushLock:    &sync.Mutex{},
+	}
+	if err := history.load(); err != nil {
+		return nil, err
+	}
+	// Make sure we can write before we start
+	if err := history.flush(); err != nil {
+		return nil, err
+	}
+	go history.run()
+	return history, nil
+}
+
+// Outcomes past the size are dropped in case it was lowered, and data stores
+// that never reported before the restart never will so they are failed
+func (f *fileHistory) load() error {
+	bytes, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) || (err == nil && len(bytes) == 0) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Unable to read history file %v: %v", f.path, err)
+	}
+	histories := []*DeviceJobHistory{}
+	if err := json.Unmarshal(bytes, &histories); err != nil {
+		return fmt.Errorf("Unable to parse history file %v: %v", f.path, err)
+	}
+	for _, history := range histories {
+		if len(history.Outcomes) > f.size {
+			history.Outcomes = history.Outcomes[:f.size]
+		}
+		for _, outcome := range history.Outcomes {
+			for name, dataStoreOutcome := range outcome.DataStores {
+				if dataStoreOutcome.Status == DataStoreOutcomePending {
+					outcome.DataStores[name] = &DataStoreOutcome{
+						Status:  DataStoreOutcomeFailed,
+						Failure: historyRestartFailure,
+					}
+				}
+			}
+		}
+		f.history[(&DataStoreJob{DeviceName: history.DeviceName, JobName: history.JobName}).key()] = history
+	}
+	return nil
+}
+
+func (f *fileHistory) Record(job *DataStoreJob) {
+	f.localHistory.Record(job)
+	f.markDirty()
+}
+
+func (f *fileHistory) RecordDataStore(job *DataStoreJob, dataStoreName string, outcome *DataStoreOutcome) {
+	f.localHistory.RecordDataStore(job, dataStoreName, outcome)
+	f.markDirty()
+}
+
+func (f *fileHistory) markDirty() {
+	f.historyLock.Lock()
+	defer f.historyLock.Unlock()
+	f.dirty = true
+}
+
+func (f *fileHistory) run() {
+	for {
+		time.Sleep(historyFlushTime)
+		f.historyLock.Lock()
+		dirty := f.dirty
+		f.historyLock.Unlock()
+		if dirty {
+			if err := f.flush(); err != nil {
+				log.Printf("Unable to persist history: %v", err)
+				// Try again next time
+				f.markDirty()
+			}
+		}
+	}
+}
+
+func (f *fileHistory) flush() error {
+	f.flushLock.Lock()
+	defer f.flushLock.Unlock()
+	f.historyLock.Lock()
+	histories := make([]*DeviceJobHistory, 0, len(f.history))
+	for _, history := range f.history {
+		histories = append(histories, history)
+	}
+	// Serialized under the lock since outcomes are updated in place
+	bytes, err := json.MarshalIndent(histories, "", "  ")
+	f.dirty = false
+	f.historyLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("Unable to serialize history: %v", err)
+	}
+	// Write to a temp file and rename so we never leave a partial file
+	temp := f.path + ".tmp"
+	if err := ioutil.WriteFile(temp, bytes, 0644); err != nil {
+		return fmt.Errorf("Unable to write history file %v: %v", temp, err)
+	}
+	if err := os.Rename(temp, f.path); err != nil {
+		return fmt.Errorf("Unable to move history file to %v: %v", f.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalHistory(t *testing.T) {
+	history := newLocalHistory(2)
+	if history.DeviceJobHistory("dev", "job") != nil {
+		t.Fatal("Expected no history")
+	}
+	for i, failure := range []string{"", "timeout", ""} {
+		history.Record(&DataStoreJob{
+			DeviceName: "dev",
+			JobName:    "job",
+			JobTime:    time.Unix(int64(100*(i+1)), 0),
+			StartTime:  time.Unix(int64(100*(i+1)), 0),
+			EndTime:    time.Unix(int64(100*(i+1)+5), 0),
+			Failure:    failure,
+		})
+	}
+	actual := history.DeviceJobHistory("dev", "job")
+	if actual.LastSuccess != 300 || actual.LastFailure != 200 {
+		t.Fatalf("Expected last success 300 and failure 200, got %v and %v", actual.LastSuccess, actual.LastFailure)
+	}
+	if len(actual.Outcomes) != 2 || actual.Outcomes[0].JobTimestamp != 300 || actual.Outcomes[1].Failure != "timeout" {
+		t.Fatalf("Unexpected outcomes: %v", actual.Outcomes)
+	}
+	if history.DeviceJobHistory("dev", "otherjob") != nil {
+		t.Fatal("Expected no history for other job")
+	}
+}
+
+func TestFileHistoryReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, HistoryFileName)
+	history, err := newFileHistory(3, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, failure := range []string{"", "timeout", ""} {
+		job := &DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(int64(100*(i+1)), 0),
+			Failure: failure}
+		history.Record(job)
+		history.RecordDataStore(job, "git", &DataStoreOutcome{Status: DataStoreOutcomeStored})
+	}
+	// The last result never finished before the restart
+	history.RecordDataStore(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(300, 0)}, "git",
+		&DataStoreOutcome{Status: DataStoreOutcomePending})
+	if err := history.flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Loaded with a smaller size
+	reloaded, err := newFileHistory(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := reloaded.DeviceJobHistory("dev", "job")
+	if actual == nil || actual.LastSuccess != 300 || actual.LastFailure != 200 || len(actual.Outcomes) != 2 {
+		t.Fatalf("Unexpected history: %+v", actual)
+	}
+	if outcome := actual.Outcomes[0].DataStores["git"]; outcome.Status != DataStoreOutcomeFailed ||
+		outcome.Failure != historyRestartFailure {
+		t.Fatalf("Expected pending outcome to be failed, got %+v", outcome)
+	}
+	if outcome := actual.Outcomes[1].DataStores["git"]; outcome.Status != DataStoreOutcomeStored {
+		t.Fatalf("Expected stored outcome, got %+v", outcome)
+	}
+	// New outcomes are added to what was loaded
+	reloaded.Record(&DataStoreJob{DeviceName: "dev", JobName: "job", JobTime: time.Unix(400, 0)})
+	if actual := reloaded.DeviceJobHistory("dev", "job"); actual.LastSuccess != 400 ||
+		actual.Outcomes[1].JobTimestamp != 300 {
+		t.Fatalf("Unexpected history after record: %+v", actual)
+	}
+}
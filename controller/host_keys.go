@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"gitlab.com/cretz/fusty/model"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const TofuKnownHostsFileName = "tofu_known_hosts"
+
+// hostKeyStore gives the host keys devices may have to workers and records
+// the first keys workers see for the tofu policy
+type hostKeyStore struct {
+	// A known hosts file only ever appended to
+	tofuPath string
+	tofuLock *sync.Mutex
+}
+
+func newHostKeyStore(tofuPath string) *hostKeyStore {
+	return &hostKeyStore{tofuPath: tofuPath, tofuLock: &sync.Mutex{}}
+}
+
+// The keys in authorized keys format or nil if the device's policy doesn't
+// use them. Files are read every time so changes are picked up.
+func (h *hostKeyStore) hostKeys(device *model.Device) ([]string, error) {
+	if device.HostKey == nil {
+		return nil, nil
+	}
+	switch device.HostKey.Policy {
+	case model.HostKeyPolicyKnownHosts:
+		return readKnownHosts(device.HostKey.KnownHostsFile, device.KnownHostsName())
+	case model.HostKeyPolicyTofu:
+		h.tofuLock.Lock()
+		defer h.tofuLock.Unlock()
+		keys, err := readKnownHosts(h.tofuPath, device.KnownHostsName())
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return keys, err
+	default:
+		return nil, nil
+	}
+}
+
+// Records the key a worker saw for a tofu device unless it already has one
+func (h *hostKeyStore) recordFirstSeen(device *model.Device, key string) error {
+	if device.HostKey == nil || device.HostKey.Policy != model.HostKeyPolicyTofu {
+		return fmt.Errorf("Device %v does not trust host keys on first use", device.Name)
+	}
+	fields := strings.Fields(key)
+	if len(fields) != 2 {
+		return fmt.Errorf("Invalid host key: %v", key)
+	} else if _, err := base64.StdEncoding.DecodeString(fields[1]); err != nil {
+		return fmt.Errorf("Invalid host key: %v", err)
+	}
+	h.tofuLock.Lock()
+	defer h.tofuLock.Unlock()
+	name := device.KnownHostsName()
+	if keys, err := readKnownHosts(h.tofuPath, name); err != nil && !os.IsNotExist(err) {
+		return err
+	} else if len(keys) > 0 {
+		// Another worker got here first
+		return nil
+	}
+	file, err := os.OpenFile(h.tofuPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open %v: %v", h.tofuPath, err)
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%v %v %v\n", name, fields[0], fields[1]); err != nil {
+		return fmt.Errorf("Unable to write to %v: %v", h.tofuPath, err)
+	}
+	return nil
+}
+
+// The keys for the host name in the known hosts file. Lines with markers like
+// @cert-authority or @revoked are skipped since they are not supported.
+func readKnownHosts(filename string, name string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+			continue
+		}
+		if knownHostsMatch(fields[0], name) {
+			keys = append(keys, fields[1]+" "+fields[2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read %v: %v", filename, err)
+	}
+	return keys, nil
+}
+
+// Whether the comma separated patterns match the name. Hashed names, wildcards
+// and negation are supported like OpenSSH does.
+func knownHostsMatch(patterns string, name string) bool {
+	// Hashed entries have a single name
+	if strings.HasPrefix(patterns, "|1|") {
+		pieces := strings.Split(patterns[3:], "|")
+		if len(pieces) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(pieces[0])
+		if err != nil {
+			return false
+		}
+		expected, err := base64.StdEncoding.DecodeString(pieces[1])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(name))
+		return hmac.Equal(mac.Sum(nil), expected)
+	}
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if wildcardMatch(pattern, name) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Only * and ? are wildcards, brackets are for ports. Case is ignored.
+func wildcardMatch(pattern string, name string) bool {
+	expr := "(?i)^" + regexp.QuoteMeta(pattern) + "$"
+	expr = strings.Replace(strings.Replace(expr, `\*`, ".*", -1), `\?`, ".", -1)
+	matched, _ := regexp.MatchString(expr, name)
+	return matched
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKnownHostsMatch(t *testing.T) {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("[router1]:2222"))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	tests := []struct {
+		patterns string
+		name     string
+		expected bool
+	}{
+		{"router1,10.0.0.1", "router1", true},
+		{"router1,10.0.0.1", "10.0.0.1", true},
+		{"router1", "router2", false},
+		{"Router1", "router1", true},
+		{"router*", "router2", true},
+		{"router?", "router10", false},
+		{"router*,!router3", "router3", false},
+		{"[router1]:2222", "[router1]:2222", true},
+		{"[router1]:2222", "router1", false},
+		{hashed, "[router1]:2222", true},
+		{hashed, "router1", false},
+	}
+	for _, test := range tests {
+		if actual := knownHostsMatch(test.patterns, test.name); actual != test.expected {
+			t.Errorf("Expected %v for %v matching %v", test.expected, test.patterns, test.name)
+		}
+	}
+}
+
+func TestHostKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-host-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(knownHosts, []byte("# Comment\n"+
+		"@cert-authority * ssh-rsa AAAAcert\n"+
+		"router1,router2 ssh-rsa AAAAone\n"+
+		"router1 ecdsa-sha2-nistp256 AAAAtwo comment\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := newHostKeyStore(filepath.Join(dir, TofuKnownHostsFileName))
+	device := model.NewDefaultDevice("router1")
+	device.HostKey = &model.DeviceHostKey{Policy: model.HostKeyPolicyKnownHosts, KnownHostsFile: knownHosts}
+	keys, err := store.hostKeys(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"ssh-rsa AAAAone", "ecdsa-sha2-nistp256 AAAAtwo"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v, got %v", expected, keys)
+	}
+	// Nothing is trusted until a worker sees it
+	device.HostKey = &model.DeviceHostKey{Policy: model.HostKeyPolicyTofu}
+	device.DeviceProtocol.SshDeviceProtocol.Port = 2222
+	if keys, err := store.hostKeys(device); err != nil || len(keys) != 0 {
+		t.Fatalf("Unexpected keys %v, error: %v", keys, err)
+	}
+	if err := store.recordFirstSeen(device, "ssh-rsa Zmlyc3Q="); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.recordFirstSeen(device, "ssh-rsa c2Vjb25k"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := store.hostKeys(device); err != nil || !reflect.DeepEqual(keys, []string{"ssh-rsa Zmlyc3Q="}) {
+		t.Fatalf("Unexpected keys %v, error: %v", keys, err)
+	}
+	if err := store.recordFirstSeen(device, "not a key"); err == nil {
+		t.Fatal("Expected invalid key to fail")
+	}
+	device.HostKey.Policy = model.HostKeyPolicyNone
+	if err := store.recordFirstSeen(device, "ssh-rsa Zmlyc3Q="); err == nil {
+		t.Fatal("Expected record to fail without tofu policy")
+	}
+}
+
+func TestTofuKnownHostsFile(t *testing.T) {
+	tofu := model.NewDefaultDevice("router1")
+	tofu.HostKey = &model.DeviceHostKey{Policy: model.HostKeyPolicyTofu}
+	gitDataStores := config.DataStoreList{
+		&config.DataStore{Type: "git", DataStoreGit: &config.DataStoreGit{DataDir: "data"}},
+	}
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		conf     *config.Config
+		devices  staticDeviceStore
+		expected string
+	}{
+		{&config.Config{TofuKnownHostsFile: "tofu"}, staticDeviceStore{"router1": tofu}, "tofu"},
+		{&config.Config{DataStores: gitDataStores}, staticDeviceStore{"router1": tofu},
+			filepath.Join("data", TofuKnownHostsFileName)},
+		// Never the working directory with tofu devices
+		{&config.Config{}, staticDeviceStore{"router1": tofu}, ""},
+		{&config.Config{}, staticDeviceStore{"router2": model.NewDefaultDevice("router2")},
+			filepath.Join(workingDir, TofuKnownHostsFileName)},
+	}
+	for _, test := range tests {
+		controller := &Controller{conf: test.conf, DeviceStore: test.devices}
+		actual, err := controller.tofuKnownHostsFile()
+		if test.expected == "" && err == nil {
+			t.Errorf("Expected error for %+v, got %v", test.conf, actual)
+		} else if test.expected != "" && (err != nil || actual != test.expected) {
+			t.Errorf("Expected %v for %+v, got %v with error: %v", test.expected, test.conf, actual, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Incoming job contents are written under this in the controller data
+// directory, unless the incoming directory is configured, until every data
+// store is done with them
+const (
+	// Named for us since it may be in the working directory
+	IncomingDirName = "fusty-incoming"
+	// The prefix of the temp files job contents are written to
+	fileJobContentsPrefix = "job"
+)
+
+var errJobContentsTooLarge = errors.New("Job contents too large")
+
+// JobContents is a job result that data stores read as many times as they
+// need without it being held in memory
+type JobContents interface {
+	Open() (io.ReadCloser, error)
+	Size() int64
+}
+
+// BytesJobContents are job contents held in memory. These are only used for
+// small things like failures and overviews.
+type BytesJobContents []byte
+
+func (b BytesJobContents) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (b BytesJobContents) Size() int64 {
+	return int64(len(b))
+}
+
+// fileJobContents are job contents in a file that must not change while in use
+type fileJobContents struct {
+	path string
+	size int64
+}
+
+func (f *fileJobContents) Open() (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+func (f *fileJobContents) Size() int64 {
+	return f.size
+}
+
+func (f *fileJobContents) remove() {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to remove job contents file %v: %v", f.path, err)
+	}
+}
+
+// Writes everything from the reader to a new file in the directory. Fails
+// without leaving a file if there are more than the max bytes.
+func newFileJobContents(dir string, reader io.Reader, maxBytes int64) (*fileJobContents, error) {
+	file, err := ioutil.TempFile(dir, fileJobContentsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(file, io.LimitReader(reader, maxBytes+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > maxBytes {
+		err = errJobContentsTooLarge
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &fileJobContents{path: file.Name(), size: size}, nil
+}
+
+// Writes the contents to a new file at the path
+func copyJobContents(contents JobContents, path string) (*fileJobContents, error) {
+	reader, err := contents.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilesystemFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &fileJobContents{path: path, size: size}, nil
+}
+
+func jobContentsHash(contents JobContents, hasher hash.Hash) ([]byte, error) {
+	reader, err := contents.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+func jobContentsSha1(contents JobContents) ([]byte, error) {
+	return jobContentsHash(contents, sha1.New())
+}
+
+func jobContentsSha256(contents JobContents) ([]byte, error) {
+	return jobContentsHash(contents, sha256.New())
+}
+
+// Removes the job contents files left in the directory by a previous run.
+// Nothing else in the directory is touched.
+func removeFileJobContents(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), fileJobContentsPrefix) {
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
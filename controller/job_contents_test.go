@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileJobContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-incoming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents, err := newFileJobContents(dir, strings.NewReader("config"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents.Size() != 6 || readJobContents(t, contents) != "config" {
+		t.Fatalf("Unexpected contents: %v", contents)
+	}
+	// Can be read again
+	if readJobContents(t, contents) != "config" {
+		t.Fatal("Unable to read contents twice")
+	}
+	contents.remove()
+	// Too large leaves nothing behind
+	if _, err := newFileJobContents(dir, strings.NewReader("config"), 5); err != errJobContentsTooLarge {
+		t.Fatalf("Expected too large error, got %v", err)
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("Expected no files, got %v", len(files))
+	}
+}
+
+func TestRemoveFileJobContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fusty-incoming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := newFileJobContents(dir, strings.NewReader("config"), 6); err != nil {
+		t.Fatal(err)
+	}
+	// The operator's files are left alone
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeFileJobContents(dir); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "notes.txt" {
+		t.Fatalf("Unexpected files left: %v", files)
+	}
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"gitlab.com/cretz/fusty/model"
+	"time"
+)
+
+const (
+	DefaultLeaseSeconds = 900
+	DefaultLeaseRetries = 2
+	leaseCheckTime      = time.Second
+	// Time for the worker to post the result after the job times out
+	leaseTimeoutMargin = time.Minute
+)
+
+// executionLease is held by a worker from the time it is handed an execution
+// until it posts the completion
+type executionLease struct {
+	id       string
+	devJob   *deviceJob
+	run      *scheduledRun
+	deadline time.Time
+}
+
+func (j *schedulerLocal) newLease(devJob *deviceJob, run *scheduledRun, now time.Time) *executionLease {
+	// The clock doesn't start until the run is supposed to start
+	start := run.runTime
+	if start.Before(now) {
+		start = now
+	}
+	lease := &executionLease{
+		id:       newLeaseId(),
+		devJob:   devJob,
+		run:      run,
+		deadline: start.Add(j.jobLeaseDuration(devJob.Job)),
+	}
+	j.leasesLock.Lock()
+	defer j.leasesLock.Unlock()
+	j.leases[lease.id] = lease
+	return lease
+}
+
+// The lease is extended by however long the worker may wait between retries
+// since that time isn't spent running the job. It is also never shorter than
+// the job timeout since the worker won't give up before then.
+func (j *schedulerLocal) jobLeaseDuration(job *model.Job) time.Duration {
+	duration := j.leaseDuration
+	if job.Retry != nil {
+		duration += job.Retry.TotalBackoff()
+	}
+	if timeout := time.Duration(job.Timeout)*time.Second + leaseTimeoutMargin; job.Timeout > 0 && timeout > duration {
+		duration = timeout
+	}
+	return duration
+}
+
+// Returns false if the lease was not found
+func (j *schedulerLocal) releaseLease(id string) bool {
+	j.leasesLock.Lock()
+	defer j.leasesLock.Unlock()
+	if _, ok := j.leases[id]; !ok {
+		return false
+	}
+	delete(j.leases, id)
+	return true
+}
+
+func (j *schedulerLocal) runLeaseExpiration() {
+	for {
+		time.Sleep(leaseCheckTime)
+		j.expireLeases(time.Now())
+	}
+}
+
+// Expired leases are handed back to the device job to give to another worker
+// unless they have run out of attempts in which case they are lost
+func (j *schedulerLocal) expireLeases(now time.Time) {
+	expired := []*executionLease{}
+	j.leasesLock.Lock()
+	for id, lease := range j.leases {
+		if now.After(lease.deadline) {
+			expired = append(expired, lease)
+			delete(j.leases, id)
+		}
+	}
+	j.leasesLock.Unlock()
+	for _, lease := range expired {
+		if lease.run.attempt > j.leaseRetries {
+			j.errLog.Printf("Lost run of job %v on device %v at expected time %v: lease %v expired after %v attempt(s)",
+				lease.devJob.Job.Name, lease.devJob.Device.Name, lease.run.runTime, lease.id, lease.run.attempt)
+			continue
+		}
+		j.errLog.Printf("Lease %v for job %v on device %v at expected time %v expired on attempt %v, reassigning",
+			lease.id, lease.devJob.Job.Name, lease.devJob.Device.Name, lease.run.runTime, lease.run.attempt)
+		lease.devJob.addPendingRun(&scheduledRun{runTime: lease.run.runTime, attempt: lease.run.attempt + 1})
+	}
+}
+
+func newLeaseId() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		// This is panic worthy
+		panic(err)
+	}
+	return hex.EncodeToString(bytes)
+}
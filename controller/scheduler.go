@@ -2,24 +2,99 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
 	"gitlab.com/cretz/fusty/model"
 	"log"
+	"os"
 	"sync"
 	"time"
 )
 
+const (
+	MissedRunsSkip    = "skip"
+	MissedRunsRunOnce = "run_once"
+	MissedRunsRunAll  = "run_all"
+	// The most missed runs we will enqueue for a single device job
+	maxMissedRuns = 1000
+)
+
 type Scheduler interface {
 	NextExecution(tags []string, before time.Time) *model.Execution
+	// The lease ID may be empty for workers that do not send it
+	ExecutionCompleted(deviceName string, jobName string, jobTime time.Time, leaseId string)
 }
 
 type schedulerLocal struct {
 	deviceJobsByTag map[string][]*deviceJob
+	stateStore      SchedulerStateStore
+	missedRuns      string
+	errLog          *log.Logger
+	leaseDuration   time.Duration
+	leaseRetries    int
+	leasesLock      *sync.Mutex
+	leases          map[string]*executionLease
 }
 
 func (c *Controller) NewLocalScheduler() (Scheduler, error) {
-	ret := &schedulerLocal{deviceJobsByTag: make(map[string][]*deviceJob)}
-	for _, dev := range c.AllDevices() {
-		if err := ret.addDeviceJob(dev); err != nil {
+	missedRuns := MissedRunsSkip
+	leaseSeconds := DefaultLeaseSeconds
+	leaseRetries := DefaultLeaseRetries
+	var stateConf *config.SchedulerState
+	if c.conf.Scheduler != nil {
+		if c.conf.Scheduler.MissedRuns != "" {
+			missedRuns = c.conf.Scheduler.MissedRuns
+		}
+		if c.conf.Scheduler.LeaseSeconds < 0 {
+			return nil, errors.New("Lease seconds cannot be negative")
+		} else if c.conf.Scheduler.LeaseSeconds > 0 {
+			leaseSeconds = c.conf.Scheduler.LeaseSeconds
+		}
+		if c.conf.Scheduler.LeaseRetries != nil {
+			if *c.conf.Scheduler.LeaseRetries < 0 {
+				return nil, errors.New("Lease retries cannot be negative")
+			}
+			leaseRetries = *c.conf.Scheduler.LeaseRetries
+		}
+		stateConf = c.conf.Scheduler.SchedulerState
+	}
+	stateStore, err := NewSchedulerStateStoreFromConfig(stateConf, c.dataDir())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create scheduler state: %v", err)
+	}
+	scheduler, err := newLocalScheduler(c.AllDevices(), stateStore, missedRuns, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	scheduler.errLog = c.errLog
+	scheduler.leaseDuration = time.Duration(leaseSeconds) * time.Second
+	scheduler.leaseRetries = leaseRetries
+	go scheduler.runLeaseExpiration()
+	return scheduler, nil
+}
+
+func newLocalScheduler(devices map[string]*model.Device, stateStore SchedulerStateStore,
+	missedRuns string, now time.Time) (*schedulerLocal, error) {
+	if missedRuns != MissedRunsSkip && missedRuns != MissedRunsRunOnce && missedRuns != MissedRunsRunAll {
+		return nil, fmt.Errorf("Unrecognized missed runs setting: %v", missedRuns)
+	}
+	ret := &schedulerLocal{
+		deviceJobsByTag: make(map[string][]*deviceJob),
+		stateStore:      stateStore,
+		missedRuns:      missedRuns,
+		errLog:          log.New(os.Stderr, "", log.LstdFlags),
+		leaseDuration:   DefaultLeaseSeconds * time.Second,
+		leaseRetries:    DefaultLeaseRetries,
+		leasesLock:      &sync.Mutex{},
+		leases:          make(map[string]*executionLease),
+	}
+	state, err := stateStore.Load()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load scheduler state: %v", err)
+	}
+	for _, dev := range devices {
+		if err := ret.addDeviceJob(dev, state[dev.Name], now); err != nil {
 			return nil, err
 		}
 	}
@@ -40,11 +115,16 @@ func (j *schedulerLocal) NextExecution(tags []string, before time.Time) *model.E
 	}
 	for _, tag := range tags {
 		for _, devJob := range j.deviceJobsByTag[tag] {
-			if runTime := devJob.nextRun(before); !runTime.IsZero() {
+			if run := devJob.nextRun(before); !run.runTime.IsZero() {
+				j.stateStore.MarkScheduled(devJob.Device.Name, devJob.Job.Name, run.runTime)
+				lease := j.newLease(devJob, run, time.Now())
 				return &model.Execution{
-					Device:    devJob.Device,
-					Job:       devJob.Job,
-					Timestamp: runTime.Unix(),
+					Device:        devJob.Device,
+					Job:           devJob.Job,
+					Timestamp:     run.runTime.Unix(),
+					LeaseId:       lease.id,
+					LeaseDeadline: lease.deadline.Unix(),
+					Attempt:       run.attempt,
 				}
 			}
 		}
@@ -52,14 +132,26 @@ func (j *schedulerLocal) NextExecution(tags []string, before time.Time) *model.E
 	return nil
 }
 
-func (j *schedulerLocal) addDeviceJob(dev *model.Device) error {
+func (j *schedulerLocal) ExecutionCompleted(deviceName string, jobName string, jobTime time.Time, leaseId string) {
+	j.stateStore.MarkCompleted(deviceName, jobName, jobTime)
+	if leaseId != "" && !j.releaseLease(leaseId) {
+		// We still accept it, but it may have been given to another worker
+		j.errLog.Printf("Job %v on device %v at expected time %v completed with unknown or expired lease %v",
+			jobName, deviceName, jobTime, leaseId)
+	}
+}
+
+func (j *schedulerLocal) addDeviceJob(dev *model.Device, state map[string]*DeviceJobState, now time.Time) error {
 	for _, job := range dev.Jobs {
 		devJob := &deviceJob{
 			Device:      dev,
 			Job:         job,
-			lastRun:     time.Now(),
+			lastRun:     now,
 			lastRunLock: &sync.Mutex{},
 		}
+		if jobState := state[job.Name]; jobState != nil && !jobState.LastScheduled.IsZero() {
+			j.applyMissedRuns(devJob, jobState, now)
+		}
 		if len(devJob.Tags) == 0 {
 			j.addDeviceJobToTag("", devJob)
 		} else {
@@ -75,6 +167,48 @@ func (j *schedulerLocal) addDeviceJob(dev *model.Device) error {
 	return nil
 }
 
+func (j *schedulerLocal) applyMissedRuns(devJob *deviceJob, state *DeviceJobState, now time.Time) {
+	lastScheduled := state.LastScheduled
+	// The last run handed out never completed, so it was lost with its lease
+	uncompleted := state.LastCompleted.Before(lastScheduled)
+	// Anything already handed out for the future should not be handed out
+	// again. If it never completed it isn't missed yet, just handed out again.
+	if lastScheduled.After(now) {
+		devJob.lastRun = lastScheduled
+		if uncompleted {
+			devJob.pendingRuns = append(devJob.pendingRuns, &scheduledRun{runTime: lastScheduled, attempt: 1})
+			log.Printf("Job %v for device %v never completed its run at %v, running it again",
+				devJob.Job.Name, devJob.Device.Name, lastScheduled)
+		}
+		return
+	}
+	if j.missedRuns == MissedRunsSkip {
+		return
+	}
+	missed := []time.Time{}
+	if uncompleted {
+		missed = append(missed, lastScheduled)
+	}
+	for next := devJob.Job.Next(lastScheduled); !next.IsZero() && !next.After(now); next = devJob.Job.Next(next) {
+		if len(missed) == maxMissedRuns {
+			// Drop the oldest
+			missed = missed[1:]
+		}
+		missed = append(missed, next)
+	}
+	if len(missed) == 0 {
+		return
+	}
+	if j.missedRuns == MissedRunsRunOnce {
+		missed = missed[len(missed)-1:]
+	}
+	for _, runTime := range missed {
+		devJob.pendingRuns = append(devJob.pendingRuns, &scheduledRun{runTime: runTime, attempt: 1})
+	}
+	log.Printf("Job %v for device %v missed run(s) since %v, running %v of them now",
+		devJob.Job.Name, devJob.Device.Name, lastScheduled, len(missed))
+}
+
 func (j *schedulerLocal) addDeviceJobToTag(tag string, d *deviceJob) {
 	j.deviceJobsByTag[tag] = append(j.deviceJobsByTag[tag], d)
 }
@@ -84,11 +218,24 @@ type deviceJob struct {
 	*model.Job    `json:"job"`
 	lastRun       time.Time
 	lastRunLock   *sync.Mutex
+	// Missed or reassigned runs to be handed out before anything else
+	pendingRuns []*scheduledRun
 }
 
-func (d *deviceJob) nextRun(before time.Time) time.Time {
+type scheduledRun struct {
+	runTime time.Time
+	attempt int
+}
+
+// Result has a zero run time if nothing is to be run
+func (d *deviceJob) nextRun(before time.Time) *scheduledRun {
 	d.lastRunLock.Lock()
 	defer d.lastRunLock.Unlock()
+	if len(d.pendingRuns) > 0 {
+		ret := d.pendingRuns[0]
+		d.pendingRuns = d.pendingRuns[1:]
+		return ret
+	}
 	after := time.Now()
 	if d.lastRun.After(after) {
 		after = d.lastRun
@@ -96,7 +243,13 @@ func (d *deviceJob) nextRun(before time.Time) time.Time {
 	ret := d.Job.Next(after)
 	if ret.After(after) && ret.Before(before) {
 		d.lastRun = ret
-		return ret
+		return &scheduledRun{runTime: ret, attempt: 1}
 	}
-	return time.Time{}
+	return &scheduledRun{}
+}
+
+func (d *deviceJob) addPendingRun(run *scheduledRun) {
+	d.lastRunLock.Lock()
+	defer d.lastRunLock.Unlock()
+	d.pendingRuns = append(d.pendingRuns, run)
 }
@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SchedulerStateFileName  = "scheduler_state.json"
+	schedulerStateFlushTime = time.Second
+)
+
+// SchedulerStateStore persists what the scheduler has done so it can pick up
+// where it left off after a restart
+type SchedulerStateStore interface {
+	// The result is keyed by device name then job name
+	Load() (map[string]map[string]*DeviceJobState, error)
+	MarkScheduled(deviceName string, jobName string, runTime time.Time)
+	MarkCompleted(deviceName string, jobName string, runTime time.Time)
+}
+
+type DeviceJobState struct {
+	LastScheduled time.Time `json:"last_scheduled"`
+	LastCompleted time.Time `json:"last_completed"`
+}
+
+// dataDir is used as the default location for state files
+func NewSchedulerStateStoreFromConfig(conf *config.SchedulerState, dataDir string) (SchedulerStateStore, error) {
+	typ := "file"
+	if conf != nil && conf.Type != "" {
+		typ = conf.Type
+	}
+	switch typ {
+	case "file":
+		return newFileSchedulerStateStore(schedulerStateFilePath(conf, dataDir))
+	case "memory":
+		return newMemorySchedulerStateStore(), nil
+	default:
+		return nil, fmt.Errorf("Unrecognized scheduler state type: %v", typ)
+	}
+}
+
+// Where the file state store keeps its state
+func schedulerStateFilePath(conf *config.SchedulerState, dataDir string) string {
+	if conf != nil && conf.SchedulerStateFile != nil && conf.SchedulerStateFile.Path != "" {
+		return conf.SchedulerStateFile.Path
+	}
+	return filepath.Join(dataDir, SchedulerStateFileName)
+}
+
+type memorySchedulerStateStore struct {
+	stateLock *sync.Mutex
+	state     map[string]map[string]*DeviceJobState
+}
+
+func newMemorySchedulerStateStore() *memorySchedulerStateStore {
+	return &memorySchedulerStateStore{
+		stateLock: &sync.Mutex{},
+		state:     make(map[string]map[string]*DeviceJobState),
+	}
+}
+
+func (m *memorySchedulerStateStore) Load() (map[string]map[string]*DeviceJobState, error) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.copyState(), nil
+}
+
+func (m *memorySchedulerStateStore) MarkScheduled(deviceName string, jobName string, runTime time.Time) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	if state := m.deviceJobState(deviceName, jobName); runTime.After(state.LastScheduled) {
+		state.LastScheduled = runTime
+	}
+}
+
+func (m *memorySchedulerStateStore) MarkCompleted(deviceName string, jobName string, runTime time.Time) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	if state := m.deviceJobState(deviceName, jobName); runTime.After(state.LastCompleted) {
+		state.LastCompleted = runTime
+	}
+}
+
+// Expects lock to be held
+func (m *memorySchedulerStateStore) deviceJobState(deviceName string, jobName string) *DeviceJobState {
+	jobs, ok := m.state[deviceName]
+	if !ok {
+		jobs = make(map[string]*DeviceJobState)
+		m.state[deviceName] = jobs
+	}
+	state, ok := jobs[jobName]
+	if !ok {
+		state = &DeviceJobState{}
+		jobs[jobName] = state
+	}
+	return state
+}
+
+// Expects lock to be held
+func (m *memorySchedulerStateStore) copyState() map[string]map[string]*DeviceJobState {
+	ret := make(map[string]map[string]*DeviceJobState, len(m.state))
+	for deviceName, jobs := range m.state {
+		retJobs := make(map[string]*DeviceJobState, len(jobs))
+		for jobName, state := range jobs {
+			retJobs[jobName] = &DeviceJobState{LastScheduled: state.LastScheduled, LastCompleted: state.LastCompleted}
+		}
+		ret[deviceName] = retJobs
+	}
+	return ret
+}
+
+// fileSchedulerStateStore keeps state in memory and flushes it to a JSON file
+// in the background when it changes
+type fileSchedulerStateStore struct {
+	*memorySchedulerStateStore
+	path      string
+	dirty     bool
+	flushLock *sync.Mutex
+}
+
+func newFileSchedulerStateStore(path string) (*fileSchedulerStateStore, error) {
+	store := &fileSchedulerStateStore{
+		memorySchedulerStateStore: newMemorySchedulerStateStore(),
+		path:                      path,
+		flushLock:                 &sync.Mutex{},
+	}
+	if bytes, err := ioutil.ReadFile(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unable to read scheduler state file %v: %v", path, err)
+	} else if err == nil && len(bytes) > 0 {
+		if err := json.Unmarshal(bytes, &store.state); err != nil {
+			return nil, fmt.Errorf("Unable to parse scheduler state file %v: %v", path, err)
+		}
+	}
+	// Make sure we can write before we start
+	if err := store.flush(); err != nil {
+		return nil, err
+	}
+	go store.run()
+	return store, nil
+}
+
+func (f *fileSchedulerStateStore) MarkScheduled(deviceName string, jobName string, runTime time.Time) {
+	f.memorySchedulerStateStore.MarkScheduled(deviceName, jobName, runTime)
+	f.markDirty()
+}
+
+func (f *fileSchedulerStateStore) MarkCompleted(deviceName string, jobName string, runTime time.Time) {
+	f.memorySchedulerStateStore.MarkCompleted(deviceName, jobName, runTime)
+	f.markDirty()
+}
+
+func (f *fileSchedulerStateStore) markDirty() {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	f.dirty = true
+}
+
+func (f *fileSchedulerStateStore) run() {
+	for {
+		time.Sleep(schedulerStateFlushTime)
+		f.stateLock.Lock()
+		dirty := f.dirty
+		f.stateLock.Unlock()
+		if dirty {
+			if err := f.flush(); err != nil {
+				log.Printf("Unable to persist scheduler state: %v", err)
+				// Try again next time
+				f.markDirty()
+			}
+		}
+	}
+}
+
+func (f *fileSchedulerStateStore) flush() error {
+	f.flushLock.Lock()
+	defer f.flushLock.Unlock()
+	f.stateLock.Lock()
+	state := f.copyState()
+	f.dirty = false
+	f.stateLock.Unlock()
+	bytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Unable to serialize scheduler state: %v", err)
+	}
+	// Write to a temp file and rename so we never leave a partial file
+	temp := f.path + ".tmp"
+	if err := ioutil.WriteFile(temp, bytes, 0644); err != nil {
+		return fmt.Errorf("Unable to write scheduler state file %v: %v", temp, err)
+	}
+	if err := os.Rename(temp, f.path); err != nil {
+		return fmt.Errorf("Unable to move scheduler state file to %v: %v", f.path, err)
+	}
+	return nil
+}
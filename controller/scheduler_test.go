@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"testing"
+	"time"
+)
+
+func TestSchedulerMissedRuns(t *testing.T) {
+	now := time.Unix(1433152800, 0)
+	tests := []struct {
+		missedRuns    string
+		lastScheduled time.Time
+		lastCompleted time.Time
+		expected      []time.Time
+	}{
+		// No state means nothing missed
+		{MissedRunsRunAll, time.Time{}, time.Time{}, nil},
+		{MissedRunsSkip, now.Add(-time.Hour), now.Add(-time.Hour), nil},
+		{MissedRunsRunOnce, now.Add(-time.Hour), now.Add(-time.Hour), []time.Time{now}},
+		{MissedRunsRunAll, now.Add(-time.Hour), now.Add(-time.Hour), []time.Time{
+			now.Add(-45 * time.Minute), now.Add(-30 * time.Minute), now.Add(-15 * time.Minute), now,
+		}},
+		{MissedRunsRunAll, now, now, nil},
+		// Scheduled ahead of now means it was already handed out
+		{MissedRunsRunAll, now.Add(15 * time.Minute), now.Add(15 * time.Minute), nil},
+		// A scheduled run that never completed is missed too
+		{MissedRunsSkip, now.Add(-time.Hour), now.Add(-75 * time.Minute), nil},
+		{MissedRunsRunOnce, now.Add(-time.Hour), now.Add(-75 * time.Minute), []time.Time{now}},
+		{MissedRunsRunOnce, now, time.Time{}, []time.Time{now}},
+		{MissedRunsRunAll, now.Add(-time.Hour), now.Add(-75 * time.Minute), []time.Time{
+			now.Add(-time.Hour), now.Add(-45 * time.Minute), now.Add(-30 * time.Minute), now.Add(-15 * time.Minute), now,
+		}},
+		// Unless it's ahead of now, then it is only handed out again
+		{MissedRunsSkip, now.Add(15 * time.Minute), now, []time.Time{now.Add(15 * time.Minute)}},
+	}
+	for _, test := range tests {
+		sched, err := model.NewDurationSchedule("15 minutes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev := model.NewDefaultDevice("dev")
+		job := model.NewDefaultJob("job")
+		job.Schedule = sched
+		dev.Jobs = map[string]*model.Job{"job": job}
+		stateStore := newMemorySchedulerStateStore()
+		if !test.lastScheduled.IsZero() {
+			stateStore.MarkScheduled("dev", "job", test.lastScheduled)
+		}
+		if !test.lastCompleted.IsZero() {
+			stateStore.MarkCompleted("dev", "job", test.lastCompleted)
+		}
+		scheduler, err := newLocalScheduler(map[string]*model.Device{"dev": dev}, stateStore, test.missedRuns, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devJob := scheduler.deviceJobsByTag[""][0]
+		actual := []time.Time{}
+		for _, run := range devJob.pendingRuns {
+			actual = append(actual, run.runTime)
+		}
+		if len(actual) != len(test.expected) {
+			t.Errorf("Policy %v from %v expected %v missed runs, got %v",
+				test.missedRuns, test.lastScheduled, test.expected, actual)
+			continue
+		}
+		for i, expected := range test.expected {
+			if !actual[i].Equal(expected) {
+				t.Errorf("Policy %v from %v expected %v missed runs, got %v",
+					test.missedRuns, test.lastScheduled, test.expected, actual)
+				break
+			}
+		}
+		if test.lastScheduled.After(now) && !devJob.lastRun.Equal(test.lastScheduled) {
+			t.Errorf("Expected last run to be %v, got %v", test.lastScheduled, devJob.lastRun)
+		}
+	}
+}
+
+func TestSchedulerInvalidMissedRuns(t *testing.T) {
+	if _, err := newLocalScheduler(nil, newMemorySchedulerStateStore(), "sometimes", time.Now()); err == nil {
+		t.Fatal("Expected error for invalid missed runs setting")
+	}
+}
+
+func TestSchedulerLeaseExpiration(t *testing.T) {
+	sched, err := model.NewDurationSchedule("15 minutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := model.NewDefaultDevice("dev")
+	job := model.NewDefaultJob("job")
+	job.Schedule = sched
+	dev.Jobs = map[string]*model.Job{"job": job}
+	scheduler, err := newLocalScheduler(map[string]*model.Device{"dev": dev},
+		newMemorySchedulerStateStore(), MissedRunsSkip, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.leaseRetries = 1
+	// First execution is in the next 15 minutes
+	first := scheduler.NextExecution(nil, time.Now().Add(16*time.Minute))
+	if first == nil || first.LeaseId == "" || first.Attempt != 1 {
+		t.Fatalf("Expected first attempt with lease, got %+v", first)
+	}
+	if first.LeaseDeadline != first.Timestamp+DefaultLeaseSeconds {
+		t.Fatalf("Expected deadline %v, got %v", first.Timestamp+DefaultLeaseSeconds, first.LeaseDeadline)
+	}
+	// Nothing until the lease expires
+	if next := scheduler.NextExecution(nil, time.Now().Add(time.Minute)); next != nil {
+		t.Fatalf("Expected no execution, got %+v", next)
+	}
+	scheduler.expireLeases(time.Unix(first.LeaseDeadline+1, 0))
+	second := scheduler.NextExecution(nil, time.Now().Add(time.Minute))
+	if second == nil || second.Timestamp != first.Timestamp || second.Attempt != 2 || second.LeaseId == first.LeaseId {
+		t.Fatalf("Expected second attempt of first run, got %+v", second)
+	}
+	// Completing with the old lease does not release the new one
+	scheduler.ExecutionCompleted("dev", "job", time.Unix(first.Timestamp, 0), first.LeaseId)
+	if len(scheduler.leases) != 1 {
+		t.Fatalf("Expected one lease, got %v", len(scheduler.leases))
+	}
+	// Out of retries means it is lost
+	scheduler.expireLeases(time.Unix(second.LeaseDeadline+1, 0))
+	if next := scheduler.NextExecution(nil, time.Now().Add(time.Minute)); next != nil {
+		t.Fatalf("Expected no execution after retries, got %+v", next)
+	}
+	if len(scheduler.leases) != 0 {
+		t.Fatalf("Expected no leases, got %v", len(scheduler.leases))
+	}
+}
+
+func TestSchedulerLeaseDuration(t *testing.T) {
+	scheduler, err := newLocalScheduler(nil, newMemorySchedulerStateStore(), MissedRunsSkip, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry := model.NewDefaultJobRetry()
+	maxAttempts, backoff, backoffMax := 3, 100, 150
+	retry.ApplyConfig(&config.JobRetry{
+		MaxAttempts:       &maxAttempts,
+		BackoffSeconds:    &backoff,
+		BackoffMaxSeconds: &backoffMax,
+	})
+	tests := []struct {
+		retry    *model.JobRetry
+		timeout  int
+		expected time.Duration
+	}{
+		{nil, 0, DefaultLeaseSeconds * time.Second},
+		// Waits 100 then 150 seconds between the attempts
+		{retry, 0, (DefaultLeaseSeconds + 250) * time.Second},
+		{nil, 60, DefaultLeaseSeconds * time.Second},
+		{nil, 3600, time.Hour + leaseTimeoutMargin},
+		{retry, 3600, time.Hour + leaseTimeoutMargin},
+	}
+	for _, test := range tests {
+		job := model.NewDefaultJob("job")
+		job.Retry = test.retry
+		job.Timeout = test.timeout
+		if actual := scheduler.jobLeaseDuration(job); actual != test.expected {
+			t.Errorf("Expected lease duration %v for %+v with timeout %v, got %v",
+				test.expected, test.retry, test.timeout, actual)
+		}
+	}
+}
@@ -68,6 +68,25 @@ func TestControllerFailures(t *testing.T) {
 						cmd.conveyCommandFailure("Invalid schedule: syntax error in hour field: '30'")
 					})
 				})
+
+				Convey("When we have multiple schedule formats", func() {
+					conf.JobStore.JobStoreLocal.Jobs["bar"].JobSchedule = &config.JobSchedule{
+						Cron:     "0 30 * * * * *",
+						Duration: "15 minutes",
+					}
+					ctx.withTempConfig(c, conf, func(confFile string) {
+						cmd := runFusty(c, "controller", "-config", confFile)
+						cmd.conveyCommandFailure("Invalid schedule: Only one schedule format allowed, got: cron, duration")
+					})
+				})
+
+				Convey("When we have an invalid duration schedule", func() {
+					conf.JobStore.JobStoreLocal.Jobs["bar"].JobSchedule = &config.JobSchedule{Duration: "2 weeks"}
+					ctx.withTempConfig(c, conf, func(confFile string) {
+						cmd := runFusty(c, "controller", "-config", confFile)
+						cmd.conveyCommandFailure("Invalid schedule: Unrecognized duration unit 'weeks'")
+					})
+				})
 			})
 
 			Convey("When we are concerned with the device store configuration", func() {
@@ -111,7 +130,7 @@ func TestControllerFailures(t *testing.T) {
 			Convey("When we are concerned with the data store configuration", func() {
 
 				Convey("When we have no data store", func() {
-					conf.DataStore = nil
+					conf.DataStores = nil
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Data store configuration not found")
@@ -119,15 +138,33 @@ func TestControllerFailures(t *testing.T) {
 				})
 
 				Convey("When we change the data store type to invalid", func() {
-					conf.DataStore.Type = "unknown"
+					conf.DataStores[0].Type = "unknown"
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Unrecognized data store type: unknown")
 					})
 				})
 
+				Convey("When the filesystem data store has no directory", func() {
+					conf.DataStores[0].Type = "filesystem"
+					conf.DataStores[0].DataStoreFilesystem = &config.DataStoreFilesystem{}
+					ctx.withTempConfig(c, conf, func(confFile string) {
+						cmd := runFusty(c, "controller", "-config", confFile)
+						cmd.conveyCommandFailure("Data store for filesystem requires directory")
+					})
+				})
+
+				Convey("When the s3 data store has no bucket", func() {
+					conf.DataStores[0].Type = "s3"
+					conf.DataStores[0].DataStoreS3 = &config.DataStoreS3{}
+					ctx.withTempConfig(c, conf, func(confFile string) {
+						cmd := runFusty(c, "controller", "-config", confFile)
+						cmd.conveyCommandFailure("Data store for s3 requires bucket")
+					})
+				})
+
 				Convey("When there is no git URL", func() {
-					conf.DataStore.DataStoreGit.Url = ""
+					conf.DataStores[0].DataStoreGit.Url = ""
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Data store for git requires url")
@@ -135,7 +172,7 @@ func TestControllerFailures(t *testing.T) {
 				})
 
 				Convey("When we use an unknown structure", func() {
-					conf.DataStore.DataStoreGit.Structure = []string{"unknown"}
+					conf.DataStores[0].DataStoreGit.Structure = []string{"unknown"}
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Unrecognized git structure: unknown")
@@ -143,7 +180,7 @@ func TestControllerFailures(t *testing.T) {
 				})
 
 				Convey("When we use an invalid data directory", func() {
-					conf.DataStore.DataStoreGit.DataDir = filepath.Join(ctx.tempDirectory, "notpresent")
+					conf.DataStores[0].DataStoreGit.DataDir = filepath.Join(ctx.tempDirectory, "notpresent")
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Failure obtaining git data directory")
@@ -151,7 +188,7 @@ func TestControllerFailures(t *testing.T) {
 				})
 
 				Convey("When we use an invalid email", func() {
-					conf.DataStore.DataStoreGit.DataStoreGitUser.Email = "invalidemail"
+					conf.DataStores[0].DataStoreGit.DataStoreGitUser.Email = "invalidemail"
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Invalid email for git user")
@@ -159,17 +196,36 @@ func TestControllerFailures(t *testing.T) {
 				})
 
 				Convey("When we use a password without user", func() {
-					conf.DataStore.DataStoreGit.DataStoreGitUser.Pass = "somepass"
+					conf.DataStores[0].DataStoreGit.DataStoreGitUser.Pass = "somepass"
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("If git password supplied, username must also be supplied")
 					})
 				})
 
+				Convey("When we use SSH settings without an SSH URL", func() {
+					conf.DataStores[0].DataStoreGit.DataStoreGitSsh = &config.DataStoreGitSsh{KnownHostsFile: "known_hosts"}
+					ctx.withTempConfig(c, conf, func(confFile string) {
+						cmd := runFusty(c, "controller", "-config", confFile)
+						cmd.conveyCommandFailure("Git ssh settings can only be used with an SSH URL")
+					})
+				})
+
+				Convey("When we use an SSH key file that doesn't exist", func() {
+					conf.DataStores[0].DataStoreGit.Url = "git@localhost:repository.git"
+					conf.DataStores[0].DataStoreGit.DataStoreGitSsh = &config.DataStoreGitSsh{
+						KeyFile: filepath.Join(ctx.tempDirectory, "notpresent"),
+					}
+					ctx.withTempConfig(c, conf, func(confFile string) {
+						cmd := runFusty(c, "controller", "-config", confFile)
+						cmd.conveyCommandFailure("Unable to find git SSH key file")
+					})
+				})
+
 				Convey("When we use a git repository that doesn't exist", func() {
 					dir, err := ioutil.TempDir(ctx.tempDirectory, "badgit")
 					So(err, ShouldBeNil)
-					conf.DataStore.DataStoreGit.Url = dir
+					conf.DataStores[0].DataStoreGit.Url = dir
 					ctx.withTempConfig(c, conf, func(confFile string) {
 						cmd := runFusty(c, "controller", "-config", confFile)
 						cmd.conveyCommandFailure("Git repository validation using ls-remote failed")
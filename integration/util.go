@@ -91,15 +91,19 @@ func (ctx *context) newWorkingConfig() *config.Config {
 				},
 			},
 		},
-		DataStore: &config.DataStore{
-			Type: "git",
-			DataStoreGit: &config.DataStoreGit{
-				Url:      ctx.gitRepoDirectory,
-				PoolSize: 1,
-				DataDir:  ctx.gitPullDataDirectory,
-				DataStoreGitUser: &config.DataStoreGitUser{
-					FriendlyName: "John Doe",
-					Email:        "jdoe@example.com",
+		DataStores: []*config.DataStore{
+			&config.DataStore{
+				Type: "git",
+				DataStoreGit: &config.DataStoreGit{
+					Url:      ctx.gitRepoDirectory,
+					PoolSize: 1,
+					DataDir:  ctx.gitPullDataDirectory,
+					// Empty is the default backend
+					Backend: os.Getenv("FUSTY_TEST_GIT_BACKEND"),
+					DataStoreGitUser: &config.DataStoreGitUser{
+						FriendlyName: "John Doe",
+						Email:        "jdoe@example.com",
+					},
 				},
 			},
 		},
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"gitlab.com/cretz/fusty/config"
+	"regexp"
 )
 
 type Device struct {
@@ -13,6 +14,11 @@ type Device struct {
 	*DeviceProtocol    `json:"protocol"`
 	Tags               []string        `json:"-"`
 	Jobs               map[string]*Job `json:"-"`
+	// Regex matching the shell prompt for jobs that don't have their own
+	Prompt string `json:"prompt,omitempty"`
+	// For jobs that don't have their own
+	Pagers  []*Pager       `json:"pagers,omitempty"`
+	HostKey *DeviceHostKey `json:"host_key"`
 }
 
 func NewDefaultDevice(name string) *Device {
@@ -20,6 +26,7 @@ func NewDefaultDevice(name string) *Device {
 		Name:           name,
 		Host:           name,
 		DeviceProtocol: &DeviceProtocol{Type: "ssh", SshDeviceProtocol: &SshDeviceProtocol{Port: 22}},
+		HostKey:        NewDefaultDeviceHostKey(),
 	}
 }
 
@@ -40,6 +47,27 @@ func (d *Device) ApplyConfig(conf *config.Device) error {
 				IncludeCbcCiphers: conf.DeviceProtocol.DeviceProtocolSsh != nil &&
 					conf.DeviceProtocol.DeviceProtocolSsh.IncludeCbcCiphers,
 			}
+			d.DeviceProtocol.TelnetDeviceProtocol = nil
+			d.DeviceProtocol.HttpDeviceProtocol = nil
+		case "telnet":
+			d.DeviceProtocol.Type = "telnet"
+			d.DeviceProtocol.TelnetDeviceProtocol = NewDefaultTelnetDeviceProtocol()
+			if conf.DeviceProtocol.DeviceProtocolTelnet != nil {
+				d.DeviceProtocol.TelnetDeviceProtocol.ApplyConfig(conf.DeviceProtocol.DeviceProtocolTelnet)
+			}
+			d.DeviceProtocol.SshDeviceProtocol = nil
+			d.DeviceProtocol.HttpDeviceProtocol = nil
+		case "http":
+			d.DeviceProtocol.Type = "http"
+			d.DeviceProtocol.HttpDeviceProtocol = NewDefaultHttpDeviceProtocol()
+			if conf.DeviceProtocol.DeviceProtocolHttp != nil {
+				err := d.DeviceProtocol.HttpDeviceProtocol.ApplyConfig(conf.DeviceProtocol.DeviceProtocolHttp)
+				if err != nil {
+					return err
+				}
+			}
+			d.DeviceProtocol.SshDeviceProtocol = nil
+			d.DeviceProtocol.TelnetDeviceProtocol = nil
 		default:
 			return fmt.Errorf("Unrecognized protocol type: %v", conf.Type)
 		}
@@ -49,13 +77,23 @@ func (d *Device) ApplyConfig(conf *config.Device) error {
 		if d.DeviceCredentials == nil {
 			d.DeviceCredentials = &DeviceCredentials{}
 		}
-		if conf.DeviceCredentials.User != "" {
-			d.DeviceCredentials.User = conf.DeviceCredentials.User
+		if err := d.DeviceCredentials.ApplyConfig(conf.DeviceCredentials); err != nil {
+			return fmt.Errorf("Invalid credentials: %v", err)
 		}
-		if conf.DeviceCredentials.Pass != "" {
-			d.DeviceCredentials.Pass = conf.DeviceCredentials.Pass
+	}
+	if conf.Prompt != "" {
+		d.Prompt = sanitizeRegex(conf.Prompt)
+	}
+	// Pagers replace the inherited ones as a whole
+	if len(conf.Pagers) > 0 {
+		d.Pagers = nil
+		for _, pager := range conf.Pagers {
+			d.Pagers = append(d.Pagers, NewPagerFromConfig(pager))
 		}
 	}
+	if conf.DeviceHostKey != nil {
+		d.HostKey.ApplyConfig(conf.DeviceHostKey)
+	}
 	// We expect the job to be present to overwrite it with anything
 	for name, job := range conf.Jobs {
 		if existing, ok := d.Jobs[name]; ok {
@@ -77,27 +115,57 @@ func (d *Device) Validate() []error {
 	}
 	if d.DeviceProtocol == nil {
 		errs = append(errs, errors.New("Protocol required"))
+	} else if d.DeviceProtocol.TelnetDeviceProtocol != nil {
+		for _, err := range d.DeviceProtocol.TelnetDeviceProtocol.Validate() {
+			errs = append(errs, fmt.Errorf("Invalid telnet protocol: %v", err))
+		}
+	} else if d.DeviceProtocol.HttpDeviceProtocol != nil {
+		for _, err := range d.DeviceProtocol.HttpDeviceProtocol.Validate() {
+			errs = append(errs, fmt.Errorf("Invalid http protocol: %v", err))
+		}
+	}
+	if d.Prompt != "" {
+		if _, err := regexp.Compile(d.Prompt); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid prompt regex '%v': %v", d.Prompt, err))
+		}
+	}
+	for _, pager := range d.Pagers {
+		if err := pager.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if d.HostKey != nil {
+		for _, err := range d.HostKey.Validate() {
+			errs = append(errs, fmt.Errorf("Invalid host key: %v", err))
+		}
+	}
+	if d.DeviceCredentials != nil {
+		for _, err := range d.DeviceCredentials.Validate() {
+			errs = append(errs, fmt.Errorf("Invalid credentials: %v", err))
+		}
 	}
-	// TODO: validate credentials
 	for name, job := range d.Jobs {
 		for _, err := range job.Validate() {
 			errs = append(errs, fmt.Errorf("Invalid job %v: %v", name, err))
 		}
+		// HTTP devices can only do HTTP jobs and vice versa
+		if d.DeviceProtocol != nil && d.DeviceProtocol.Type == "http" && job.HttpRequest == nil {
+			errs = append(errs, fmt.Errorf("Invalid job %v: Only http jobs can run on http devices", name))
+		} else if d.DeviceProtocol != nil && d.DeviceProtocol.Type != "http" && job.HttpRequest != nil {
+			errs = append(errs, fmt.Errorf("Invalid job %v: Http jobs can only run on http devices", name))
+		}
 	}
 	return errs
 }
 
 type DeviceProtocol struct {
-	Type               string `json:"type"`
-	*SshDeviceProtocol `json:"ssh,omitempty"`
+	Type                  string `json:"type"`
+	*SshDeviceProtocol    `json:"ssh,omitempty"`
+	*TelnetDeviceProtocol `json:"telnet,omitempty"`
+	*HttpDeviceProtocol   `json:"http,omitempty"`
 }
 
 type SshDeviceProtocol struct {
 	Port              int  `json:"port"`
 	IncludeCbcCiphers bool `json:"include_cbc_ciphers"`
 }
-
-type DeviceCredentials struct {
-	User string `json:"user"`
-	Pass string `json:"pass"`
-}
@@ -0,0 +1,158 @@
+package model
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"io/ioutil"
+	"regexp"
+)
+
+// The ways a worker can authenticate with a device over SSH
+const (
+	AuthMethodPublicKey           = "public_key"
+	AuthMethodAgent               = "agent"
+	AuthMethodPassword            = "password"
+	AuthMethodKeyboardInteractive = "keyboard_interactive"
+)
+
+// The order methods are tried in when there is no auth order. Only the ones
+// with credentials set are used.
+var DefaultAuthOrder = []string{AuthMethodPublicKey, AuthMethodAgent, AuthMethodPassword, AuthMethodKeyboardInteractive}
+
+type DeviceCredentials struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+	// Sent as a bearer token by http devices
+	Token string `json:"token,omitempty"`
+	// PEM encoded private key, read from the key file on the controller if
+	// that's how it was configured
+	Key           string `json:"key,omitempty"`
+	KeyPassphrase string `json:"key_passphrase,omitempty"`
+	// Use the keys of the SSH agent the worker runs with
+	Agent bool `json:"agent,omitempty"`
+	// Answers for keyboard interactive questions. Unanswered questions that
+	// are not echoed are given the password.
+	KeyboardInteractive []*KeyboardInteractiveAnswer `json:"keyboard_interactive,omitempty"`
+	// Empty to use the default order
+	AuthOrder []string `json:"auth_order,omitempty"`
+}
+
+type KeyboardInteractiveAnswer struct {
+	// Implicitly prefixed and suffixed like expectations
+	Prompt string `json:"prompt"`
+	Answer string `json:"answer"`
+}
+
+func (d *DeviceCredentials) ApplyConfig(conf *config.DeviceCredentials) error {
+	if conf.User != "" {
+		d.User = conf.User
+	}
+	if conf.Pass != "" {
+		d.Pass = conf.Pass
+	}
+	if conf.Token != "" {
+		d.Token = conf.Token
+	}
+	if conf.Key != "" && conf.KeyFile != "" {
+		return errors.New("Cannot have both key and key file")
+	}
+	if conf.Key != "" {
+		d.Key = conf.Key
+	}
+	if conf.KeyFile != "" {
+		key, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read key file %v: %v", conf.KeyFile, err)
+		}
+		d.Key = string(key)
+	}
+	if conf.KeyPassphrase != "" {
+		d.KeyPassphrase = conf.KeyPassphrase
+	}
+	if conf.Agent != nil {
+		d.Agent = *conf.Agent
+	}
+	// Answers replace the inherited ones as a whole
+	if len(conf.KeyboardInteractive) > 0 {
+		d.KeyboardInteractive = nil
+		for _, answer := range conf.KeyboardInteractive {
+			d.KeyboardInteractive = append(d.KeyboardInteractive,
+				&KeyboardInteractiveAnswer{Prompt: sanitizeRegex(answer.Prompt), Answer: answer.Answer})
+		}
+	}
+	if len(conf.AuthOrder) > 0 {
+		d.AuthOrder = append([]string{}, conf.AuthOrder...)
+	}
+	return nil
+}
+
+// AuthMethods is the auth order if set or the default order of the methods
+// that have credentials
+func (d *DeviceCredentials) AuthMethods() []string {
+	if len(d.AuthOrder) > 0 {
+		return d.AuthOrder
+	}
+	methods := []string{}
+	for _, method := range DefaultAuthOrder {
+		switch method {
+		case AuthMethodPublicKey:
+			if d.Key == "" {
+				continue
+			}
+		case AuthMethodAgent:
+			if !d.Agent {
+				continue
+			}
+		case AuthMethodPassword:
+			if d.Pass == "" {
+				continue
+			}
+		case AuthMethodKeyboardInteractive:
+			if d.Pass == "" && len(d.KeyboardInteractive) == 0 {
+				continue
+			}
+		}
+		methods = append(methods, method)
+	}
+	// Nothing set is still an attempt with an empty password like always
+	if len(methods) == 0 {
+		methods = append(methods, AuthMethodPassword)
+	}
+	return methods
+}
+
+func (d *DeviceCredentials) Validate() []error {
+	errs := []error{}
+	if d.Key != "" {
+		if block, _ := pem.Decode([]byte(d.Key)); block == nil {
+			errs = append(errs, errors.New("Key is not PEM encoded"))
+		} else if x509.IsEncryptedPEMBlock(block) && d.KeyPassphrase == "" {
+			errs = append(errs, errors.New("Key is encrypted but there is no key passphrase"))
+		}
+	}
+	for _, answer := range d.KeyboardInteractive {
+		if _, err := regexp.Compile(answer.Prompt); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid keyboard interactive prompt regex '%v': %v", answer.Prompt, err))
+		}
+	}
+	seen := map[string]bool{}
+	for _, method := range d.AuthOrder {
+		switch method {
+		case AuthMethodPublicKey:
+			if d.Key == "" {
+				errs = append(errs, errors.New("Auth method public_key requires a key"))
+			}
+		case AuthMethodAgent, AuthMethodPassword, AuthMethodKeyboardInteractive:
+		default:
+			errs = append(errs, fmt.Errorf("Unrecognized auth method: %v", method))
+		}
+		if seen[method] {
+			errs = append(errs, fmt.Errorf("Auth method %v is in the auth order more than once", method))
+		}
+		seen[method] = true
+	}
+	return errs
+}
@@ -0,0 +1,63 @@
+package model_test
+
+import (
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"reflect"
+	"testing"
+)
+
+func TestDeviceCredentialsAuthMethods(t *testing.T) {
+	agent := true
+	tests := []struct {
+		conf     *config.DeviceCredentials
+		expected []string
+	}{
+		{&config.DeviceCredentials{User: "user"}, []string{"password"}},
+		{&config.DeviceCredentials{Pass: "pass"}, []string{"password", "keyboard_interactive"}},
+		{&config.DeviceCredentials{Pass: "pass", Agent: &agent}, []string{"agent", "password", "keyboard_interactive"}},
+		{
+			&config.DeviceCredentials{Key: "key",
+				KeyboardInteractive: []*config.KeyboardInteractiveAnswer{{Prompt: "Token", Answer: "1"}}},
+			[]string{"public_key", "keyboard_interactive"},
+		},
+		{&config.DeviceCredentials{Pass: "pass", AuthOrder: []string{"keyboard_interactive", "password"}},
+			[]string{"keyboard_interactive", "password"}},
+	}
+	for _, test := range tests {
+		creds := &model.DeviceCredentials{}
+		if err := creds.ApplyConfig(test.conf); err != nil {
+			t.Fatal(err)
+		}
+		if methods := creds.AuthMethods(); !reflect.DeepEqual(methods, test.expected) {
+			t.Errorf("For %+v expected %v, got %v", test.conf, test.expected, methods)
+		}
+	}
+}
+
+func TestDeviceCredentialsValidate(t *testing.T) {
+	creds := &model.DeviceCredentials{}
+	if err := creds.ApplyConfig(&config.DeviceCredentials{
+		Key:       "not a key",
+		AuthOrder: []string{"password", "certificate", "password"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	errs := creds.Validate()
+	expected := []string{
+		"Key is not PEM encoded",
+		"Unrecognized auth method: certificate",
+		"Auth method password is in the auth order more than once",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	for index, err := range errs {
+		if err.Error() != expected[index] {
+			t.Errorf("Expected error '%v', got '%v'", expected[index], err)
+		}
+	}
+	if err := creds.ApplyConfig(&config.DeviceCredentials{Key: "key", KeyFile: "key.pem"}); err == nil {
+		t.Fatal("Expected error for key and key file")
+	}
+}
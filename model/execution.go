@@ -4,4 +4,25 @@ type Execution struct {
 	Device    *Device `json:"device"`
 	Job       *Job    `json:"job"`
 	Timestamp int64   `json:"timestamp"`
+	// The lease must be given back on completion. If the deadline passes
+	// first, the execution may be given to another worker.
+	LeaseId       string `json:"lease_id,omitempty"`
+	LeaseDeadline int64  `json:"lease_deadline,omitempty"`
+	// Starts at 1 and increases each time a lease expires
+	Attempt int `json:"attempt,omitempty"`
+	// The host keys the device may have in authorized keys format, given by
+	// the controller for the known_hosts and tofu host key policies
+	HostKeys []string `json:"host_keys,omitempty"`
+	// Set when the controller could not read the host keys, which fails the
+	// execution for the host key instead of trusting whatever key is seen
+	HostKeysError string `json:"host_keys_error,omitempty"`
+}
+
+// ExecutionAttempt is one run of an execution by a worker. A worker retries a
+// failed run on its own per the job retry settings, unlike lease attempts.
+type ExecutionAttempt struct {
+	StartTimestamp int64  `json:"start_timestamp"`
+	EndTimestamp   int64  `json:"end_timestamp"`
+	Failure        string `json:"failure,omitempty"`
+	FailureClass   string `json:"failure_class,omitempty"`
 }
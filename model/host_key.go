@@ -0,0 +1,79 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"strings"
+)
+
+// How a worker verifies the SSH host key of a device
+const (
+	// Any host key is accepted
+	HostKeyPolicyNone = "none"
+	// The key must be for the device in the known hosts file
+	HostKeyPolicyKnownHosts = "known_hosts"
+	// The key must have one of the fingerprints
+	HostKeyPolicyFingerprint = "fingerprint"
+	// The first key seen is recorded by the controller and must match after
+	HostKeyPolicyTofu = "tofu"
+)
+
+type DeviceHostKey struct {
+	Policy string `json:"policy"`
+	// Read by the controller, not the worker
+	KnownHostsFile string `json:"known_hosts_file,omitempty"`
+	// SHA256 fingerprints like ssh-keygen shows
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+func NewDefaultDeviceHostKey() *DeviceHostKey {
+	return &DeviceHostKey{Policy: HostKeyPolicyNone}
+}
+
+func (d *DeviceHostKey) ApplyConfig(conf *config.DeviceHostKey) {
+	if conf.Policy != "" {
+		d.Policy = conf.Policy
+	}
+	if conf.KnownHostsFile != "" {
+		d.KnownHostsFile = conf.KnownHostsFile
+	}
+	if len(conf.Fingerprints) > 0 {
+		d.Fingerprints = append([]string{}, conf.Fingerprints...)
+	}
+}
+
+func (d *DeviceHostKey) Validate() []error {
+	errs := []error{}
+	switch d.Policy {
+	case HostKeyPolicyNone, HostKeyPolicyTofu:
+	case HostKeyPolicyKnownHosts:
+		if d.KnownHostsFile == "" {
+			errs = append(errs, errors.New("Known hosts file required for known_hosts policy"))
+		}
+	case HostKeyPolicyFingerprint:
+		if len(d.Fingerprints) == 0 {
+			errs = append(errs, errors.New("At least one fingerprint required for fingerprint policy"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Unrecognized host key policy: %v", d.Policy))
+	}
+	for _, fingerprint := range d.Fingerprints {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			errs = append(errs, fmt.Errorf("Fingerprint '%v' must start with SHA256:", fingerprint))
+		}
+	}
+	return errs
+}
+
+// KnownHostsName is how the device's host is named in known hosts files
+func (d *Device) KnownHostsName() string {
+	port := 22
+	if d.DeviceProtocol != nil && d.DeviceProtocol.SshDeviceProtocol != nil {
+		port = d.DeviceProtocol.SshDeviceProtocol.Port
+	}
+	if port == 22 {
+		return d.Host
+	}
+	return fmt.Sprintf("[%v]:%v", d.Host, port)
+}
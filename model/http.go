@@ -0,0 +1,144 @@
+package model
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"io/ioutil"
+	"strings"
+)
+
+type HttpDeviceProtocol struct {
+	Port int  `json:"port"`
+	Tls  bool `json:"tls"`
+	// Don't verify the device's certificate
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// PEM encoded certificates to verify with instead of the system ones, read
+	// from the CA file on the controller
+	CaCerts string `json:"ca_certs,omitempty"`
+}
+
+func NewDefaultHttpDeviceProtocol() *HttpDeviceProtocol {
+	return &HttpDeviceProtocol{Tls: true}
+}
+
+func (h *HttpDeviceProtocol) ApplyConfig(conf *config.DeviceProtocolHttp) error {
+	if conf.Port != 0 {
+		h.Port = conf.Port
+	}
+	if conf.Tls != nil {
+		h.Tls = *conf.Tls
+	}
+	h.InsecureSkipVerify = conf.InsecureSkipVerify
+	if conf.CaFile != "" {
+		certs, err := ioutil.ReadFile(conf.CaFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read CA file %v: %v", conf.CaFile, err)
+		}
+		h.CaCerts = string(certs)
+	}
+	return nil
+}
+
+// The port if set, otherwise the default for the scheme
+func (h *HttpDeviceProtocol) PortOrDefault() int {
+	if h.Port != 0 {
+		return h.Port
+	} else if h.Tls {
+		return 443
+	}
+	return 80
+}
+
+func (h *HttpDeviceProtocol) Validate() []error {
+	errs := []error{}
+	if h.CaCerts != "" {
+		if h.InsecureSkipVerify {
+			errs = append(errs, errors.New("Cannot have both insecure skip verify and CA file"))
+		} else if !h.Tls {
+			errs = append(errs, errors.New("CA certificates require TLS"))
+		} else if !x509.NewCertPool().AppendCertsFromPEM([]byte(h.CaCerts)) {
+			errs = append(errs, errors.New("No PEM encoded certificates in CA file"))
+		}
+	}
+	return errs
+}
+
+// HttpRequest is what an http job requests from the device. The response body
+// is the result.
+type HttpRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// Empty to expect any 2xx status
+	ExpectStatus []int `json:"expect_status,omitempty"`
+}
+
+func NewDefaultHttpRequest() *HttpRequest {
+	return &HttpRequest{Method: "GET", Path: "/", Headers: map[string]string{}}
+}
+
+func (h *HttpRequest) ApplyConfig(conf *config.Job) {
+	if conf.JobHttp == nil {
+		return
+	}
+	if conf.JobHttp.Method != "" {
+		h.Method = strings.ToUpper(conf.JobHttp.Method)
+	}
+	if conf.JobHttp.Path != "" {
+		h.Path = conf.JobHttp.Path
+	}
+	for key, value := range conf.JobHttp.Headers {
+		h.Headers[key] = value
+	}
+	if conf.JobHttp.Body != "" {
+		h.Body = conf.JobHttp.Body
+	}
+	if len(conf.JobHttp.ExpectStatus) > 0 {
+		h.ExpectStatus = append([]int{}, conf.JobHttp.ExpectStatus...)
+	}
+}
+
+func (h *HttpRequest) StatusExpected(status int) bool {
+	if len(h.ExpectStatus) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, expected := range h.ExpectStatus {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HttpRequest) Validate() []error {
+	errs := []error{}
+	if h.Method == "" || strings.ContainsAny(h.Method, " \t\r\n") {
+		errs = append(errs, fmt.Errorf("Invalid HTTP method: %v", h.Method))
+	}
+	if !strings.HasPrefix(h.Path, "/") {
+		errs = append(errs, fmt.Errorf("HTTP path '%v' must start with /", h.Path))
+	}
+	for _, status := range h.ExpectStatus {
+		if status < 100 || status > 599 {
+			errs = append(errs, fmt.Errorf("Invalid expected HTTP status: %v", status))
+		}
+	}
+	return errs
+}
+
+func (h *HttpRequest) DeepCopy() *HttpRequest {
+	ret := &HttpRequest{
+		Method:       h.Method,
+		Path:         h.Path,
+		Headers:      map[string]string{},
+		Body:         h.Body,
+		ExpectStatus: append([]int{}, h.ExpectStatus...),
+	}
+	for key, value := range h.Headers {
+		ret.Headers[key] = value
+	}
+	return ret
+}
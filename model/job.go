@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"gitlab.com/cretz/fusty/config"
+	"path"
 	"regexp"
 	"strings"
 )
@@ -12,9 +13,44 @@ type Job struct {
 	Name           string `json:"name"`
 	*CommandSet    `json:"command_set"`
 	*FileSet       `json:"file_set"`
+	*HttpRequest   `json:"http_request,omitempty"`
 	Schedule       `json:"-"`
 	Scrubbers      []*JobScrubber    `json:"scrubbers"`
 	TemplateValues map[string]string `json:"template_values"`
+	// Empty to use the data store's policy
+	CommitPolicy string `json:"commit_policy,omitempty"`
+	// Without a leading dot. Empty to derive it from the job.
+	FileExtension string `json:"file_extension,omitempty"`
+	// Nil if failed executions are not retried
+	Retry *JobRetry `json:"retry,omitempty"`
+	// Seconds the whole execution can take including retries. Zero means no
+	// limit.
+	Timeout int `json:"timeout,omitempty"`
+	// Regex matching the shell prompt. Empty to use the device's.
+	Prompt string `json:"prompt,omitempty"`
+	// Empty to use the device's
+	Pagers []*Pager `json:"pagers,omitempty"`
+	// Nil if command output is kept as is
+	Normalize *JobNormalize `json:"normalize,omitempty"`
+}
+
+const (
+	DefaultJobFileExtension = "txt"
+	// Commit every result even if nothing changed
+	CommitPolicyAlways = "always"
+	// Only commit results that changed something
+	CommitPolicyOnChange = "on_change"
+	// Only commit results that changed something or if it has been a day
+	CommitPolicyOnChangeWithHeartbeat = "on_change_with_heartbeat"
+)
+
+func ValidateCommitPolicy(policy string) error {
+	switch policy {
+	case "", CommitPolicyAlways, CommitPolicyOnChange, CommitPolicyOnChangeWithHeartbeat:
+		return nil
+	default:
+		return fmt.Errorf("Unrecognized commit policy: %v", policy)
+	}
 }
 
 func NewDefaultJob(name string) *Job {
@@ -27,6 +63,9 @@ func (j *Job) ApplyConfig(conf *config.Job) error {
 		if j.FileSet != nil {
 			return errors.New("Generic file set in job of type command")
 		}
+		if j.HttpRequest != nil {
+			return errors.New("Generic HTTP request in job of type command")
+		}
 		if j.CommandSet == nil {
 			j.CommandSet = NewDefaultCommandSet()
 		}
@@ -34,12 +73,25 @@ func (j *Job) ApplyConfig(conf *config.Job) error {
 		if j.CommandSet != nil {
 			return errors.New("Generic command set in job of type file")
 		}
+		if j.HttpRequest != nil {
+			return errors.New("Generic HTTP request in job of type file")
+		}
 		if j.FileSet == nil {
 			j.FileSet = NewDefaultFileSet()
 		}
+	} else if conf.Type == "http" {
+		if j.CommandSet != nil {
+			return errors.New("Generic command set in job of type http")
+		}
+		if j.FileSet != nil {
+			return errors.New("Generic file set in job of type http")
+		}
+		if j.HttpRequest == nil {
+			j.HttpRequest = NewDefaultHttpRequest()
+		}
 	} else if conf.Type == "" {
 		// Default to command set
-		if j.FileSet == nil && j.CommandSet == nil {
+		if j.FileSet == nil && j.CommandSet == nil && j.HttpRequest == nil {
 			j.CommandSet = NewDefaultCommandSet()
 		}
 	} else {
@@ -52,6 +104,9 @@ func (j *Job) ApplyConfig(conf *config.Job) error {
 	if j.FileSet != nil {
 		j.FileSet.ApplyConfig(conf)
 	}
+	if j.HttpRequest != nil {
+		j.HttpRequest.ApplyConfig(conf)
+	}
 	if conf.JobSchedule != nil {
 		if sched, err := NewScheduleFromConfig(conf.JobSchedule); err != nil {
 			return fmt.Errorf("Invalid schedule: %v", err)
@@ -65,6 +120,37 @@ func (j *Job) ApplyConfig(conf *config.Job) error {
 	for key, value := range conf.TemplateValues {
 		j.TemplateValues[key] = value
 	}
+	if conf.CommitPolicy != "" {
+		j.CommitPolicy = conf.CommitPolicy
+	}
+	if conf.FileExtension != "" {
+		j.FileExtension = strings.TrimPrefix(conf.FileExtension, ".")
+	}
+	if conf.JobNormalize != nil {
+		if j.Normalize == nil {
+			j.Normalize = NewDefaultJobNormalize()
+		}
+		j.Normalize.ApplyConfig(conf.JobNormalize)
+	}
+	if conf.JobRetry != nil {
+		if j.Retry == nil {
+			j.Retry = NewDefaultJobRetry()
+		}
+		j.Retry.ApplyConfig(conf.JobRetry)
+	}
+	if conf.Timeout != 0 {
+		j.Timeout = conf.Timeout
+	}
+	if conf.Prompt != "" {
+		j.Prompt = sanitizeRegex(conf.Prompt)
+	}
+	// Pagers replace the inherited ones as a whole
+	if len(conf.Pagers) > 0 {
+		j.Pagers = nil
+		for _, pager := range conf.Pagers {
+			j.Pagers = append(j.Pagers, NewPagerFromConfig(pager))
+		}
+	}
 	return nil
 }
 
@@ -81,6 +167,17 @@ func (j *Job) ApplyTemplateValues() {
 				}
 			}
 		}
+		if j.HttpRequest != nil {
+			j.HttpRequest.Path = strings.Replace(j.HttpRequest.Path, "{{"+key+"}}", value, -1)
+			j.HttpRequest.Body = strings.Replace(j.HttpRequest.Body, "{{"+key+"}}", value, -1)
+			for header, headerValue := range j.HttpRequest.Headers {
+				j.HttpRequest.Headers[header] = strings.Replace(headerValue, "{{"+key+"}}", value, -1)
+			}
+		}
+		j.Prompt = strings.Replace(j.Prompt, "{{"+key+"}}", value, -1)
+		if j.Normalize != nil {
+			j.Normalize.StripPromptLines = strings.Replace(j.Normalize.StripPromptLines, "{{"+key+"}}", value, -1)
+		}
 		for _, scrubber := range j.Scrubbers {
 			scrubber.Search = strings.Replace(scrubber.Search, "{{"+key+"}}", value, -1)
 			scrubber.Replace = strings.Replace(scrubber.Replace, "{{"+key+"}}", value, -1)
@@ -88,6 +185,32 @@ func (j *Job) ApplyTemplateValues() {
 	}
 }
 
+// The extension of the stored result. This is the configured one, or if every
+// fetched file has the same extension it is that, otherwise it is "txt".
+func (j *Job) Extension() string {
+	if j.FileExtension != "" {
+		return j.FileExtension
+	}
+	ext := ""
+	if j.FileSet != nil {
+		for index, file := range j.FileSet.Files {
+			name := file.Name
+			if file.Compression == "gzip" {
+				name = strings.TrimSuffix(name, ".gz")
+			}
+			fileExt := strings.TrimPrefix(path.Ext(name), ".")
+			if index > 0 && fileExt != ext {
+				return DefaultJobFileExtension
+			}
+			ext = fileExt
+		}
+	}
+	if ext == "" {
+		return DefaultJobFileExtension
+	}
+	return ext
+}
+
 func (j *Job) DeepCopy() *Job {
 	// github.com/mitchellh/copystructure was failing because it could not traverse the pointer
 	// so we have to do this ourselves.
@@ -96,6 +219,10 @@ func (j *Job) DeepCopy() *Job {
 		Name:           j.Name,
 		Schedule:       j.Schedule.DeepCopy(),
 		TemplateValues: map[string]string{},
+		CommitPolicy:   j.CommitPolicy,
+		FileExtension:  j.FileExtension,
+		Timeout:        j.Timeout,
+		Prompt:         j.Prompt,
 	}
 	if j.CommandSet != nil {
 		job.CommandSet = j.CommandSet.DeepCopy()
@@ -103,9 +230,21 @@ func (j *Job) DeepCopy() *Job {
 	if j.FileSet != nil {
 		job.FileSet = j.FileSet.DeepCopy()
 	}
+	if j.HttpRequest != nil {
+		job.HttpRequest = j.HttpRequest.DeepCopy()
+	}
+	if j.Retry != nil {
+		job.Retry = j.Retry.DeepCopy()
+	}
+	if j.Normalize != nil {
+		job.Normalize = j.Normalize.DeepCopy()
+	}
 	for _, scrubber := range j.Scrubbers {
 		job.Scrubbers = append(job.Scrubbers, scrubber.DeepCopy())
 	}
+	for _, pager := range j.Pagers {
+		job.Pagers = append(job.Pagers, pager.DeepCopy())
+	}
 	for key, value := range j.TemplateValues {
 		job.TemplateValues[key] = value
 	}
@@ -123,11 +262,40 @@ func (j *Job) Validate() []error {
 	if j.FileSet != nil {
 		errs = append(errs, j.FileSet.Validate()...)
 	}
+	if j.HttpRequest != nil {
+		errs = append(errs, j.HttpRequest.Validate()...)
+	}
 	for _, scrubber := range j.Scrubbers {
 		if err := scrubber.Validate(); err != nil {
 			errs = append(errs, fmt.Errorf("Scrubber validation failed: %v", err))
 		}
 	}
+	if err := ValidateCommitPolicy(j.CommitPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if strings.ContainsAny(j.FileExtension, "/\\") {
+		errs = append(errs, fmt.Errorf("Invalid file extension: %v", j.FileExtension))
+	}
+	if j.Retry != nil {
+		errs = append(errs, j.Retry.Validate()...)
+	}
+	if j.Normalize != nil {
+		errs = append(errs, j.Normalize.Validate()...)
+	}
+	if j.Timeout < 0 {
+		errs = append(errs, errors.New("Job timeout cannot be negative"))
+	}
+	// Like expectations, only validated once there are no replacers
+	if j.Prompt != "" && !strings.Contains(j.Prompt, "{{") {
+		if _, err := regexp.Compile(j.Prompt); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid prompt regex '%v': %v", j.Prompt, err))
+		}
+	}
+	for _, pager := range j.Pagers {
+		if err := pager.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return errs
 }
 
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"regexp"
+	"strings"
+)
+
+// JobNormalize is how command output is cleaned up by the worker before it is
+// scrubbed
+type JobNormalize struct {
+	// Remove the echo of each command
+	StripEcho bool `json:"strip_echo"`
+	// Regex for lines to remove. Empty to remove none.
+	StripPromptLines string `json:"strip_prompt_lines,omitempty"`
+	// Turn carriage returns before newlines into just newlines
+	NormalizeNewlines bool `json:"normalize_newlines"`
+	// Remove ANSI/VT100 escape sequences
+	StripAnsi bool `json:"strip_ansi"`
+}
+
+func NewDefaultJobNormalize() *JobNormalize {
+	return &JobNormalize{}
+}
+
+func (j *JobNormalize) ApplyConfig(conf *config.JobNormalize) {
+	if conf.StripEcho != nil {
+		j.StripEcho = *conf.StripEcho
+	}
+	if conf.StripPromptLines != "" {
+		j.StripPromptLines = sanitizeRegex(conf.StripPromptLines)
+	}
+	if conf.NormalizeNewlines != nil {
+		j.NormalizeNewlines = *conf.NormalizeNewlines
+	}
+	if conf.StripAnsi != nil {
+		j.StripAnsi = *conf.StripAnsi
+	}
+}
+
+func (j *JobNormalize) DeepCopy() *JobNormalize {
+	copied := *j
+	return &copied
+}
+
+func (j *JobNormalize) Validate() []error {
+	errs := []error{}
+	// Like expectations, only validated once there are no replacers
+	if j.StripPromptLines != "" && !strings.Contains(j.StripPromptLines, "{{") {
+		if _, err := regexp.Compile(j.StripPromptLines); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid prompt lines regex '%v': %v", j.StripPromptLines, err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"time"
+)
+
+const (
+	DefaultJobRetryMaxAttempts       = 3
+	DefaultJobRetryBackoffSeconds    = 30
+	DefaultJobRetryBackoffMaxSeconds = 300
+	// Retries all happen within the job's lease, so they are kept to a handful
+	MaxJobRetryAttempts = 10
+	// The classes of failure a job can be retried on
+	FailureClassConnect = "connect"
+	FailureClassAuth    = "auth"
+	FailureClassExpect  = "expect"
+	FailureClassScrub   = "scrub"
+	// The job timeout passed or the job was canceled. These are never retried.
+	FailureClassTimeout  = "timeout"
+	FailureClassCanceled = "canceled"
+	// The device's host key did not verify. This is never retried either.
+	FailureClassHostKey = "host_key"
+)
+
+// JobRetry is how a worker retries a failed execution before posting it
+type JobRetry struct {
+	// Including the first
+	MaxAttempts int `json:"max_attempts"`
+	// Doubles after each retry up to the max
+	BackoffSeconds    int `json:"backoff_seconds"`
+	BackoffMaxSeconds int `json:"backoff_max_seconds"`
+	// The failure classes that are retried
+	On []string `json:"on"`
+}
+
+func NewDefaultJobRetry() *JobRetry {
+	return &JobRetry{
+		MaxAttempts:       DefaultJobRetryMaxAttempts,
+		BackoffSeconds:    DefaultJobRetryBackoffSeconds,
+		BackoffMaxSeconds: DefaultJobRetryBackoffMaxSeconds,
+		// Auth and scrub failures are unlikely to go away on their own
+		On: []string{FailureClassConnect, FailureClassExpect},
+	}
+}
+
+func (j *JobRetry) ApplyConfig(conf *config.JobRetry) {
+	if conf.MaxAttempts != nil {
+		j.MaxAttempts = *conf.MaxAttempts
+	}
+	if conf.BackoffSeconds != nil {
+		j.BackoffSeconds = *conf.BackoffSeconds
+	}
+	if conf.BackoffMaxSeconds != nil {
+		j.BackoffMaxSeconds = *conf.BackoffMaxSeconds
+	}
+	if len(conf.On) > 0 {
+		j.On = append([]string{}, conf.On...)
+	}
+}
+
+func (j *JobRetry) DeepCopy() *JobRetry {
+	return &JobRetry{
+		MaxAttempts:       j.MaxAttempts,
+		BackoffSeconds:    j.BackoffSeconds,
+		BackoffMaxSeconds: j.BackoffMaxSeconds,
+		On:                append([]string{}, j.On...),
+	}
+}
+
+func (j *JobRetry) Validate() []error {
+	errs := []error{}
+	if j.MaxAttempts < 1 || j.MaxAttempts > MaxJobRetryAttempts {
+		errs = append(errs, fmt.Errorf("Retry max attempts must be between 1 and %v", MaxJobRetryAttempts))
+	}
+	if j.BackoffSeconds < 0 || j.BackoffMaxSeconds < 0 {
+		errs = append(errs, errors.New("Retry backoff seconds cannot be negative"))
+	}
+	for _, class := range j.On {
+		switch class {
+		case FailureClassConnect, FailureClassAuth, FailureClassExpect, FailureClassScrub:
+		default:
+			errs = append(errs, fmt.Errorf("Unrecognized retry failure class: %v", class))
+		}
+	}
+	return errs
+}
+
+// Whether another attempt is made after the given attempt failed with the
+// failure class
+func (j *JobRetry) Retryable(class string, attempt int) bool {
+	if class == "" || attempt >= j.MaxAttempts {
+		return false
+	}
+	for _, on := range j.On {
+		if on == class {
+			return true
+		}
+	}
+	return false
+}
+
+// How long to wait after the given failed attempt
+func (j *JobRetry) Backoff(attempt int) time.Duration {
+	backoff := time.Duration(j.BackoffSeconds) * time.Second
+	max := time.Duration(j.BackoffMaxSeconds) * time.Second
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// The most time spent waiting between all attempts
+func (j *JobRetry) TotalBackoff() time.Duration {
+	total := time.Duration(0)
+	for attempt := 1; attempt < j.MaxAttempts; attempt++ {
+		total += j.Backoff(attempt)
+	}
+	return total
+}
@@ -0,0 +1,68 @@
+package model_test
+
+import (
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"testing"
+	"time"
+)
+
+func TestJobRetry(t *testing.T) {
+	retry := model.NewDefaultJobRetry()
+	maxAttempts, backoff, backoffMax := 4, 10, 30
+	retry.ApplyConfig(&config.JobRetry{
+		MaxAttempts:       &maxAttempts,
+		BackoffSeconds:    &backoff,
+		BackoffMaxSeconds: &backoffMax,
+	})
+	if errs := retry.Validate(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+	tests := []struct {
+		class     string
+		attempt   int
+		retryable bool
+		backoff   time.Duration
+	}{
+		{model.FailureClassConnect, 1, true, 10 * time.Second},
+		{model.FailureClassExpect, 2, true, 20 * time.Second},
+		{model.FailureClassConnect, 3, true, 30 * time.Second},
+		{model.FailureClassConnect, 4, false, 30 * time.Second},
+		{model.FailureClassAuth, 1, false, 10 * time.Second},
+		{"", 1, false, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if retryable := retry.Retryable(test.class, test.attempt); retryable != test.retryable {
+			t.Errorf("Expected retryable %v for %v on attempt %v", test.retryable, test.class, test.attempt)
+		}
+		if backoff := retry.Backoff(test.attempt); backoff != test.backoff {
+			t.Errorf("Expected backoff %v on attempt %v, got %v", test.backoff, test.attempt, backoff)
+		}
+	}
+	if total := retry.TotalBackoff(); total != 60*time.Second {
+		t.Errorf("Expected total backoff of 60s, got %v", total)
+	}
+	retry.ApplyConfig(&config.JobRetry{On: []string{"unknown"}})
+	if errs := retry.Validate(); len(errs) != 1 || errs[0].Error() != "Unrecognized retry failure class: unknown" {
+		t.Fatalf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestJobRetryConfig(t *testing.T) {
+	zero, eleven := 0, 11
+	// Zero turns backoff off instead of using the default
+	retry := model.NewDefaultJobRetry()
+	retry.ApplyConfig(&config.JobRetry{BackoffSeconds: &zero})
+	if errs := retry.Validate(); len(errs) > 0 {
+		t.Fatalf("Unexpected errors: %v", errs)
+	} else if retry.MaxAttempts != model.DefaultJobRetryMaxAttempts || retry.TotalBackoff() != 0 {
+		t.Fatalf("Expected default attempts without backoff, got %+v", retry)
+	}
+	for _, maxAttempts := range []*int{&zero, &eleven} {
+		retry := model.NewDefaultJobRetry()
+		retry.ApplyConfig(&config.JobRetry{MaxAttempts: maxAttempts})
+		if errs := retry.Validate(); len(errs) != 1 || errs[0].Error() != "Retry max attempts must be between 1 and 10" {
+			t.Fatalf("Unexpected errors for %v max attempts: %v", *maxAttempts, errs)
+		}
+	}
+}
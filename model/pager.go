@@ -0,0 +1,45 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"regexp"
+)
+
+// Space is what most pagers take to show the next page
+const DefaultPagerSend = " "
+
+// Pager is a prompt in shell output asking for a keystroke to show more. The
+// prompt is removed from the output and the keystroke sent.
+type Pager struct {
+	// Not implicitly prefixed or suffixed like expectations since this is
+	// what is removed
+	Pattern string `json:"pattern"`
+	// Empty to only remove the match
+	Send string `json:"send"`
+}
+
+func NewPagerFromConfig(conf *config.Pager) *Pager {
+	pager := &Pager{Pattern: conf.Pattern, Send: DefaultPagerSend}
+	if conf.Send != nil {
+		pager.Send = *conf.Send
+	}
+	return pager
+}
+
+func (p *Pager) DeepCopy() *Pager {
+	return &Pager{Pattern: p.Pattern, Send: p.Send}
+}
+
+func (p *Pager) Validate() error {
+	if p.Pattern == "" {
+		return errors.New("Pager pattern required")
+	}
+	if exp, err := regexp.Compile(p.Pattern); err != nil {
+		return fmt.Errorf("Invalid pager regex '%v': %v", p.Pattern, err)
+	} else if exp.MatchString("") {
+		return fmt.Errorf("Pager regex '%v' cannot match empty output", p.Pattern)
+	}
+	return nil
+}
@@ -2,22 +2,52 @@ package model
 
 import (
 	"errors"
+	"fmt"
 	"github.com/gorhill/cronexpr"
 	"gitlab.com/cretz/fusty/config"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Schedule interface {
-	// Exclusive
+	// Exclusive. A zero time means there are no more runs.
 	Next(start time.Time) time.Time
 	DeepCopy() Schedule
 }
 
 func NewScheduleFromConfig(sched *config.JobSchedule) (Schedule, error) {
-	if sched.Cron == "" {
-		return nil, errors.New("Only cron supported currently")
+	// Exactly one of the formats must be present
+	formats := []string{}
+	if sched.Cron != "" {
+		formats = append(formats, "cron")
+	}
+	if sched.Duration != "" {
+		formats = append(formats, "duration")
+	}
+	if sched.Iso8601 != "" {
+		formats = append(formats, "iso_8601")
+	}
+	if sched.Fixed != 0 {
+		formats = append(formats, "fixed")
+	}
+	if len(formats) == 0 {
+		return nil, errors.New("One of cron, duration, iso_8601, or fixed required")
+	} else if len(formats) > 1 {
+		return nil, fmt.Errorf("Only one schedule format allowed, got: %v", strings.Join(formats, ", "))
+	}
+	switch formats[0] {
+	case "cron":
+		return NewCronSchedule(sched.Cron)
+	case "duration":
+		return NewDurationSchedule(sched.Duration)
+	case "iso_8601":
+		return NewIso8601Schedule(sched.Iso8601)
+	default:
+		return NewFixedSchedule(sched.Fixed)
 	}
-	return NewCronSchedule(sched.Cron)
 }
 
 type CronSchedule struct {
@@ -44,3 +74,196 @@ func (c *CronSchedule) DeepCopy() Schedule {
 	}
 	return ret
 }
+
+var durationScheduleUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// DurationSchedule runs on every multiple of the interval since the unix epoch
+type DurationSchedule struct {
+	originalString string
+	interval       time.Duration
+}
+
+func NewDurationSchedule(duration string) (*DurationSchedule, error) {
+	pieces := strings.Fields(duration)
+	if len(pieces) != 2 {
+		return nil, fmt.Errorf("Duration '%v' must be in the form of 'number timeunit'", duration)
+	}
+	amount, err := strconv.ParseInt(pieces[0], 10, 64)
+	if err != nil || amount <= 0 {
+		return nil, fmt.Errorf("Duration amount '%v' must be a positive whole number", pieces[0])
+	}
+	unit, ok := durationScheduleUnits[strings.TrimSuffix(strings.ToLower(pieces[1]), "s")]
+	if !ok {
+		return nil, fmt.Errorf("Unrecognized duration unit '%v', expecting seconds, minutes, hours, or days", pieces[1])
+	}
+	if amount > math.MaxInt64/int64(unit) {
+		return nil, fmt.Errorf("Duration amount '%v' must be a positive whole number of at most %v %v",
+			pieces[0], math.MaxInt64/int64(unit), pieces[1])
+	}
+	return &DurationSchedule{originalString: duration, interval: time.Duration(amount) * unit}, nil
+}
+
+func (d *DurationSchedule) Next(start time.Time) time.Time {
+	// Truncate is relative to the zero time, so we do our own math relative to the epoch
+	elapsed := start.UnixNano()
+	remainder := elapsed % int64(d.interval)
+	if remainder < 0 {
+		remainder += int64(d.interval)
+	}
+	return time.Unix(0, elapsed-remainder+int64(d.interval))
+}
+
+func (d *DurationSchedule) DeepCopy() Schedule {
+	return &DurationSchedule{originalString: d.originalString, interval: d.interval}
+}
+
+// Just a safeguard against looping forever on a strange period
+const iso8601MaxIteration = 100000
+
+var (
+	iso8601PeriodRegex = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+	iso8601TimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05Z0700", "20060102T150405Z0700", "2006-01-02T15:04Z07:00"}
+)
+
+// Iso8601Schedule is a repeating interval in the form of R[n]/start/period or
+// R[n]/start/end where the difference between start and end is the period.
+type Iso8601Schedule struct {
+	originalString string
+	// Negative means unbounded
+	repetitions int
+	start       time.Time
+	years       int
+	months      int
+	days        int
+	clock       time.Duration
+}
+
+func NewIso8601Schedule(interval string) (*Iso8601Schedule, error) {
+	pieces := strings.Split(interval, "/")
+	if len(pieces) != 3 || !strings.HasPrefix(pieces[0], "R") {
+		return nil, fmt.Errorf("ISO-8601 interval '%v' must be repeating in the form of R[n]/start/period", interval)
+	}
+	ret := &Iso8601Schedule{originalString: interval, repetitions: -1}
+	if count := strings.TrimPrefix(pieces[0], "R"); count != "" && count != "-1" {
+		if v, err := strconv.Atoi(count); err != nil || v < 1 {
+			return nil, fmt.Errorf("Invalid ISO-8601 repetition count '%v'", count)
+		} else {
+			ret.repetitions = v
+		}
+	}
+	start, err := parseIso8601Time(pieces[1])
+	if err != nil {
+		return nil, err
+	}
+	ret.start = start
+	if strings.HasPrefix(pieces[2], "P") {
+		if err := ret.parsePeriod(pieces[2]); err != nil {
+			return nil, err
+		}
+	} else if end, err := parseIso8601Time(pieces[2]); err != nil {
+		return nil, err
+	} else {
+		ret.clock = end.Sub(start)
+	}
+	if ret.years == 0 && ret.months == 0 && ret.days == 0 && ret.clock <= 0 {
+		return nil, fmt.Errorf("ISO-8601 interval '%v' must have a positive period", interval)
+	}
+	return ret, nil
+}
+
+// Fractions of a second are dropped since run times are tracked in whole
+// seconds and a run would never look completed otherwise
+func parseIso8601Time(str string) (time.Time, error) {
+	for _, layout := range iso8601TimeLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t.Truncate(time.Second), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unrecognized ISO-8601 date/time '%v'", str)
+}
+
+func (i *Iso8601Schedule) parsePeriod(period string) error {
+	matches := iso8601PeriodRegex.FindStringSubmatch(period)
+	if matches == nil || period == "P" || strings.HasSuffix(period, "T") {
+		return fmt.Errorf("Invalid ISO-8601 period '%v'", period)
+	}
+	values := make([]int, len(matches)-1)
+	for index, match := range matches[1:] {
+		if match != "" {
+			if v, err := strconv.Atoi(match); err != nil {
+				return fmt.Errorf("Invalid ISO-8601 period '%v': %v", period, err)
+			} else {
+				values[index] = v
+			}
+		}
+	}
+	i.years = values[0]
+	i.months = values[1]
+	i.days = values[2]*7 + values[3]
+	i.clock = time.Duration(values[4])*time.Hour + time.Duration(values[5])*time.Minute +
+		time.Duration(values[6])*time.Second
+	return nil
+}
+
+func (i *Iso8601Schedule) occurrence(index int) time.Time {
+	return i.start.AddDate(index*i.years, index*i.months, index*i.days).Add(time.Duration(index) * i.clock)
+}
+
+func (i *Iso8601Schedule) Next(start time.Time) time.Time {
+	index := 0
+	if start.After(i.start) {
+		// Jump close to the answer using a period that is never longer than the real one
+		approx := time.Duration(i.years)*365*24*time.Hour + time.Duration(i.months)*28*24*time.Hour +
+			time.Duration(i.days)*23*time.Hour + i.clock
+		if approx > 0 {
+			index = int(start.Sub(i.start) / approx)
+		}
+		// Since the approximate period is short, we may have overshot and need to back up
+		for index > 0 && i.occurrence(index).After(start) {
+			index--
+		}
+	}
+	for iter := 0; iter < iso8601MaxIteration; iter++ {
+		if i.repetitions >= 0 && index >= i.repetitions {
+			return time.Time{}
+		}
+		if next := i.occurrence(index); next.After(start) {
+			return next
+		}
+		index++
+	}
+	return time.Time{}
+}
+
+func (i *Iso8601Schedule) DeepCopy() Schedule {
+	ret := *i
+	return &ret
+}
+
+// FixedSchedule runs exactly once at a specific time
+type FixedSchedule struct {
+	at time.Time
+}
+
+func NewFixedSchedule(unix int64) (*FixedSchedule, error) {
+	if unix < 0 {
+		return nil, fmt.Errorf("Fixed time %v must not be negative", unix)
+	}
+	return &FixedSchedule{at: time.Unix(unix, 0)}, nil
+}
+
+func (f *FixedSchedule) Next(start time.Time) time.Time {
+	if f.at.After(start) {
+		return f.at
+	}
+	return time.Time{}
+}
+
+func (f *FixedSchedule) DeepCopy() Schedule {
+	return &FixedSchedule{at: f.at}
+}
@@ -0,0 +1,101 @@
+package model_test
+
+import (
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleFromConfigErrors(t *testing.T) {
+	tests := []struct {
+		conf     *config.JobSchedule
+		errorMsg string
+	}{
+		{&config.JobSchedule{}, "One of cron, duration, iso_8601, or fixed required"},
+		{&config.JobSchedule{Cron: "* * * * *", Fixed: 5}, "Only one schedule format allowed, got: cron, fixed"},
+		{&config.JobSchedule{Duration: "15"}, "must be in the form of 'number timeunit'"},
+		{&config.JobSchedule{Duration: "1.5 minutes"}, "must be a positive whole number"},
+		{&config.JobSchedule{Duration: "0 minutes"}, "must be a positive whole number"},
+		{&config.JobSchedule{Duration: "9999999999999 days"}, "must be a positive whole number of at most 106751 days"},
+		{&config.JobSchedule{Duration: "2 weeks"}, "Unrecognized duration unit 'weeks'"},
+		{&config.JobSchedule{Iso8601: "2015-01-01T00:00:00Z/PT1H"}, "must be repeating"},
+		{&config.JobSchedule{Iso8601: "RX/2015-01-01T00:00:00Z/PT1H"}, "Invalid ISO-8601 repetition count 'X'"},
+		{&config.JobSchedule{Iso8601: "R/yesterday/PT1H"}, "Unrecognized ISO-8601 date/time 'yesterday'"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/PT"}, "Invalid ISO-8601 period 'PT'"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/P1H"}, "Invalid ISO-8601 period 'P1H'"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/P0D"}, "must have a positive period"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/2014-01-01T00:00:00Z"}, "must have a positive period"},
+		{&config.JobSchedule{Fixed: -1}, "must not be negative"},
+	}
+	for _, test := range tests {
+		if _, err := model.NewScheduleFromConfig(test.conf); err == nil {
+			t.Errorf("Expected error for %+v", test.conf)
+		} else if !strings.Contains(err.Error(), test.errorMsg) {
+			t.Errorf("Expected error for %+v to contain '%v', got: %v", test.conf, test.errorMsg, err)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		conf     *config.JobSchedule
+		start    string
+		expected string
+	}{
+		// Durations are aligned to the epoch and exclusive of the start
+		{&config.JobSchedule{Duration: "15 minutes"}, "2015-06-01T10:07:00Z", "2015-06-01T10:15:00Z"},
+		{&config.JobSchedule{Duration: "15 minutes"}, "2015-06-01T10:15:00Z", "2015-06-01T10:30:00Z"},
+		{&config.JobSchedule{Duration: "1 minute"}, "2015-06-01T10:07:30Z", "2015-06-01T10:08:00Z"},
+		{&config.JobSchedule{Duration: "45 Seconds"}, "1970-01-01T00:01:00Z", "1970-01-01T00:01:30Z"},
+		{&config.JobSchedule{Duration: "7 days"}, "1970-01-05T00:00:00Z", "1970-01-08T00:00:00Z"},
+		{&config.JobSchedule{Duration: "3 hours"}, "2015-06-01T23:59:59Z", "2015-06-02T00:00:00Z"},
+		// Intervals start at the start date and repeat per period
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/PT1H"}, "2014-12-01T00:00:00Z", "2015-01-01T00:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/PT1H"}, "2015-01-01T00:00:00Z", "2015-01-01T01:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/PT1H30M"}, "2015-03-04T05:06:07Z", "2015-03-04T06:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-31T00:00:00Z/P1M"}, "2015-02-15T00:00:00Z", "2015-03-03T00:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T12:00:00Z/P1Y"}, "2019-06-01T00:00:00Z", "2020-01-01T12:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/P1W"}, "2015-01-01T00:00:01Z", "2015-01-08T00:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00Z/2015-01-01T00:10:00Z"},
+			"2015-01-01T00:15:00Z", "2015-01-01T00:20:00Z"},
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00-05:00/P1D"}, "2015-01-10T04:00:00Z", "2015-01-10T05:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R3/2015-01-01T00:00:00Z/P1D"}, "2015-01-02T12:00:00Z", "2015-01-03T00:00:00Z"},
+		// Runs are on whole seconds
+		{&config.JobSchedule{Iso8601: "R/2015-01-01T00:00:00.75Z/PT1H"}, "2015-01-01T00:00:00Z", "2015-01-01T01:00:00Z"},
+		{&config.JobSchedule{Iso8601: "R3/2015-01-01T00:00:00Z/P1D"}, "2015-01-03T00:00:00Z", ""},
+		// Fixed runs just once
+		{&config.JobSchedule{Fixed: 1433152800}, "2015-06-01T00:00:00Z", "2015-06-01T10:00:00Z"},
+		{&config.JobSchedule{Fixed: 1433152800}, "2015-06-01T10:00:00Z", ""},
+		// Cron still works
+		{&config.JobSchedule{Cron: "0 30 * * * * *"}, "2015-06-01T10:07:00Z", "2015-06-01T10:30:00Z"},
+	}
+	for _, test := range tests {
+		sched, err := model.NewScheduleFromConfig(test.conf)
+		if err != nil {
+			t.Errorf("Unexpected error for %+v: %v", test.conf, err)
+			continue
+		}
+		start := mustParseTime(t, test.start)
+		expected := time.Time{}
+		if test.expected != "" {
+			expected = mustParseTime(t, test.expected)
+		}
+		if actual := sched.Next(start); !actual.Equal(expected) {
+			t.Errorf("Schedule %+v from %v expected %v, got %v", test.conf, test.start, expected, actual.UTC())
+		}
+		// Copies have to behave the same
+		if actual := sched.DeepCopy().Next(start); !actual.Equal(expected) {
+			t.Errorf("Copied schedule %+v from %v expected %v, got %v", test.conf, test.start, expected, actual.UTC())
+		}
+	}
+}
+
+func mustParseTime(t *testing.T, str string) time.Time {
+	ret, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
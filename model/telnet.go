@@ -0,0 +1,52 @@
+package model
+
+import (
+	"fmt"
+	"gitlab.com/cretz/fusty/config"
+	"regexp"
+)
+
+const (
+	DefaultTelnetPort = 23
+	// The prompts most devices show, before being sanitized like expectations
+	DefaultTelnetLoginPrompt    = `(?i)(login|user ?name): ?$`
+	DefaultTelnetPasswordPrompt = `(?i)password: ?$`
+)
+
+type TelnetDeviceProtocol struct {
+	Port int `json:"port"`
+	// Regexes for the prompts to send the user and password after
+	LoginPrompt    string `json:"login_prompt"`
+	PasswordPrompt string `json:"password_prompt"`
+}
+
+func NewDefaultTelnetDeviceProtocol() *TelnetDeviceProtocol {
+	return &TelnetDeviceProtocol{
+		Port:           DefaultTelnetPort,
+		LoginPrompt:    sanitizeRegex(DefaultTelnetLoginPrompt),
+		PasswordPrompt: sanitizeRegex(DefaultTelnetPasswordPrompt),
+	}
+}
+
+func (t *TelnetDeviceProtocol) ApplyConfig(conf *config.DeviceProtocolTelnet) {
+	if conf.Port != 0 {
+		t.Port = conf.Port
+	}
+	if conf.LoginPrompt != "" {
+		t.LoginPrompt = sanitizeRegex(conf.LoginPrompt)
+	}
+	if conf.PasswordPrompt != "" {
+		t.PasswordPrompt = sanitizeRegex(conf.PasswordPrompt)
+	}
+}
+
+func (t *TelnetDeviceProtocol) Validate() []error {
+	errs := []error{}
+	if _, err := regexp.Compile(t.LoginPrompt); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid login prompt regex '%v': %v", t.LoginPrompt, err))
+	}
+	if _, err := regexp.Compile(t.PasswordPrompt); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid password prompt regex '%v': %v", t.PasswordPrompt, err))
+	}
+	return errs
+}
@@ -3,10 +3,11 @@ package worker
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"gitlab.com/cretz/fusty/model"
-	"io/ioutil"
+	"io"
 	"log"
 	"regexp"
 	"sort"
@@ -17,40 +18,163 @@ import (
 type result struct {
 	jobName        string
 	deviceName     string
+	leaseId        string
 	jobTimestamp   int64
 	startTimestamp int64
 	endTimestamp   int64
 	file           []byte // This can be nil/empty
-	failure        error
+	// If set, this writes the file as the result is posted instead of it being
+	// held in file. The end timestamp and any failure are set after it runs.
+	writeFile func(w io.Writer) error
+	failure   error
+	// Seen for the first time under the tofu host key policy
+	hostKey string
+	// The start of this attempt and the failed attempts before it
+	attemptStartTimestamp int64
+	previousAttempts      []*model.ExecutionAttempt
+}
+
+// classifiedFailure is a failure that may be retried per the job retry
+// settings
+type classifiedFailure struct {
+	class string
+	error
+}
+
+// Empty if the failure is not classified
+func failureClass(err error) string {
+	if classified, ok := err.(*classifiedFailure); ok {
+		return classified.class
+	}
+	return ""
 }
 
 var (
 	fileContentsHr string = strings.Repeat("-", 12)
 )
 
-func runExecution(execution *model.Execution) *result {
-	res := &result{
-		jobName:        execution.Job.Name,
-		deviceName:     execution.Device.Name,
-		jobTimestamp:   execution.Timestamp,
-		startTimestamp: time.Now().Unix(),
+// How long to wait for the prompt before the first command and after commands
+// without a timeout
+var promptTimeout = 30 * time.Second
+
+// Runs the execution, retrying failures per the job retry settings. The final
+// result is completed while the session is still open so files can be
+// streamed from it. Everything including the streaming stops when the context
+// is done.
+func runExecution(ctx context.Context, execution *model.Execution, complete func(res *result)) {
+	startTimestamp := time.Now().Unix()
+	previousAttempts := []*model.ExecutionAttempt{}
+	for attempt := 1; ; attempt++ {
+		res := &result{
+			jobName:               execution.Job.Name,
+			deviceName:            execution.Device.Name,
+			leaseId:               execution.LeaseId,
+			jobTimestamp:          execution.Timestamp,
+			startTimestamp:        startTimestamp,
+			attemptStartTimestamp: time.Now().Unix(),
+			previousAttempts:      previousAttempts,
+		}
+		retry := false
+		runAttempt(ctx, execution, res, func(res *result) {
+			// Streamed files have no failure yet so they are never retried
+			retry = execution.Job.Retry != nil && execution.Job.Retry.Retryable(failureClass(res.failure), attempt)
+			if !retry {
+				complete(res)
+			}
+		})
+		if !retry {
+			return
+		}
+		previousAttempts = append(previousAttempts, res.attempt())
+		backoff := execution.Job.Retry.Backoff(attempt)
+		if Verbose {
+			log.Printf("Attempt %v of job %v on device %v failed, retrying in %v: %v",
+				attempt, res.jobName, res.deviceName, backoff, res.failure)
+		}
+		// If the context is done first, the next attempt fails right away
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// The context for an execution which is done when the job timeout passes
+func executionContext(job *model.Job) (context.Context, context.CancelFunc) {
+	if job.Timeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(job.Timeout)*time.Second)
 	}
+	return context.WithCancel(context.Background())
+}
+
+// The failure for a done context. This replaces whatever failure the context
+// caused, like a closed connection.
+func contextFailure(ctx context.Context, job *model.Job) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &classifiedFailure{model.FailureClassTimeout, fmt.Errorf("Job timed out after %v seconds", job.Timeout)}
+	}
+	return &classifiedFailure{model.FailureClassCanceled, errors.New("Job canceled")}
+}
+
+func runAttempt(ctx context.Context, execution *model.Execution, res *result, complete func(res *result)) {
 	if Verbose {
 		log.Printf("Running execution: %v", res)
 	}
-	sess, err := newSession(execution.Device)
+	if ctx.Err() != nil {
+		res.endTimestamp = time.Now().Unix()
+		res.failure = contextFailure(ctx, execution.Job)
+		complete(res)
+		return
+	}
+	// Connecting without the keys could trust any key
+	if execution.HostKeysError != "" {
+		res.endTimestamp = time.Now().Unix()
+		res.failure = &classifiedFailure{model.FailureClassHostKey,
+			fmt.Errorf("Controller unable to get host keys - %v", execution.HostKeysError)}
+		complete(res)
+		return
+	}
+	sess, err := openSession(execution)
 	if err != nil {
 		res.endTimestamp = time.Now().Unix()
 		res.failure = fmt.Errorf("Unable to initiate session - %v", err)
-		return res
+		complete(res)
+		return
 	}
 	defer sess.close()
-	if err := sess.authenticate(execution.Device); err != nil {
+	err = sess.authenticate(ctx, execution.Device)
+	// Recorded even if authentication fails after the key was accepted
+	res.hostKey = sess.firstSeenHostKey()
+	if err != nil {
 		res.endTimestamp = time.Now().Unix()
-		res.failure = fmt.Errorf("Authentication failed - %v", err)
-		return res
+		if ctx.Err() != nil {
+			res.failure = contextFailure(ctx, execution.Job)
+		} else if failureClass(err) == model.FailureClassHostKey {
+			res.failure = err
+		} else if failureClass(err) == model.FailureClassConnect {
+			res.failure = &classifiedFailure{model.FailureClassConnect, fmt.Errorf("Connection failed - %v", err)}
+		} else {
+			res.failure = &classifiedFailure{model.FailureClassAuth, fmt.Errorf("Authentication failed - %v", err)}
+		}
+		complete(res)
+		return
+	}
+	// Scrubbers need the entire file, otherwise it is never held in memory
+	if execution.Job.FileSet != nil && len(execution.Job.Scrubbers) == 0 {
+		res.writeFile = func(w io.Writer) error {
+			err := writeFiles(sess, execution.Job, w)
+			if err != nil && ctx.Err() != nil {
+				err = contextFailure(ctx, execution.Job)
+			}
+			return err
+		}
+		complete(res)
+		return
+	}
+	res.file, res.failure = runJob(ctx, sess, execution.Job, execution.Device)
+	if res.failure != nil && ctx.Err() != nil {
+		res.failure = contextFailure(ctx, execution.Job)
 	}
-	res.file, res.failure = runJob(sess, execution.Job)
 
 	// We scrub no matter what but if there is failure we don't override failure.
 	// Note, if there is anything to scrub we completely remove what exists on
@@ -58,7 +182,7 @@ func runExecution(execution *model.Execution) *result {
 	if len(res.file) > 0 && len(execution.Job.Scrubbers) > 0 {
 		if clean, err := scrubBytes(res.file, execution.Job); err != nil {
 			if res.failure == nil {
-				res.failure = err
+				res.failure = &classifiedFailure{model.FailureClassScrub, err}
 			}
 			res.file = []byte{}
 		} else {
@@ -67,20 +191,65 @@ func runExecution(execution *model.Execution) *result {
 	}
 
 	res.endTimestamp = time.Now().Unix()
-	return res
+	complete(res)
 }
 
-func runJob(sess session, job *model.Job) ([]byte, error) {
+// This attempt, which must have ended
+func (r *result) attempt() *model.ExecutionAttempt {
+	attempt := &model.ExecutionAttempt{StartTimestamp: r.attemptStartTimestamp, EndTimestamp: r.endTimestamp}
+	if r.failure != nil {
+		attempt.Failure = r.failure.Error()
+		attempt.FailureClass = failureClass(r.failure)
+	}
+	return attempt
+}
+
+func runJob(ctx context.Context, sess session, job *model.Job, device *model.Device) ([]byte, error) {
 	if job.FileSet != nil {
 		return fetchFile(sess, job)
 	} else if job.CommandSet != nil {
-		return runCommands(sess, job)
+		return runCommands(ctx, sess, job, device)
+	} else if job.HttpRequest != nil {
+		if httpSess, ok := sess.(*httpSession); ok {
+			return httpSess.request(ctx, job.HttpRequest)
+		}
+		return nil, errors.New("Http jobs can only run on http devices")
 	} else {
-		return nil, errors.New("Unable to find file set or command set to run")
+		return nil, errors.New("Unable to find file set, command set, or http request to run")
 	}
 }
 
-func runCommands(sess session, job *model.Job) ([]byte, error) {
+// The job's prompt and pagers are used if set, otherwise the device's. The
+// output is normalized per the job whether or not there is an error.
+func runCommands(ctx context.Context, sess session, job *model.Job, device *model.Device) (output []byte, err error) {
+	// Where each command's output starts
+	commandStarts := []int{}
+	if job.Normalize != nil {
+		defer func() { output = normalizeOutput(job.Normalize, job.CommandSet.Commands, output, commandStarts) }()
+	}
+	promptRegex := job.Prompt
+	if promptRegex == "" {
+		promptRegex = device.Prompt
+	}
+	var prompt *regexp.Regexp
+	if promptRegex != "" {
+		var err error
+		if prompt, err = regexp.Compile(promptRegex); err != nil {
+			return nil, fmt.Errorf("Unable to compile prompt regex '%v': %v", promptRegex, err)
+		}
+	}
+	pagerConfs := job.Pagers
+	if len(pagerConfs) == 0 {
+		pagerConfs = device.Pagers
+	}
+	pagers := []*shellPager{}
+	for _, pager := range pagerConfs {
+		if expr, err := regexp.Compile(pager.Pattern); err != nil {
+			return nil, fmt.Errorf("Unable to compile pager regex '%v': %v", pager.Pattern, err)
+		} else {
+			pagers = append(pagers, &shellPager{expr: expr, send: pager.Send})
+		}
+	}
 	if Verbose {
 		log.Printf("Connecting to shell to run job %v", job.Name)
 	}
@@ -90,17 +259,31 @@ func runCommands(sess session, job *model.Job) ([]byte, error) {
 	}
 	defer shell.close()
 	buff := []byte{}
-	// Wait a second and clear output before first command
-	// TODO: this makes things a bit slow :-( ...maybe some kind of thing that knows when it's at the first prompt
-	time.Sleep(time.Second)
+	// Clear output before first command once the device is ready, which
+	// without a prompt is assumed to be after a second
+	if prompt == nil {
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return buff, err
+		}
+	} else if _, ready, err := readShellUntil(ctx, shell, pagers, promptTimeout, prompt.Match); err != nil {
+		return buff, err
+	} else if !ready {
+		return buff, &classifiedFailure{model.FailureClassExpect,
+			fmt.Errorf("Device never showed prompt matching %v", promptRegex)}
+	}
 	shell.bytesAndReset()
 	for _, cmd := range job.CommandSet.Commands {
 		if Verbose {
 			log.Printf("Running command '%v' for job %v", cmd.Command, job.Name)
 		}
 		// Clear out all pending output before running the command by reading everything in the buffer
-		// (but still hold on to it)
-		buff = append(buff, shell.bytesAndReset()...)
+		// (but still hold on to it). It may have pager prompts like any other output.
+		pending, _, err := answerPagers(shell, pagers, shell.bytesAndReset(), 0)
+		buff = append(buff, pending...)
+		if err != nil {
+			return buff, err
+		}
+		commandStarts = append(commandStarts, len(buff))
 		// Write the command
 		if _, err := shell.Write([]byte(cmd.Command)); err != nil {
 			return buff, fmt.Errorf("Error writing command '%v': %v", cmd.Command, err)
@@ -115,9 +298,13 @@ func runCommands(sess session, job *model.Job) ([]byte, error) {
 		}
 		// Due to how we don't store job state from job to job, we recompile the regex
 		// every command here knowing it is not too expensive in most cases. Here if the
-		// timeout is not zero we check the output once a second.
-		if cmd.Timeout == 0 {
-			continue
+		// timeout is not zero or there is a prompt we check the output as it arrives.
+		timeout := time.Duration(cmd.Timeout) * time.Second
+		if timeout == 0 {
+			if prompt == nil {
+				continue
+			}
+			timeout = promptTimeout
 		}
 		expectRegex := []*regexp.Regexp{}
 		expectNotRegex := []*regexp.Regexp{}
@@ -136,50 +323,161 @@ func runCommands(sess session, job *model.Job) ([]byte, error) {
 			}
 		}
 
-		matchSuccess := false
-		thisCommandBytes := []byte{}
 		if Verbose {
 			log.Printf("Reading log output for command '%v'", cmd.Command)
 		}
-	CommandLoop:
-		for i := 0; i < cmd.Timeout; i++ {
-			currBytes := shell.bytesAndReset()
-			thisCommandBytes = append(thisCommandBytes, currBytes...)
-			buff = append(buff, currBytes...)
-			if Verbose && len(thisCommandBytes) > 0 {
-				log.Printf("Current output for command '%v':\n----\n%v\n----", cmd.Command, string(thisCommandBytes))
+		// The command is done on any failure match, otherwise at the prompt if
+		// there is one or the first success match if not
+		notMatched := -1
+		thisCommandBytes, done, err := readShellUntil(ctx, shell, pagers, timeout, func(output []byte) bool {
+			if Verbose && len(output) > 0 {
+				log.Printf("Current output for command '%v':\n----\n%v\n----", cmd.Command, string(output))
 			}
-			// Check for failure expectations
 			for i, notExpr := range expectNotRegex {
-				if notExpr.Match(thisCommandBytes) {
-					if Verbose {
-						log.Printf("Matched unexpected pattern %v", cmd.Expect[i])
-					}
-					return buff, fmt.Errorf("Output of command '%v' matched failure pattern: %v",
-						cmd.Command, cmd.ExpectNot[i])
+				if notExpr.Match(output) {
+					notMatched = i
+					return true
 				}
 			}
-			// Now for success
-			for i, expr := range expectRegex {
-				if expr.Match(thisCommandBytes) {
-					if Verbose {
-						log.Printf("Matched expected pattern %v", cmd.Expect[i])
-					}
-					matchSuccess = true
-					break CommandLoop
-				}
+			if prompt != nil {
+				return prompt.Match(output)
+			}
+			return matchAnyRegex(expectRegex, output) != -1
+		})
+		buff = append(buff, thisCommandBytes...)
+		if err != nil {
+			return buff, err
+		}
+		if notMatched != -1 {
+			if Verbose {
+				log.Printf("Matched unexpected pattern %v", cmd.ExpectNot[notMatched])
+			}
+			return buff, &classifiedFailure{model.FailureClassExpect, fmt.Errorf(
+				"Output of command '%v' matched failure pattern: %v", cmd.Command, cmd.ExpectNot[notMatched])}
+		}
+		if len(expectRegex) > 0 {
+			matched := matchAnyRegex(expectRegex, thisCommandBytes)
+			if matched == -1 {
+				return buff, &classifiedFailure{model.FailureClassExpect,
+					fmt.Errorf("Output of command '%v' never matched expected pattern(s)", cmd.Command)}
+			}
+			if Verbose {
+				log.Printf("Matched expected pattern %v", cmd.Expect[matched])
 			}
-			// We go ahead and sleep the one second
-			time.Sleep(time.Second)
 		}
-		if len(expectRegex) > 0 && !matchSuccess {
-			return buff, fmt.Errorf("Output of command '%v' never matched expected pattern(s)", cmd.Command)
+		if prompt != nil && !done {
+			return buff, &classifiedFailure{model.FailureClassExpect,
+				fmt.Errorf("Output of command '%v' never returned to prompt", cmd.Command)}
 		}
 	}
 	return buff, nil
 }
 
+// shellPager is a compiled model.Pager
+type shellPager struct {
+	expr *regexp.Regexp
+	send string
+}
+
+// Reads shell output as it arrives until done is true for all of it or the
+// timeout passes. Pager prompts are answered and removed from the output as
+// they show. Returns the output and whether done was ever true.
+func readShellUntil(ctx context.Context, shell sessionShell, pagers []*shellPager, timeout time.Duration,
+	done func(output []byte) bool) ([]byte, bool, error) {
+	output, pagerFrom, err := answerPagers(shell, pagers, shell.bytesAndReset(), 0)
+	if err != nil {
+		return output, false, err
+	} else if done(output) {
+		return output, true, nil
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-shell.changed():
+			if curr := shell.bytesAndReset(); len(curr) > 0 {
+				if output, pagerFrom, err = answerPagers(shell, pagers, append(output, curr...), pagerFrom); err != nil {
+					return output, false, err
+				} else if done(output) {
+					return output, true, nil
+				}
+			}
+		case <-timer.C:
+			output, _, err = answerPagers(shell, pagers, append(output, shell.bytesAndReset()...), pagerFrom)
+			return output, err == nil && done(output), err
+		case <-ctx.Done():
+			return output, false, ctx.Err()
+		}
+	}
+}
+
+// Removes every pager prompt in the output after the index, earliest first,
+// and sends its keystroke. Returns the output and the index to look after
+// next time, which is the start of the last line since a prompt may not have
+// fully arrived yet.
+func answerPagers(shell sessionShell, pagers []*shellPager, output []byte, from int) ([]byte, int, error) {
+	for len(pagers) > 0 {
+		var found *shellPager
+		var loc []int
+		for _, pager := range pagers {
+			if pagerLoc := pager.expr.FindIndex(output[from:]); pagerLoc != nil && pagerLoc[1] > pagerLoc[0] &&
+				(loc == nil || pagerLoc[0] < loc[0]) {
+				found, loc = pager, pagerLoc
+			}
+		}
+		if found == nil {
+			break
+		}
+		if Verbose {
+			log.Printf("Answering pager prompt %q", output[from+loc[0]:from+loc[1]])
+		}
+		output = append(output[:from+loc[0]], output[from+loc[1]:]...)
+		from += loc[0]
+		if found.send != "" {
+			if _, err := shell.Write([]byte(found.send)); err != nil {
+				return output, from, fmt.Errorf("Error answering pager prompt: %v", err)
+			}
+		}
+	}
+	if index := bytes.LastIndexByte(output[from:], '\n'); index != -1 {
+		from += index + 1
+	}
+	return output, from, nil
+}
+
+// The index of the first regex that matches or -1
+func matchAnyRegex(exprs []*regexp.Regexp, output []byte) int {
+	for i, expr := range exprs {
+		if expr.Match(output) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Fails with the context error if the context is done first
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	select {
+	case <-time.After(duration):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func fetchFile(sess session, job *model.Job) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeFiles(sess, job, &buf); err != nil {
+		return nil, err
+	}
+	if Verbose {
+		log.Printf("Overall fetched:\n%v", string(buf.Bytes()))
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes each file as it is read
+func writeFiles(sess session, job *model.Job, w io.Writer) error {
 	// Just sftp files for now
 	// Get all the paths and sort in alphabetical order
 	paths := []string{}
@@ -190,43 +488,52 @@ func fetchFile(sess session, job *model.Job) ([]byte, error) {
 	}
 	sort.Strings(paths)
 	// Run for each, decompressing as needed
-	var buf bytes.Buffer
 	for i, path := range paths {
 		if Verbose {
 			log.Printf("Fetching file: %v", path)
 		}
 		// Any error is an error for all
-		fileBytes, err := sess.fetchFile(path)
-		if err != nil {
-			return nil, err
-		}
-		if pathsToFiles[path].Compression == "gzip" {
-			gzipReader, err := gzip.NewReader(bytes.NewReader(fileBytes))
-			if err != nil {
-				return nil, fmt.Errorf("Unable to begin decompressing file %v: %v", path, err)
-			}
-			defer gzipReader.Close()
-			fileBytes, err = ioutil.ReadAll(gzipReader)
-			if err != nil {
-				return nil, fmt.Errorf("Unable to decompress file %v: %v", path, err)
-			}
-		}
-		// If there are multiple files, we separate each section with the path
-		if len(paths) > 1 {
-			fileBytes = append([]byte(fileContentsHr+"\nFile: "+path+"\n"+fileContentsHr+"\n"), fileBytes...)
+		if err := writeFile(sess, path, pathsToFiles[path].Compression, len(paths) > 1, i > 0, w); err != nil {
+			return err
 		}
-		// Any one after the first must have a newline prepended
-		if i > 0 {
-			fileBytes = append([]byte("\n"), fileBytes...)
-		}
-		if _, err := buf.Write(fileBytes); err != nil {
-			return nil, fmt.Errorf("Error writing contents to buffer: %v", err)
+	}
+	return nil
+}
+
+func writeFile(sess session, path string, compression string, withHeader bool, withNewline bool, w io.Writer) error {
+	file, err := sess.fetchFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if compression == "gzip" {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("Unable to begin decompressing file %v: %v", path, err)
 		}
+		defer gzipReader.Close()
+		reader = gzipReader
 	}
-	if Verbose {
-		log.Printf("Overall fetched:\n%v", string(buf.Bytes()))
+	prefix := ""
+	// Any one after the first must have a newline prepended
+	if withNewline {
+		prefix = "\n"
 	}
-	return buf.Bytes(), nil
+	// If there are multiple files, we separate each section with the path
+	if withHeader {
+		prefix += fileContentsHr + "\nFile: " + path + "\n" + fileContentsHr + "\n"
+	}
+	if _, err := io.WriteString(w, prefix); err != nil {
+		return fmt.Errorf("Error writing contents: %v", err)
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		if compression == "gzip" {
+			return fmt.Errorf("Unable to decompress file %v: %v", path, err)
+		}
+		return fmt.Errorf("Unable to fetch file %v: %v", path, err)
+	}
+	return nil
 }
 
 func scrubBytes(dirty []byte, job *model.Job) ([]byte, error) {
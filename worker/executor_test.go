@@ -0,0 +1,340 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingSession never gets through authentication. Like a device that
+// accepts the connection but never answers, it blocks until the connection is
+// closed when the context is done.
+type blockingSession struct {
+	closed chan bool
+}
+
+func newBlockingSession() *blockingSession {
+	return &blockingSession{closed: make(chan bool)}
+}
+
+func (b *blockingSession) authenticate(ctx context.Context, device *model.Device) error {
+	go func() {
+		<-ctx.Done()
+		close(b.closed)
+	}()
+	<-b.closed
+	return errors.New("Connection closed")
+}
+
+func (b *blockingSession) close() error {
+	return nil
+}
+
+func (b *blockingSession) run(cmd string) ([]byte, error) {
+	return nil, errors.New("Not connected")
+}
+
+func (b *blockingSession) fetchFile(path string) (io.ReadCloser, error) {
+	return nil, errors.New("Not connected")
+}
+
+func (b *blockingSession) shell() (sessionShell, error) {
+	return nil, errors.New("Not connected")
+}
+
+func (b *blockingSession) firstSeenHostKey() string {
+	return ""
+}
+
+func TestRunExecutionTimeout(t *testing.T) {
+	defer func() { openSession = newSession }()
+	openSession = func(execution *model.Execution) (session, error) {
+		return newBlockingSession(), nil
+	}
+	job := model.NewDefaultJob("backup")
+	job.Timeout = 1
+	// Connection failures are retried, but never once the job times out
+	job.Retry = model.NewDefaultJobRetry()
+	execution := &model.Execution{Device: model.NewDefaultDevice("router"), Job: job}
+	ctx, cancel := executionContext(job)
+	defer cancel()
+	results := []*result{}
+	done := make(chan bool)
+	go func() {
+		runExecution(ctx, execution, func(res *result) { results = append(results, res) })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Execution never finished")
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected one result, got %v", len(results))
+	}
+	res := results[0]
+	if class := failureClass(res.failure); class != model.FailureClassTimeout || len(res.previousAttempts) != 0 {
+		t.Fatalf("Expected single timed out attempt, got class '%v' after %v attempt(s): %v",
+			class, len(res.previousAttempts), res.failure)
+	}
+}
+
+func TestRunExecutionHostKeysError(t *testing.T) {
+	defer func() { openSession = newSession }()
+	openSession = func(execution *model.Execution) (session, error) {
+		t.Fatal("Expected no session without host keys")
+		return nil, nil
+	}
+	execution := &model.Execution{
+		Device:        model.NewDefaultDevice("router"),
+		Job:           model.NewDefaultJob("backup"),
+		HostKeysError: "Unable to read tofu_known_hosts",
+	}
+	var res *result
+	runExecution(context.Background(), execution, func(completed *result) { res = completed })
+	if res == nil || failureClass(res.failure) != model.FailureClassHostKey {
+		t.Fatalf("Expected host key failure, got %+v", res)
+	}
+}
+
+// fakeShell is a device shell that writes the response to what it is sent as
+// its output
+type fakeShell struct {
+	out       *threadSafeByteBuffer
+	inputLock *sync.Mutex
+	input     []byte
+	respond   func(input string) string
+}
+
+func newFakeShell(initial string, respond func(input string) string) *fakeShell {
+	shell := &fakeShell{out: newThreadSafeByteBuffer(), inputLock: &sync.Mutex{}, respond: respond}
+	if initial != "" {
+		shell.out.Write([]byte(initial))
+	}
+	return shell
+}
+
+func (f *fakeShell) Write(p []byte) (int, error) {
+	f.inputLock.Lock()
+	f.input = append(f.input, p...)
+	f.inputLock.Unlock()
+	if f.respond != nil {
+		if response := f.respond(string(p)); response != "" {
+			f.out.Write([]byte(response))
+		}
+	}
+	return len(p), nil
+}
+
+func (f *fakeShell) sent() string {
+	f.inputLock.Lock()
+	defer f.inputLock.Unlock()
+	return string(f.input)
+}
+
+func (f *fakeShell) close() error {
+	return nil
+}
+
+func (f *fakeShell) bytesAndReset() []byte {
+	return f.out.bytesAndReset()
+}
+
+func (f *fakeShell) changed() <-chan bool {
+	return f.out.changedChan
+}
+
+// fakeShellSession only has the fake shell
+type fakeShellSession struct {
+	*blockingSession
+	fakeShell *fakeShell
+}
+
+func (f *fakeShellSession) shell() (sessionShell, error) {
+	return f.fakeShell, nil
+}
+
+func TestThreadSafeByteBufferChanged(t *testing.T) {
+	buff := newThreadSafeByteBuffer()
+	changed := func() bool {
+		select {
+		case <-buff.changedChan:
+			return true
+		default:
+			return false
+		}
+	}
+	if changed() {
+		t.Fatal("Expected no change before a write")
+	}
+	// Several writes before a read are one signal
+	buff.Write([]byte("a"))
+	buff.Write([]byte("b"))
+	if !changed() || changed() {
+		t.Fatal("Expected a single change for both writes")
+	}
+	if actual := string(buff.bytesAndReset()); actual != "ab" {
+		t.Fatalf("Expected ab, got %q", actual)
+	}
+	buff.unread([]byte("b"))
+	if !changed() {
+		t.Fatal("Expected a change after unread")
+	}
+	buff.unread(nil)
+	if changed() {
+		t.Fatal("Expected no change after unreading nothing")
+	}
+}
+
+func TestReadShellUntil(t *testing.T) {
+	prompt := regexp.MustCompile(`router#$`)
+	tests := []struct {
+		initial string
+		// Written a bit after reading starts
+		later    string
+		cancel   bool
+		expected string
+		found    bool
+		err      error
+	}{
+		{"banner\r\nrouter#", "", false, "banner\r\nrouter#", true, nil},
+		{"banner\r\n", "router#", false, "banner\r\nrouter#", true, nil},
+		{"banner\r\n", "more banner", false, "banner\r\nmore banner", false, nil},
+		{"", "", false, "", false, nil},
+		{"banner", "", true, "banner", false, context.Canceled},
+	}
+	for _, test := range tests {
+		shell := newFakeShell(test.initial, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			cancel()
+		}
+		if test.later != "" {
+			time.AfterFunc(50*time.Millisecond, func() { shell.out.Write([]byte(test.later)) })
+		}
+		output, found, err := readShellUntil(ctx, shell, nil, 200*time.Millisecond, prompt.Match)
+		cancel()
+		if string(output) != test.expected || found != test.found || err != test.err {
+			t.Errorf("For %q then %q expected %q, %v and %v, got %q, %v and %v",
+				test.initial, test.later, test.expected, test.found, test.err, output, found, err)
+		}
+	}
+}
+
+func TestRunCommandsPrompt(t *testing.T) {
+	defer func(timeout time.Duration) { promptTimeout = timeout }(promptTimeout)
+	promptTimeout = 200 * time.Millisecond
+	tests := []struct {
+		initial string
+		// Sent back on each enter
+		response string
+		timeout  int
+		expected string
+		failure  string
+	}{
+		// Commands without a timeout still wait for the prompt
+		{"router#", "config\r\nrouter#", 0, "config\r\nrouter#", ""},
+		{"router#", "config\r\nrouter#", 1, "config\r\nrouter#", ""},
+		{"banner", "", 0, "", "Device never showed prompt matching .*router#$"},
+		{"router#", "config\r\n", 0, "config\r\n", "Output of command 'show run' never returned to prompt"},
+		{"router#", "config\r\n", 1, "config\r\n", "Output of command 'show run' never returned to prompt"},
+	}
+	for _, test := range tests {
+		job := model.NewDefaultJob("backup")
+		if err := job.ApplyConfig(&config.Job{
+			Type:     "command",
+			Prompt:   "router#$",
+			Commands: []*config.JobCommand{&config.JobCommand{Command: "show run", Timeout: &test.timeout}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		response := test.response
+		shell := newFakeShell(test.initial, func(input string) string {
+			if input == "\n" {
+				return response
+			}
+			return ""
+		})
+		sess := &fakeShellSession{blockingSession: newBlockingSession(), fakeShell: shell}
+		output, err := runCommands(context.Background(), sess, job, model.NewDefaultDevice("router"))
+		failure := ""
+		if err != nil {
+			failure = err.Error()
+			if failureClass(err) != model.FailureClassExpect {
+				t.Errorf("Expected expect failure class for %q", failure)
+			}
+		}
+		if string(output) != test.expected || failure != test.failure {
+			t.Errorf("For %q with timeout %v expected %q with failure %q, got %q with failure %q",
+				test.response, test.timeout, test.expected, test.failure, output, failure)
+		}
+	}
+}
+
+func TestAnswerPagers(t *testing.T) {
+	more := &shellPager{expr: regexp.MustCompile(`--More--`), send: " "}
+	backspaces := &shellPager{expr: regexp.MustCompile("\x08+ *\x08*"), send: ""}
+	tests := []struct {
+		pagers []*shellPager
+		// Each is appended to the output before answering
+		reads    []string
+		expected string
+		sent     string
+	}{
+		{[]*shellPager{more}, []string{"line1\n--Mo", "re--line2\n"}, "line1\nline2\n", " "},
+		{[]*shellPager{more}, []string{"a\n--More--b\n--More--c\n--More--"}, "a\nb\nc\n", "   "},
+		{[]*shellPager{more, backspaces}, []string{"a\n--More--\x08\x08  \x08\x08b\n"}, "a\nb\n", " "},
+		{[]*shellPager{backspaces}, []string{"a\x08", "\x08 \x08b"}, "ab", ""},
+		{nil, []string{"a\n--More--"}, "a\n--More--", ""},
+	}
+	for _, test := range tests {
+		shell := newFakeShell("", nil)
+		output, from := []byte{}, 0
+		for _, read := range test.reads {
+			var err error
+			if output, from, err = answerPagers(shell, test.pagers, append(output, read...), from); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(output) != test.expected || shell.sent() != test.sent {
+			t.Errorf("For %q expected %q sending %q, got %q sending %q",
+				test.reads, test.expected, test.sent, output, shell.sent())
+		}
+	}
+}
+
+func TestRunCommandsPendingPagers(t *testing.T) {
+	zero := 0
+	job := model.NewDefaultJob("backup")
+	if err := job.ApplyConfig(&config.Job{
+		Type: "command",
+		Commands: []*config.JobCommand{
+			&config.JobCommand{Command: "show run", Timeout: &zero},
+			&config.JobCommand{Command: "show version", Timeout: &zero},
+			&config.JobCommand{Command: "exit", Timeout: &zero},
+		},
+		Pagers: []*config.Pager{&config.Pager{Pattern: "--More--"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The output of commands without a timeout is read before the next one
+	responses := map[string]string{"show run": "config\n--More--", " ": "more config\n", "show version": "1.0\n"}
+	shell := newFakeShell("", func(input string) string { return responses[input] })
+	sess := &fakeShellSession{blockingSession: newBlockingSession(), fakeShell: shell}
+	output, err := runCommands(context.Background(), sess, job, model.NewDefaultDevice("router"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "config\nmore config\n1.0\n"; string(output) != expected {
+		t.Fatalf("Expected %q, got %q", expected, output)
+	}
+	if expected := "show run\n show version\nexit\n"; shell.sent() != expected {
+		t.Fatalf("Expected to send %q, got %q", expected, shell.sent())
+	}
+}
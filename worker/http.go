@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/model"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The largest response body an http job accepts since it is held in memory
+var maxHttpResponseBytes int64 = 100 * 1024 * 1024
+
+// httpSession makes the request of an http job. There is nothing to
+// authenticate ahead of time, credentials are sent with the request.
+type httpSession struct {
+	device    *model.Device
+	client    *http.Client
+	transport *http.Transport
+}
+
+func (h *httpSession) authenticate(ctx context.Context, device *model.Device) error {
+	proto := device.DeviceProtocol.HttpDeviceProtocol
+	tlsConf := &tls.Config{InsecureSkipVerify: proto.InsecureSkipVerify}
+	if proto.CaCerts != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(proto.CaCerts)) {
+			return errors.New("Unable to add CA")
+		}
+		tlsConf.RootCAs = pool
+	}
+	h.device = device
+	h.transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConf}
+	h.client = &http.Client{Transport: h.transport}
+	return nil
+}
+
+func (h *httpSession) close() error {
+	if h.transport != nil {
+		h.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (h *httpSession) run(cmd string) ([]byte, error) {
+	return nil, errors.New("Commands cannot be run over http")
+}
+
+func (h *httpSession) fetchFile(path string) (io.ReadCloser, error) {
+	return nil, errors.New("Files cannot be fetched over http")
+}
+
+func (h *httpSession) shell() (sessionShell, error) {
+	return nil, errors.New("There is no shell over http")
+}
+
+func (h *httpSession) firstSeenHostKey() string {
+	return ""
+}
+
+// Returns the response body if the status is expected
+func (h *httpSession) request(ctx context.Context, req *model.HttpRequest) ([]byte, error) {
+	proto := h.device.DeviceProtocol.HttpDeviceProtocol
+	scheme := "http"
+	if proto.Tls {
+		scheme = "https"
+	}
+	url := scheme + "://" + net.JoinHostPort(h.device.Host, strconv.Itoa(proto.PortOrDefault())) + req.Path
+	httpReq, err := http.NewRequest(req.Method, url, strings.NewReader(req.Body))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid request: %v", err)
+	}
+	httpReq = httpReq.WithContext(ctx)
+	if creds := h.device.DeviceCredentials; creds != nil {
+		if creds.Token != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+creds.Token)
+		} else if creds.User != "" {
+			httpReq.SetBasicAuth(creds.User, creds.Pass)
+		}
+	}
+	// Headers can override the auth
+	for key, value := range req.Headers {
+		if strings.EqualFold(key, "Host") {
+			httpReq.Host = value
+		} else {
+			httpReq.Header.Set(key, value)
+		}
+	}
+	if Verbose {
+		log.Printf("Requesting %v %v", req.Method, url)
+	}
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return nil, &classifiedFailure{model.FailureClassConnect, fmt.Errorf("Request to %v failed: %v", url, err)}
+	}
+	defer resp.Body.Close()
+	// One byte past the max is read to know it was passed
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHttpResponseBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read response from %v: %v", url, err)
+	} else if int64(len(body)) > maxHttpResponseBytes {
+		return nil, &classifiedFailure{model.FailureClassExpect,
+			fmt.Errorf("Response from %v is larger than %v bytes", url, maxHttpResponseBytes)}
+	}
+	if !req.StatusExpected(resp.StatusCode) {
+		class := model.FailureClassExpect
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			class = model.FailureClassAuth
+		}
+		return nil, &classifiedFailure{class, fmt.Errorf("Unexpected status '%v' from %v", resp.Status, url)}
+	}
+	return body, nil
+}
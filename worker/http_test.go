@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"context"
+	"encoding/pem"
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHttpSessionRequest(t *testing.T) {
+	defer func(max int64) { maxHttpResponseBytes = max }(maxHttpResponseBytes)
+	maxHttpResponseBytes = 1024
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		switch {
+		case req.URL.Path == "/large":
+			w.Write([]byte(strings.Repeat("a", 1025)))
+		case req.URL.Path == "/missing":
+			http.NotFound(w, req)
+		case req.Header.Get("Authorization") != "Bearer mytoken":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.Write([]byte(req.Method + " " + req.URL.RequestURI() + " " + req.Header.Get("Accept") + " " + string(body)))
+		}
+	}))
+	defer server.Close()
+	// The device trusts the test server's certificate through a CA file
+	dir, err := ioutil.TempDir("", "fusty-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	newDevice := func(token string) *model.Device {
+		device := model.NewDefaultDevice("api")
+		if err := device.ApplyConfig(&config.Device{
+			Host: host,
+			DeviceProtocol: &config.DeviceProtocol{
+				Type:               "http",
+				DeviceProtocolHttp: &config.DeviceProtocolHttp{Port: port, CaFile: caFile},
+			},
+			DeviceCredentials: &config.DeviceCredentials{Token: token},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if errs := device.Validate(); len(errs) > 0 {
+			t.Fatalf("Unexpected errors: %v", errs)
+		}
+		return device
+	}
+	tests := []struct {
+		token    string
+		conf     *config.JobHttp
+		expected string
+		class    string
+	}{
+		{"mytoken", &config.JobHttp{Path: "/config?format=json", Headers: map[string]string{"Accept": "text/plain"}},
+			"GET /config?format=json text/plain ", ""},
+		{"mytoken", &config.JobHttp{Method: "post", Path: "/export", Body: "all"}, "POST /export  all", ""},
+		{"mytoken", &config.JobHttp{Path: "/missing"}, "", model.FailureClassExpect},
+		{"mytoken", &config.JobHttp{Path: "/missing", ExpectStatus: []int{404}}, "404 page not found\n", ""},
+		{"wrong", &config.JobHttp{Path: "/config"}, "", model.FailureClassAuth},
+		{"mytoken", &config.JobHttp{Path: "/large"}, "", model.FailureClassExpect},
+	}
+	for _, test := range tests {
+		job := model.NewDefaultJob("backup")
+		if err := job.ApplyConfig(&config.Job{Type: "http", JobHttp: test.conf}); err != nil {
+			t.Fatal(err)
+		}
+		device := newDevice(test.token)
+		sess, err := newSession(&model.Execution{Device: device, Job: job})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.authenticate(context.Background(), device); err != nil {
+			t.Fatal(err)
+		}
+		output, err := runJob(context.Background(), sess, job, device)
+		sess.close()
+		if string(output) != test.expected || failureClass(err) != test.class {
+			t.Errorf("For %+v expected %q with class '%v', got %q with error: %v",
+				test.conf, test.expected, test.class, output, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"bytes"
+	"gitlab.com/cretz/fusty/model"
+	"regexp"
+	"strings"
+)
+
+var (
+	// CSI sequences like colors and cursor movement, OSC sequences like window
+	// titles, and the two character escapes like charset selection
+	ansiRegex = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[@-Z\\-_]`)
+	// Any carriage returns before a newline
+	crlfRegex = regexp.MustCompile(`\r+\n`)
+)
+
+// Normalizes the output of each command on its own before removing prompt
+// lines from all of it. The command starts are the indexes in the output where
+// each command was sent and there may be fewer of them than commands if the job
+// stopped early.
+func normalizeOutput(normalize *model.JobNormalize, commands []*model.CommandSetCommand, output []byte,
+	commandStarts []int) []byte {
+	var promptLines *regexp.Regexp
+	if normalize.StripPromptLines != "" {
+		// Validated beforehand so this is just a safety net
+		if expr, err := regexp.Compile(normalize.StripPromptLines); err == nil {
+			promptLines = expr
+		}
+	}
+	normalized := []byte{}
+	for index := -1; index < len(commandStarts); index++ {
+		// The output before the first command has no echo
+		start, end := 0, len(output)
+		if index >= 0 {
+			start = commandStarts[index]
+		}
+		if index+1 < len(commandStarts) {
+			end = commandStarts[index+1]
+		}
+		segment := append([]byte{}, output[start:end]...)
+		if normalize.StripAnsi {
+			segment = ansiRegex.ReplaceAll(segment, nil)
+		}
+		if normalize.NormalizeNewlines {
+			segment = crlfRegex.ReplaceAll(segment, []byte("\n"))
+		}
+		if normalize.StripEcho && index >= 0 {
+			segment = stripEcho(segment, commands[index].Command)
+			// The prompt the command was typed after no longer has a line end
+			if len(segment) > 0 && len(normalized) > 0 && normalized[len(normalized)-1] != '\n' {
+				normalized = append(normalized, '\n')
+			}
+		}
+		normalized = append(normalized, segment...)
+	}
+	// Prompts are on the same line as the echo that follows them
+	if promptLines != nil {
+		normalized = stripLines(normalized, promptLines)
+	}
+	return normalized
+}
+
+// Removes the first line if it is just the command
+func stripEcho(segment []byte, command string) []byte {
+	line, rest := segment, []byte{}
+	if index := bytes.IndexByte(segment, '\n'); index != -1 {
+		line, rest = segment[:index], segment[index+1:]
+	}
+	if strings.TrimSpace(string(line)) == strings.TrimSpace(command) {
+		return rest
+	}
+	return segment
+}
+
+// Removes every line that matches, ignoring carriage returns at the end
+func stripLines(output []byte, expr *regexp.Regexp) []byte {
+	lines := bytes.SplitAfter(output, []byte("\n"))
+	kept := make([][]byte, 0, len(lines))
+	for _, line := range lines {
+		if len(line) == 0 || !expr.Match(bytes.TrimRight(line, "\r\n")) {
+			kept = append(kept, line)
+		}
+	}
+	return bytes.Join(kept, nil)
+}
@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"gitlab.com/cretz/fusty/model"
+	"testing"
+)
+
+func TestNormalizeOutput(t *testing.T) {
+	commands := []*model.CommandSetCommand{{Command: "terminal length 0"}, {Command: "show run"}}
+	output := "Welcome\r\nrouter#terminal length 0\r\nrouter#show run\r\n\x1b[1mBuilding\x1b[0m configuration\r\r\n" +
+		"hostname router\r\nrouter#"
+	// Where the commands were sent
+	commandStarts := []int{len("Welcome\r\nrouter#"), len("Welcome\r\nrouter#terminal length 0\r\nrouter#")}
+	tests := []struct {
+		normalize *model.JobNormalize
+		expected  string
+	}{
+		{&model.JobNormalize{}, output},
+		{&model.JobNormalize{StripAnsi: true, NormalizeNewlines: true},
+			"Welcome\nrouter#terminal length 0\nrouter#show run\nBuilding configuration\nhostname router\nrouter#"},
+		{&model.JobNormalize{StripEcho: true, StripAnsi: true, NormalizeNewlines: true},
+			"Welcome\nrouter#\nrouter#\nBuilding configuration\nhostname router\nrouter#"},
+		{&model.JobNormalize{StripEcho: true, StripAnsi: true, NormalizeNewlines: true, StripPromptLines: "^router#"},
+			"Welcome\nBuilding configuration\nhostname router\n"},
+		// Carriage returns are ignored when matching lines
+		{&model.JobNormalize{StripPromptLines: "^router#.*$"}, "Welcome\r\n\x1b[1mBuilding\x1b[0m configuration\r\r\n" +
+			"hostname router\r\n"},
+	}
+	for _, test := range tests {
+		if actual := string(normalizeOutput(test.normalize, commands, []byte(output), commandStarts)); actual != test.expected {
+			t.Errorf("For %+v expected %q, got %q", test.normalize, test.expected, actual)
+		}
+	}
+	// Stopping before every command is sent still normalizes what is there
+	if actual := string(normalizeOutput(&model.JobNormalize{StripEcho: true, NormalizeNewlines: true}, commands,
+		[]byte("router#terminal length 0\r\n"), []int{len("router#")})); actual != "router#" {
+		t.Errorf("Unexpected output for early stop: %q", actual)
+	}
+}
@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"gitlab.com/cretz/fusty/model"
@@ -12,14 +13,15 @@ import (
 	"github.com/ScriptRock/crypto/ssh"
 	"github.com/ScriptRock/sftp"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"strconv"
 	"sync"
 )
 
 type session interface {
-	authenticate(device *model.Device) error
+	// Everything on the session fails once the context is done
+	authenticate(ctx context.Context, device *model.Device) error
 
 	// Should be called even on auth failure
 	close() error
@@ -27,33 +29,72 @@ type session interface {
 	// Note, both bytes and error can be set
 	run(cmd string) ([]byte, error)
 
-	fetchFile(path string) ([]byte, error)
+	// The file is read as it streams and must be closed
+	fetchFile(path string) (io.ReadCloser, error)
 
 	shell() (sessionShell, error)
+
+	// The host key to record for trust on first use after authenticating, or
+	// empty if there is none
+	firstSeenHostKey() string
 }
 
 type sessionShell interface {
 	io.Writer
 	close() error
 	bytesAndReset() []byte
+	// Signaled when there is output that has not been read. A signal may be
+	// for output that has since been read.
+	changed() <-chan bool
 }
 
-func newSession(device *model.Device) (session, error) {
-	if device.DeviceProtocol.SshDeviceProtocol == nil {
-		return nil, errors.New("Unable to find SSH settings")
+// How sessions are created for executions, replaced in tests
+var openSession = newSession
+
+func newSession(execution *model.Execution) (session, error) {
+	switch execution.Device.DeviceProtocol.Type {
+	case "telnet":
+		if execution.Device.DeviceProtocol.TelnetDeviceProtocol == nil {
+			return nil, errors.New("Unable to find telnet settings")
+		}
+		return &telnetSession{}, nil
+	case "http":
+		if execution.Device.DeviceProtocol.HttpDeviceProtocol == nil {
+			return nil, errors.New("Unable to find http settings")
+		}
+		return &httpSession{}, nil
+	default:
+		if execution.Device.DeviceProtocol.SshDeviceProtocol == nil {
+			return nil, errors.New("Unable to find SSH settings")
+		}
+		return &sshSession{hostKeys: execution.HostKeys}, nil
 	}
-	return &sshSession{}, nil
 }
 
 type sshSession struct {
 	device *model.Device
 	client *ssh.Client
+	// Closed when the session is
+	closed chan bool
+	// From the controller for the known_hosts and tofu policies
+	hostKeys []string
+	// Set by host key verification
+	hostKeyFailure error
+	seenHostKey    string
 }
 
-func (s *sshSession) authenticate(device *model.Device) error {
+func (s *sshSession) authenticate(ctx context.Context, device *model.Device) error {
+	auth, agentConn, err := sshAuthMethods(device.DeviceCredentials)
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+	if err != nil {
+		return err
+	}
 	sshConf := &ssh.ClientConfig{
-		User: device.DeviceCredentials.User,
-		Auth: []ssh.AuthMethod{ssh.Password(device.DeviceCredentials.Pass)},
+		User:            device.DeviceCredentials.User,
+		Auth:            auth,
+		HostKeyCallback: s.verifyHostKey(device),
 	}
 	if device.DeviceProtocol.SshDeviceProtocol.IncludeCbcCiphers {
 		sshConf.Config = ssh.Config{Ciphers: ssh.AllSupportedCiphers()}
@@ -63,16 +104,39 @@ func (s *sshSession) authenticate(device *model.Device) error {
 	if Verbose {
 		log.Printf("Starting SSH session on %v for user %v", hostPort, device.DeviceCredentials.User)
 	}
-	client, err := ssh.Dial("tcp", hostPort, sshConf)
+	// Dialed separately so connection failures can be told apart
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return &classifiedFailure{model.FailureClassConnect, fmt.Errorf("Unable to connect to %v: %v", hostPort, err)}
+	}
+	// Closing the connection is what stops any SSH, shell or SFTP call that
+	// is waiting on it
+	s.closed = make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-s.closed:
+		}
+	}()
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, hostPort, sshConf)
 	if err != nil {
+		conn.Close()
+		if s.hostKeyFailure != nil {
+			return &classifiedFailure{model.FailureClassHostKey,
+				fmt.Errorf("Host key verification failed for %v - %v", hostPort, s.hostKeyFailure)}
+		}
 		return fmt.Errorf("Unable to connect to %v: %v", hostPort, err)
 	}
 	s.device = device
-	s.client = client
+	s.client = ssh.NewClient(clientConn, chans, reqs)
 	return nil
 }
 
 func (s *sshSession) close() error {
+	if s.closed != nil {
+		close(s.closed)
+	}
 	if s.client != nil {
 		return s.client.Close()
 	}
@@ -91,21 +155,41 @@ func (s *sshSession) run(cmd string) ([]byte, error) {
 	return session.CombinedOutput(cmd)
 }
 
-func (s *sshSession) fetchFile(path string) ([]byte, error) {
+func (s *sshSession) fetchFile(path string) (io.ReadCloser, error) {
 	client, err := sftp.NewClient(s.client)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect to SFTP on %v: %v", s.device.Host, err)
 	}
-	defer client.Close()
 	file, err := client.Open(path)
 	if err != nil {
+		client.Close()
 		return nil, fmt.Errorf("Unable to open %v via SFTP on %v: %v", path, s.device.Host, err)
 	}
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read %v via SFTP on %v: %v", path, s.device.Host, err)
+	return &sftpFile{file: file, client: client, path: path, host: s.device.Host}, nil
+}
+
+// sftpFile closes its SFTP client when closed
+type sftpFile struct {
+	file   *sftp.File
+	client *sftp.Client
+	path   string
+	host   string
+}
+
+func (s *sftpFile) Read(p []byte) (int, error) {
+	n, err := s.file.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("Unable to read %v via SFTP on %v: %v", s.path, s.host, err)
 	}
-	return bytes, nil
+	return n, err
+}
+
+func (s *sftpFile) Close() error {
+	err := s.file.Close()
+	if clientErr := s.client.Close(); err == nil {
+		err = clientErr
+	}
+	return err
 }
 
 func (s *sshSession) shell() (sessionShell, error) {
@@ -156,28 +240,58 @@ func (s *sshSessionShell) bytesAndReset() []byte {
 	return s.stdOutAndErrBuff.bytesAndReset()
 }
 
+func (s *sshSessionShell) changed() <-chan bool {
+	return s.stdOutAndErrBuff.changedChan
+}
+
 type threadSafeByteBuffer struct {
-	buff *bytes.Buffer
-	lock *sync.Mutex
+	buff        *bytes.Buffer
+	lock        *sync.Mutex
+	changedChan chan bool
 }
 
 func newThreadSafeByteBuffer() *threadSafeByteBuffer {
 	return &threadSafeByteBuffer{
-		buff: &bytes.Buffer{},
-		lock: &sync.Mutex{},
+		buff:        &bytes.Buffer{},
+		lock:        &sync.Mutex{},
+		changedChan: make(chan bool, 1),
 	}
 }
 
 func (t *threadSafeByteBuffer) Write(p []byte) (n int, err error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	return t.buff.Write(p)
+	n, err = t.buff.Write(p)
+	// Non-blocking since a signal already waiting covers this write too
+	select {
+	case t.changedChan <- true:
+	default:
+	}
+	return
+}
+
+// Puts output back in front of anything written since it was read
+func (t *threadSafeByteBuffer) unread(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rest := append([]byte{}, t.buff.Bytes()...)
+	t.buff.Reset()
+	t.buff.Write(p)
+	t.buff.Write(rest)
+	select {
+	case t.changedChan <- true:
+	default:
+	}
 }
 
 func (t *threadSafeByteBuffer) bytesAndReset() []byte {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	// We want this to run first
-	defer t.buff.Reset()
-	return t.buff.Bytes()
+	// Copied since the buffer is reused by the next write
+	ret := append([]byte{}, t.buff.Bytes()...)
+	t.buff.Reset()
+	return ret
 }
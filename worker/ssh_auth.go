@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/ScriptRock/crypto/ssh"
+	"github.com/ScriptRock/crypto/ssh/agent"
+	"gitlab.com/cretz/fusty/model"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+)
+
+// Builds the SSH auth methods in the order of the credentials. The returned
+// closer, if any, must be closed once authentication is done.
+func sshAuthMethods(creds *model.DeviceCredentials) ([]ssh.AuthMethod, io.Closer, error) {
+	methods := []ssh.AuthMethod{}
+	var agentConn io.Closer
+	for _, method := range creds.AuthMethods() {
+		switch method {
+		case model.AuthMethodPublicKey:
+			signer, err := parsePrivateKey(creds.Key, creds.KeyPassphrase)
+			if err != nil {
+				return nil, agentConn, err
+			}
+			methods = append(methods, ssh.PublicKeys(signer))
+		case model.AuthMethodAgent:
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				// Other methods may still work
+				if Verbose {
+					log.Printf("Skipping SSH agent auth since SSH_AUTH_SOCK is not set")
+				}
+				continue
+			}
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				return nil, agentConn, fmt.Errorf("Unable to connect to SSH agent: %v", err)
+			}
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		case model.AuthMethodPassword:
+			methods = append(methods, ssh.Password(creds.Pass))
+		case model.AuthMethodKeyboardInteractive:
+			challenge, err := keyboardInteractiveChallenge(creds)
+			if err != nil {
+				return nil, agentConn, err
+			}
+			methods = append(methods, ssh.KeyboardInteractive(challenge))
+		default:
+			return nil, agentConn, fmt.Errorf("Unrecognized auth method: %v", method)
+		}
+	}
+	return methods, agentConn, nil
+}
+
+// The vendored SSH package can't decrypt keys so we do it for it
+func parsePrivateKey(key string, passphrase string) (ssh.Signer, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("Key is not PEM encoded")
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		decrypted, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt key: %v", err)
+		}
+		block = &pem.Block{Type: block.Type, Bytes: decrypted}
+	}
+	signer, err := ssh.ParsePrivateKey(pem.EncodeToMemory(block))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse key: %v", err)
+	}
+	return signer, nil
+}
+
+func keyboardInteractiveChallenge(creds *model.DeviceCredentials) (ssh.KeyboardInteractiveChallenge, error) {
+	prompts := make([]*regexp.Regexp, len(creds.KeyboardInteractive))
+	for index, answer := range creds.KeyboardInteractive {
+		expr, err := regexp.Compile(answer.Prompt)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid keyboard interactive prompt regex '%v': %v", answer.Prompt, err)
+		}
+		prompts[index] = expr
+	}
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for index, question := range questions {
+			answered := false
+			for promptIndex, prompt := range prompts {
+				if prompt.MatchString(question) {
+					answers[index] = creds.KeyboardInteractive[promptIndex].Answer
+					answered = true
+					break
+				}
+			}
+			// Hidden questions are almost always for the password
+			if !answered && !echos[index] && creds.Pass != "" {
+				answers[index] = creds.Pass
+				answered = true
+			}
+			if !answered {
+				return nil, fmt.Errorf("No keyboard interactive answer for question '%v'", question)
+			}
+		}
+		return answers, nil
+	}, nil
+}
@@ -0,0 +1,61 @@
+package worker
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"gitlab.com/cretz/fusty/model"
+	"testing"
+)
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	encryptedBlock, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key),
+		[]byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := pem.EncodeToMemory(encryptedBlock)
+	tests := []struct {
+		key        string
+		passphrase string
+		valid      bool
+	}{
+		{string(plain), "", true},
+		{string(encrypted), "secret", true},
+		{string(encrypted), "wrong", false},
+		{"not a key", "", false},
+	}
+	for _, test := range tests {
+		if _, err := parsePrivateKey(test.key, test.passphrase); (err == nil) != test.valid {
+			t.Errorf("Expected valid %v with passphrase '%v', got error: %v", test.valid, test.passphrase, err)
+		}
+	}
+}
+
+func TestKeyboardInteractiveChallenge(t *testing.T) {
+	creds := &model.DeviceCredentials{
+		Pass:                "mypass",
+		KeyboardInteractive: []*model.KeyboardInteractiveAnswer{{Prompt: ".*Token.*", Answer: "123456"}},
+	}
+	challenge, err := keyboardInteractiveChallenge(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := challenge("user", "", []string{"Password: ", "Token: "}, []bool{false, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 2 || answers[0] != "mypass" || answers[1] != "123456" {
+		t.Fatalf("Unexpected answers: %v", answers)
+	}
+	// Echoed questions are never given the password
+	if _, err := challenge("user", "", []string{"Username: "}, []bool{true}); err == nil {
+		t.Fatal("Expected error for unanswered question")
+	}
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ScriptRock/crypto/ssh"
+	"gitlab.com/cretz/fusty/model"
+	"net"
+	"strings"
+)
+
+// Verifies the host key per the device's policy. The failure is kept on the
+// session since the handshake error it causes doesn't say why.
+func (s *sshSession) verifyHostKey(device *model.Device) func(string, net.Addr, ssh.PublicKey) error {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		s.hostKeyFailure = checkHostKey(device.HostKey, s.hostKeys, key)
+		if s.hostKeyFailure == nil && device.HostKey != nil && device.HostKey.Policy == model.HostKeyPolicyTofu &&
+			len(s.hostKeys) == 0 {
+			s.seenHostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		}
+		return s.hostKeyFailure
+	}
+}
+
+func (s *sshSession) firstSeenHostKey() string {
+	return s.seenHostKey
+}
+
+// Known keys are in authorized keys format
+func checkHostKey(hostKey *model.DeviceHostKey, knownKeys []string, key ssh.PublicKey) error {
+	if hostKey == nil {
+		return nil
+	}
+	fingerprint := hostKeyFingerprint(key)
+	switch hostKey.Policy {
+	case model.HostKeyPolicyFingerprint:
+		for _, pinned := range hostKey.Fingerprints {
+			// Padding is optional
+			if strings.TrimRight(pinned, "=") == fingerprint {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v key with fingerprint %v is not pinned", key.Type(), fingerprint)
+	case model.HostKeyPolicyKnownHosts, model.HostKeyPolicyTofu:
+		if len(knownKeys) == 0 {
+			if hostKey.Policy == model.HostKeyPolicyTofu {
+				return nil
+			}
+			return errors.New("No known host keys for device")
+		}
+		for _, known := range knownKeys {
+			if knownKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(known)); err == nil &&
+				bytes.Equal(knownKey.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v key with fingerprint %v does not match the known host keys", key.Type(), fingerprint)
+	default:
+		return nil
+	}
+}
+
+// Same as ssh-keygen shows
+func hostKeyFingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
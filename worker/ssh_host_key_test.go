@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/ScriptRock/crypto/ssh"
+	"gitlab.com/cretz/fusty/model"
+	"strings"
+	"testing"
+)
+
+func TestCheckHostKey(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		private, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ssh.NewPublicKey(&private.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key, otherKey := newKey(), newKey()
+	known := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	other := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(otherKey)))
+	tests := []struct {
+		hostKey   *model.DeviceHostKey
+		knownKeys []string
+		valid     bool
+	}{
+		{nil, nil, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyNone}, nil, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyFingerprint, Fingerprints: []string{hostKeyFingerprint(key)}},
+			nil, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyFingerprint, Fingerprints: []string{hostKeyFingerprint(key) + "="}},
+			nil, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyFingerprint,
+			Fingerprints: []string{hostKeyFingerprint(otherKey)}}, nil, false},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyKnownHosts}, []string{other, known}, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyKnownHosts}, []string{other}, false},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyKnownHosts}, nil, false},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyTofu}, nil, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyTofu}, []string{known}, true},
+		{&model.DeviceHostKey{Policy: model.HostKeyPolicyTofu}, []string{other}, false},
+	}
+	for index, test := range tests {
+		if err := checkHostKey(test.hostKey, test.knownKeys, key); (err == nil) != test.valid {
+			t.Errorf("Test %v expected valid %v, got error: %v", index, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitlab.com/cretz/fusty/model"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Telnet commands and options, ref: RFC 854 and RFC 855
+const (
+	telnetSe   byte = 240
+	telnetSb   byte = 250
+	telnetWill byte = 251
+	telnetWont byte = 252
+	telnetDo   byte = 253
+	telnetDont byte = 254
+	telnetIac  byte = 255
+
+	telnetOptionEcho            byte = 1
+	telnetOptionSuppressGoAhead byte = 3
+)
+
+const (
+	// How long to wait for the first login or password prompt
+	telnetLoginTimeout = 30 * time.Second
+	// How long to wait for the next prompt after answering one. If nothing
+	// shows, the device is assumed to have logged us in.
+	telnetLoginAnswerTimeout = 10 * time.Second
+)
+
+// What most shell prompts end with, used to tell that login is done when the
+// device has no prompt set
+var telnetShellPrompt = regexp.MustCompile(`[>#$%] ?$`)
+
+// telnetSession has a single shell over the connection. Commands can't be run
+// outside of it and files can't be fetched.
+type telnetSession struct {
+	device *model.Device
+	conn   net.Conn
+	// Closed when the session is
+	closed    chan bool
+	tShell    *telnetShell
+	shellUsed bool
+}
+
+func (t *telnetSession) authenticate(ctx context.Context, device *model.Device) error {
+	hostPort := device.Host + ":" + strconv.Itoa(device.DeviceProtocol.TelnetDeviceProtocol.Port)
+	if Verbose {
+		log.Printf("Starting telnet session on %v", hostPort)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return &classifiedFailure{model.FailureClassConnect, fmt.Errorf("Unable to connect to %v: %v", hostPort, err)}
+	}
+	t.device = device
+	t.conn = conn
+	// Same as SSH, closing the connection stops whatever is waiting on it
+	t.closed = make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-t.closed:
+		}
+	}()
+	t.tShell = newTelnetShell(conn)
+	go t.tShell.read()
+	return t.login(ctx)
+}
+
+// Answers the login and password prompts. Whatever the device shows after is
+// left for the shell.
+func (t *telnetSession) login(ctx context.Context) error {
+	user, pass := "", ""
+	if t.device.DeviceCredentials != nil {
+		user, pass = t.device.DeviceCredentials.User, t.device.DeviceCredentials.Pass
+	}
+	if user == "" && pass == "" {
+		return nil
+	}
+	loginPrompt, err := regexp.Compile(t.device.DeviceProtocol.TelnetDeviceProtocol.LoginPrompt)
+	if err != nil {
+		return fmt.Errorf("Invalid login prompt: %v", err)
+	}
+	passwordPrompt, err := regexp.Compile(t.device.DeviceProtocol.TelnetDeviceProtocol.PasswordPrompt)
+	if err != nil {
+		return fmt.Errorf("Invalid password prompt: %v", err)
+	}
+	shellPrompt := telnetShellPrompt
+	if t.device.Prompt != "" {
+		if shellPrompt, err = regexp.Compile(t.device.Prompt); err != nil {
+			return fmt.Errorf("Invalid prompt: %v", err)
+		}
+	}
+	sentUser, sentPass := false, false
+	for {
+		answered := sentUser || sentPass
+		timeout := telnetLoginTimeout
+		if answered {
+			timeout = telnetLoginAnswerTimeout
+		}
+		output, found, err := readShellUntil(ctx, t.tShell, nil, timeout, func(output []byte) bool {
+			return loginPrompt.Match(output) || passwordPrompt.Match(output) || (answered && shellPrompt.Match(output))
+		})
+		if err != nil {
+			return err
+		}
+		switch {
+		case loginPrompt.Match(output):
+			// Asking again means what we sent was wrong
+			if sentUser {
+				return errors.New("Login incorrect, device asked for the login again")
+			}
+			sentUser = true
+			if _, err := t.tShell.Write([]byte(user + "\n")); err != nil {
+				return fmt.Errorf("Unable to send login: %v", err)
+			}
+		case passwordPrompt.Match(output):
+			if sentPass {
+				return errors.New("Login incorrect, device asked for the password again")
+			}
+			sentPass = true
+			if _, err := t.tShell.Write([]byte(pass + "\n")); err != nil {
+				return fmt.Errorf("Unable to send password: %v", err)
+			}
+		case !found && !answered:
+			return errors.New("Device never showed a login or password prompt")
+		default:
+			t.tShell.out.unread(output)
+			return nil
+		}
+	}
+}
+
+func (t *telnetSession) close() error {
+	if t.closed != nil {
+		close(t.closed)
+	}
+	if t.conn != nil {
+		return t.conn.Close()
+	}
+	return nil
+}
+
+func (t *telnetSession) run(cmd string) ([]byte, error) {
+	return nil, errors.New("Commands can only be run in a shell over telnet")
+}
+
+func (t *telnetSession) fetchFile(path string) (io.ReadCloser, error) {
+	return nil, errors.New("Files cannot be fetched over telnet")
+}
+
+func (t *telnetSession) shell() (sessionShell, error) {
+	if t.shellUsed {
+		return nil, errors.New("Telnet sessions only have one shell")
+	}
+	t.shellUsed = true
+	return t.tShell, nil
+}
+
+func (t *telnetSession) firstSeenHostKey() string {
+	return ""
+}
+
+// telnetShell writes what it reads from the connection, minus telnet commands,
+// to its buffer
+type telnetShell struct {
+	conn net.Conn
+	// Negotiation replies are written as the connection is read
+	writeLock *sync.Mutex
+	out       *threadSafeByteBuffer
+}
+
+func newTelnetShell(conn net.Conn) *telnetShell {
+	return &telnetShell{conn: conn, writeLock: &sync.Mutex{}, out: newThreadSafeByteBuffer()}
+}
+
+// Runs until the connection is closed
+func (t *telnetShell) read() {
+	parser := newTelnetParser()
+	buf := make([]byte, 4096)
+	for {
+		n, err := t.conn.Read(buf)
+		if n > 0 {
+			data, replies := parser.parse(buf[:n])
+			if len(replies) > 0 {
+				t.writeRaw(replies)
+			}
+			if len(data) > 0 {
+				t.out.Write(data)
+			}
+		}
+		if err != nil {
+			if Verbose && err != io.EOF {
+				log.Printf("Telnet read ended: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// Escapes IAC and sends newlines as carriage return and newline like telnet
+// expects
+func (t *telnetShell) Write(p []byte) (int, error) {
+	escaped := make([]byte, 0, len(p))
+	for i, b := range p {
+		switch {
+		case b == telnetIac:
+			escaped = append(escaped, telnetIac, telnetIac)
+		case b == '\n' && (i == 0 || p[i-1] != '\r'):
+			escaped = append(escaped, '\r', '\n')
+		default:
+			escaped = append(escaped, b)
+		}
+	}
+	if _, err := t.writeRaw(escaped); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *telnetShell) writeRaw(p []byte) (int, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.conn.Write(p)
+}
+
+// The session closes the connection
+func (t *telnetShell) close() error {
+	return nil
+}
+
+func (t *telnetShell) bytesAndReset() []byte {
+	return t.out.bytesAndReset()
+}
+
+func (t *telnetShell) changed() <-chan bool {
+	return t.out.changedChan
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIac
+	telnetStateOption
+	telnetStateSub
+	telnetStateSubIac
+)
+
+// telnetParser removes telnet commands from what is read and builds replies to
+// option negotiation. Commands may be split across reads so state is kept.
+type telnetParser struct {
+	state   int
+	command byte
+	// Replies already sent, by verb and option, so we never reply in a loop
+	replied map[[2]byte]bool
+}
+
+func newTelnetParser() *telnetParser {
+	return &telnetParser{replied: map[[2]byte]bool{}}
+}
+
+func (t *telnetParser) parse(in []byte) (data []byte, replies []byte) {
+	for _, b := range in {
+		switch t.state {
+		case telnetStateData:
+			if b == telnetIac {
+				t.state = telnetStateIac
+			} else if b != 0 {
+				// Null only follows a carriage return and means nothing
+				data = append(data, b)
+			}
+		case telnetStateIac:
+			switch b {
+			case telnetIac:
+				data = append(data, b)
+				t.state = telnetStateData
+			case telnetWill, telnetWont, telnetDo, telnetDont:
+				t.command = b
+				t.state = telnetStateOption
+			case telnetSb:
+				t.state = telnetStateSub
+			default:
+				// Go ahead, no-op and the like mean nothing to us
+				t.state = telnetStateData
+			}
+		case telnetStateOption:
+			replies = append(replies, t.reply(t.command, b)...)
+			t.state = telnetStateData
+		case telnetStateSub:
+			if b == telnetIac {
+				t.state = telnetStateSubIac
+			}
+		case telnetStateSubIac:
+			if b == telnetSe {
+				t.state = telnetStateData
+			} else {
+				t.state = telnetStateSub
+			}
+		}
+	}
+	return
+}
+
+// We let the device echo and suppress go ahead but do nothing ourselves
+func (t *telnetParser) reply(command byte, option byte) []byte {
+	var verb byte
+	switch command {
+	case telnetWill:
+		if option == telnetOptionEcho || option == telnetOptionSuppressGoAhead {
+			verb = telnetDo
+		} else {
+			verb = telnetDont
+		}
+	case telnetWont:
+		verb = telnetDont
+	case telnetDo, telnetDont:
+		verb = telnetWont
+	}
+	key := [2]byte{verb, option}
+	if t.replied[key] {
+		return nil
+	}
+	t.replied[key] = true
+	return []byte{telnetIac, verb, option}
+}
@@ -0,0 +1,106 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"gitlab.com/cretz/fusty/config"
+	"gitlab.com/cretz/fusty/model"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTelnetParser(t *testing.T) {
+	parser := newTelnetParser()
+	// Will echo, do window size, a subnegotiation, an escaped IAC, and a
+	// command split across reads
+	reads := [][]byte{
+		{'a', telnetIac, telnetWill, telnetOptionEcho, 'b', telnetIac, telnetDo, 31, '\r', 0},
+		{telnetIac, telnetSb, 24, 1, telnetIac, telnetSe, 'c', telnetIac, telnetIac, telnetIac},
+		{telnetWill, 200, 'd', telnetIac, telnetWill, telnetOptionEcho},
+	}
+	data, replies := []byte{}, []byte{}
+	for _, read := range reads {
+		currData, currReplies := parser.parse(read)
+		data, replies = append(data, currData...), append(replies, currReplies...)
+	}
+	if expected := []byte{'a', 'b', '\r', 'c', telnetIac, 'd'}; !bytes.Equal(data, expected) {
+		t.Fatalf("Expected data %v, got %v", expected, data)
+	}
+	// The repeated will echo is not replied to again
+	expected := []byte{telnetIac, telnetDo, telnetOptionEcho, telnetIac, telnetWont, 31, telnetIac, telnetDont, 200}
+	if !bytes.Equal(replies, expected) {
+		t.Fatalf("Expected replies %v, got %v", expected, replies)
+	}
+}
+
+func TestTelnetSessionLogin(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		readLine := func() string {
+			line, _ := reader.ReadString('\n')
+			return line
+		}
+		conn.Write([]byte{telnetIac, telnetWill, telnetOptionEcho})
+		conn.Write([]byte("Welcome\r\nUsername: "))
+		// The reply to the negotiation comes first
+		reply := make([]byte, 3)
+		if _, err := reader.Read(reply); err != nil || !bytes.Equal(reply, []byte{telnetIac, telnetDo, telnetOptionEcho}) {
+			received <- "bad negotiation"
+			return
+		}
+		user := readLine()
+		conn.Write([]byte("Password: "))
+		pass := readLine()
+		conn.Write([]byte("\r\nrouter#"))
+		received <- user + pass + readLine()
+	}()
+	device := model.NewDefaultDevice("router")
+	port := listener.Addr().(*net.TCPAddr).Port
+	if err := device.ApplyConfig(&config.Device{
+		Host: "127.0.0.1",
+		DeviceProtocol: &config.DeviceProtocol{
+			Type:                 "telnet",
+			DeviceProtocolTelnet: &config.DeviceProtocolTelnet{Port: port},
+		},
+		DeviceCredentials: &config.DeviceCredentials{User: "admin", Pass: "secret"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := newSession(&model.Execution{Device: device})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sess.authenticate(ctx, device); err != nil {
+		t.Fatalf("Unable to login to port %v: %v", port, err)
+	}
+	shell, err := sess.shell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The prompt shown after login is left for the shell
+	if output, found, err := readShellUntil(ctx, shell, nil, time.Second, telnetShellPrompt.Match); err != nil || !found {
+		t.Fatalf("Prompt not found in %q, error: %v", output, err)
+	}
+	if _, err := shell.Write([]byte("show run\n")); err != nil {
+		t.Fatal(err)
+	}
+	if actual := <-received; actual != "admin\r\nsecret\r\nshow run\r\n" {
+		t.Fatalf("Unexpected input: %q", actual)
+	}
+}
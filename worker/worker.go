@@ -1,7 +1,6 @@
 package worker
 
 import (
-	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -9,6 +8,7 @@ import (
 	"fmt"
 	"github.com/hashicorp/go-syslog"
 	"gitlab.com/cretz/fusty/model"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
@@ -221,70 +221,40 @@ func (w *Worker) runExecutionAndPostResult(execution *model.Execution) {
 	w.runningExecutionCount += 1
 	w.runningExecutionCountLock.Unlock()
 
-	// Run job
-	result := runExecution(execution)
+	// Run job and post response to controller while the session is open
+	ctx, cancel := executionContext(execution.Job)
+	runExecution(ctx, execution, w.postResult)
+	cancel()
 
 	// Decrement running job count
 	w.runningExecutionCountLock.Lock()
 	w.runningExecutionCount -= 1
 	w.runningExecutionCountLock.Unlock()
+}
 
-	// Post response to controller
+func (w *Worker) postResult(result *result) {
 	url, err := url.Parse(w.conf.ControllerUrl + "/worker/complete")
 	if err != nil {
 		// This is panic worthy
 		panic(fmt.Errorf("Unable to parse URL: %v", err))
 	}
-	body := &bytes.Buffer{}
-	var postFailedErr error
-	formWriter := multipart.NewWriter(body)
-	postFailedErr = formWriter.WriteField("job", result.jobName)
-	if postFailedErr == nil {
-		postFailedErr = formWriter.WriteField("device", result.deviceName)
-	}
-	if postFailedErr == nil {
-		postFailedErr = formWriter.WriteField("job_timestamp", strconv.FormatInt(result.jobTimestamp, 10))
-	}
-	if postFailedErr == nil {
-		postFailedErr = formWriter.WriteField("start_timestamp", strconv.FormatInt(result.startTimestamp, 10))
-	}
-	if postFailedErr == nil {
-		postFailedErr = formWriter.WriteField("end_timestamp", strconv.FormatInt(result.endTimestamp, 10))
-	}
-	if postFailedErr == nil && result.failure != nil {
-		postFailedErr = formWriter.WriteField("failure", result.failure.Error())
-		if Verbose {
-			w.errLog.Printf("Job %v on device %v at expected time %v failed. Failure: %v",
-				result.jobName, result.deviceName, time.Unix(result.jobTimestamp, 0), result.failure)
-		}
-	}
-	if postFailedErr == nil && len(result.file) > 0 {
-		if file, err := formWriter.CreateFormFile("file", result.jobName); err != nil {
-			postFailedErr = fmt.Errorf("Unable to create form file HTTP param: %v", err)
-		} else if _, err := file.Write(result.file); err != nil {
-			postFailedErr = fmt.Errorf("Unable to write bytes to HTTP param: %v", err)
-		}
-	}
+	// The form is written as the request is sent so the file is never held in memory
+	body, bodyWriter := io.Pipe()
+	defer body.Close()
+	formWriter := multipart.NewWriter(bodyWriter)
+	go func() { bodyWriter.CloseWithError(w.writeResultForm(result, formWriter)) }()
+	req, postFailedErr := http.NewRequest("POST", url.String(), body)
 	if postFailedErr == nil {
-		postFailedErr = formWriter.Close()
-	} else {
-		formWriter.Close()
-	}
-	if postFailedErr == nil {
-		req, err := http.NewRequest("POST", url.String(), body)
+		req.Header.Set("Content-Type", formWriter.FormDataContentType())
+		resp, err := w.controllerClient.Do(req)
 		postFailedErr = err
 		if err == nil {
-			req.Header.Set("Content-Type", formWriter.FormDataContentType())
-			resp, err := w.controllerClient.Do(req)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
 			postFailedErr = err
-			if err != nil {
-				defer resp.Body.Close()
-				body, err := ioutil.ReadAll(resp.Body)
-				postFailedErr = err
-				if err == nil && resp.StatusCode != 200 {
-					postFailedErr = fmt.Errorf(
-						"Controller failed to accept post with status %v, body: %v", resp.Status, string(body))
-				}
+			if err == nil && resp.StatusCode != 200 {
+				postFailedErr = fmt.Errorf(
+					"Controller failed to accept post with status %v, body: %v", resp.Status, string(body))
 			}
 		}
 	}
@@ -294,3 +264,55 @@ func (w *Worker) runExecutionAndPostResult(execution *model.Execution) {
 			result.jobName, result.deviceName, time.Unix(result.startTimestamp, 0), postFailedErr)
 	}
 }
+
+// The file is written before the end timestamp and failure since writing it
+// may be what ends or fails the job
+func (w *Worker) writeResultForm(result *result, formWriter *multipart.Writer) error {
+	err := formWriter.WriteField("job", result.jobName)
+	if err == nil {
+		err = formWriter.WriteField("device", result.deviceName)
+	}
+	if err == nil && result.leaseId != "" {
+		err = formWriter.WriteField("lease_id", result.leaseId)
+	}
+	if err == nil && result.hostKey != "" {
+		err = formWriter.WriteField("host_key", result.hostKey)
+	}
+	if err == nil {
+		err = formWriter.WriteField("job_timestamp", strconv.FormatInt(result.jobTimestamp, 10))
+	}
+	if err == nil {
+		err = formWriter.WriteField("start_timestamp", strconv.FormatInt(result.startTimestamp, 10))
+	}
+	if err == nil && (len(result.file) > 0 || result.writeFile != nil) {
+		if file, createErr := formWriter.CreateFormFile("file", result.jobName); createErr != nil {
+			err = fmt.Errorf("Unable to create form file HTTP param: %v", createErr)
+		} else if result.writeFile != nil {
+			result.failure = result.writeFile(file)
+			result.endTimestamp = time.Now().Unix()
+		} else if _, writeErr := file.Write(result.file); writeErr != nil {
+			err = fmt.Errorf("Unable to write bytes to HTTP param: %v", writeErr)
+		}
+	}
+	if err == nil {
+		err = formWriter.WriteField("end_timestamp", strconv.FormatInt(result.endTimestamp, 10))
+	}
+	if err == nil {
+		// Every attempt including this one
+		attempts, jsonErr := json.Marshal(append(result.previousAttempts, result.attempt()))
+		if err = jsonErr; err == nil {
+			err = formWriter.WriteField("attempts", string(attempts))
+		}
+	}
+	if err == nil && result.failure != nil {
+		err = formWriter.WriteField("failure", result.failure.Error())
+		if Verbose {
+			w.errLog.Printf("Job %v on device %v at expected time %v failed. Failure: %v",
+				result.jobName, result.deviceName, time.Unix(result.jobTimestamp, 0), result.failure)
+		}
+	}
+	if err == nil {
+		err = formWriter.Close()
+	}
+	return err
+}